@@ -0,0 +1,42 @@
+// auth/admin.go
+
+package auth
+
+import (
+	"context"
+	"errors"
+)
+
+// AdminRole is the role EnsureAdmin gives the bootstrap administrator
+const AdminRole = "admin"
+
+// AdminPermission lets its holders call the management endpoints. EnsureAdmin
+// grants it to AdminRole; it can be granted to other roles like any permission.
+const AdminPermission = "auth:admin"
+
+// EnsureAdmin makes sure username exists and holds AdminRole, creating the
+// role, its permission and the user as needed. An existing user keeps their
+// password, so it is safe to call on every start to bootstrap the first admin.
+func (s *InMemoryAuthService) EnsureAdmin(username, password string) error {
+	ctx := context.Background()
+
+	err := s.store.CreateRole(ctx, Role{Name: AdminRole})
+	if err != nil && !errors.Is(err, ErrAlreadyExists) {
+		return err
+	}
+	if err := s.GrantPermission(AdminRole, AdminPermission); err != nil {
+		return err
+	}
+
+	_, err = s.store.GetUser(ctx, username)
+	if errors.Is(err, ErrNotFound) {
+		if password == "" {
+			return ErrAdminNeedsPassword
+		}
+		err = s.CreateUser(username, password)
+	}
+	if err != nil {
+		return err
+	}
+	return s.AddRoleToUser(username, AdminRole)
+}
@@ -0,0 +1,7 @@
+// auth/authgrpc/authpb/generate.go
+
+// Package authpb holds the protobuf messages and gRPC stubs of the
+// AuthService API, generated from auth.proto.
+package authpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative auth.proto
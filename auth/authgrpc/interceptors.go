@@ -0,0 +1,208 @@
+// auth/authgrpc/interceptors.go
+
+package authgrpc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gogorush/simple_auth/auth"
+	"github.com/gogorush/simple_auth/auth/authgrpc/authpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorDomain is the domain of the ErrorInfo detail attached to failed calls
+const ErrorDomain = "simple_auth"
+
+// Errors only the gRPC layer produces
+var (
+	errMissingParams = errors.New("missing parameters")
+	errMissingToken  = errors.New("missing access token")
+	errNotAdmin      = errors.New("admin permission required")
+)
+
+// access is what a method requires of its caller
+type access int
+
+const (
+	accessAdmin  access = iota // an access token holding auth.AdminPermission
+	accessToken                // an access token, checked by the call itself
+	accessPublic               // nothing; the request carries its own credentials
+)
+
+// methodAccess lists the methods that do not need an admin. Methods of the
+// service missing from it do, so a new method is closed until listed.
+var methodAccess = map[string]access{
+	authpb.AuthService_Authenticate_FullMethodName:    accessPublic,
+	authpb.AuthService_RefreshToken_FullMethodName:    accessPublic,
+	authpb.AuthService_ChangePassword_FullMethodName:  accessPublic,
+	authpb.AuthService_InvalidateToken_FullMethodName: accessToken,
+	authpb.AuthService_ValidateToken_FullMethodName:   accessToken,
+	authpb.AuthService_CheckUserRole_FullMethodName:   accessToken,
+	authpb.AuthService_CheckPermission_FullMethodName: accessToken,
+	authpb.AuthService_GetAllRoles_FullMethodName:     accessToken,
+	authpb.AuthService_GetDirectRoles_FullMethodName:  accessToken,
+}
+
+type tokenKey struct{}
+
+// TokenFromContext returns the access token AuthInterceptor took from the
+// call's metadata
+func TokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(tokenKey{}).(string)
+	return token, ok
+}
+
+// WithAccessToken returns a context whose outgoing calls present token in
+// the "authorization: Bearer" metadata entry
+func WithAccessToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+// AuthInterceptor authenticates calls to the AuthService methods with the
+// bearer token of their metadata, and requires an admin's token for the
+// management methods. Calls to other services on the server pass through.
+func AuthInterceptor(service auth.AuthService) grpc.UnaryServerInterceptor {
+	prefix := "/" + authpb.AuthService_ServiceDesc.ServiceName + "/"
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, prefix) {
+			return handler(ctx, req)
+		}
+		required, ok := methodAccess[info.FullMethod]
+		if !ok {
+			required = accessAdmin
+		}
+		if required == accessPublic {
+			return handler(ctx, req)
+		}
+
+		token, ok := bearerToken(ctx)
+		if !ok {
+			return nil, errMissingToken
+		}
+		if required == accessAdmin {
+			allowed, err := service.CheckPermission(token, auth.AdminPermission)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				return nil, errNotAdmin
+			}
+		}
+		return handler(context.WithValue(ctx, tokenKey{}, token), req)
+	}
+}
+
+// bearerToken returns the token of the call's "authorization: Bearer" entry
+func bearerToken(ctx context.Context) (string, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", false
+	}
+	scheme, token, _ := strings.Cut(values[0], " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// ErrorInterceptor turns the errors of the service into statuses. The code
+// follows the HTTP status of the same error, and an ErrorInfo detail carries
+// the problem code the HTTP API would have answered with.
+func ErrorInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, statusFor(err).Err()
+	}
+}
+
+// localErrors maps the gRPC layer's own errors to their code and problem code
+var localErrors = []struct {
+	err     error
+	code    codes.Code
+	problem string
+}{
+	{errMissingParams, codes.InvalidArgument, "missing_parameters"},
+	{errMissingToken, codes.Unauthenticated, "missing_token"},
+	{errNotAdmin, codes.PermissionDenied, "insufficient_scope"},
+}
+
+// httpCodes maps the HTTP status of a problem to the closest code
+var httpCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.FailedPrecondition,
+	http.StatusNotImplemented:      codes.Unimplemented,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+	http.StatusInternalServerError: codes.Internal,
+}
+
+// alreadyExists lists the conflicts that are about an existing record rather
+// than the state of one, which gRPC tells apart
+var alreadyExists = map[string]bool{
+	"user_exists":    true,
+	"role_exists":    true,
+	"key_exists":     true,
+	"already_exists": true,
+}
+
+func statusFor(err error) *status.Status {
+	for _, entry := range localErrors {
+		if errors.Is(err, entry.err) {
+			return withInfo(status.New(entry.code, err.Error()), entry.problem)
+		}
+	}
+
+	problem := auth.ProblemFor(err)
+	if problem.Status == http.StatusInternalServerError {
+		log.Printf("auth: %v", err)
+		return withInfo(status.New(codes.Internal, problem.Title), problem.Code)
+	}
+	code, ok := httpCodes[problem.Status]
+	if !ok {
+		code = codes.Unknown
+	}
+	if alreadyExists[problem.Code] {
+		code = codes.AlreadyExists
+	}
+	return withInfo(status.New(code, problem.Detail), problem.Code)
+}
+
+func withInfo(st *status.Status, reason string) *status.Status {
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: ErrorDomain})
+	if err != nil {
+		return st
+	}
+	return detailed
+}
+
+// ProblemCode returns the problem code of an error returned by a call to the
+// server, such as "role_in_use", or "" if the error carries none
+func ProblemCode(err error) string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return ""
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == ErrorDomain {
+			return info.Reason
+		}
+	}
+	return ""
+}
@@ -0,0 +1,262 @@
+// auth/authgrpc/server.go
+
+// Package authgrpc serves the AuthService operations over gRPC, for backends
+// that do not speak HTTP. The gRPC server is meant to share its AuthService
+// with the HTTP handlers, so that both see the same users, roles and tokens.
+package authgrpc
+
+import (
+	"context"
+
+	"github.com/gogorush/simple_auth/auth"
+	"github.com/gogorush/simple_auth/auth/authgrpc/authpb"
+	"google.golang.org/grpc"
+)
+
+// Server implements authpb.AuthServiceServer on top of an auth.AuthService.
+// It expects the interceptors NewServer installs: they authenticate calls
+// before they reach it, and turn the errors it returns into statuses.
+type Server struct {
+	authpb.UnimplementedAuthServiceServer
+	service auth.AuthService
+}
+
+// NewServer returns a gRPC server serving service, with the authentication
+// and error interceptors chained ahead of any interceptors in opts
+func NewServer(service auth.AuthService, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(ErrorInterceptor(), AuthInterceptor(service)),
+	}, opts...)
+	s := grpc.NewServer(opts...)
+	authpb.RegisterAuthServiceServer(s, &Server{service: service})
+	return s
+}
+
+var empty = &authpb.Empty{}
+
+func (s *Server) CreateUser(ctx context.Context, req *authpb.CreateUserRequest) (*authpb.Empty, error) {
+	if req.Username == "" || req.Password == "" {
+		return nil, errMissingParams
+	}
+	return empty, s.service.CreateUser(req.Username, req.Password)
+}
+
+func (s *Server) DeleteUser(ctx context.Context, req *authpb.DeleteUserRequest) (*authpb.Empty, error) {
+	if req.Username == "" {
+		return nil, errMissingParams
+	}
+	return empty, s.service.DeleteUser(req.Username)
+}
+
+func (s *Server) ChangePassword(ctx context.Context, req *authpb.ChangePasswordRequest) (*authpb.Empty, error) {
+	if req.Username == "" || req.OldPassword == "" || req.NewPassword == "" {
+		return nil, errMissingParams
+	}
+	return empty, s.service.ChangePassword(req.Username, req.OldPassword, req.NewPassword)
+}
+
+func (s *Server) RevokeUserTokens(ctx context.Context, req *authpb.RevokeUserTokensRequest) (*authpb.Empty, error) {
+	if req.Username == "" {
+		return nil, errMissingParams
+	}
+	return empty, s.service.RevokeUserTokens(req.Username)
+}
+
+func (s *Server) ListSessions(ctx context.Context, req *authpb.ListSessionsRequest) (*authpb.ListSessionsResponse, error) {
+	if req.Username == "" {
+		return nil, errMissingParams
+	}
+	sessions, err := s.service.ListSessions(req.Username)
+	if err != nil {
+		return nil, err
+	}
+	resp := &authpb.ListSessionsResponse{Sessions: make([]*authpb.Session, 0, len(sessions))}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, &authpb.Session{
+			Id:         session.ID,
+			Username:   session.Username,
+			ClientIp:   session.ClientIP,
+			UserAgent:  session.UserAgent,
+			IssuedAt:   session.IssuedAt,
+			ExpiresAt:  session.ExpiresAt,
+			LastUsedAt: session.LastUsedAt,
+		})
+	}
+	return resp, nil
+}
+
+func (s *Server) RevokeSession(ctx context.Context, req *authpb.RevokeSessionRequest) (*authpb.Empty, error) {
+	if req.Username == "" || req.SessionId == "" {
+		return nil, errMissingParams
+	}
+	return empty, s.service.RevokeSession(req.Username, req.SessionId)
+}
+
+func (s *Server) CreateRole(ctx context.Context, req *authpb.CreateRoleRequest) (*authpb.Empty, error) {
+	if req.RoleName == "" {
+		return nil, errMissingParams
+	}
+	return empty, s.service.CreateRole(req.RoleName)
+}
+
+func (s *Server) DeleteRole(ctx context.Context, req *authpb.DeleteRoleRequest) (*authpb.Empty, error) {
+	if req.RoleName == "" {
+		return nil, errMissingParams
+	}
+	if req.Cascade {
+		return empty, s.service.DeleteRoleCascade(req.RoleName)
+	}
+	return empty, s.service.DeleteRole(req.RoleName)
+}
+
+func (s *Server) GetRoleUsers(ctx context.Context, req *authpb.GetRoleUsersRequest) (*authpb.GetRoleUsersResponse, error) {
+	if req.RoleName == "" {
+		return nil, errMissingParams
+	}
+	usernames, err := s.service.GetRoleUsers(req.RoleName)
+	if err != nil {
+		return nil, err
+	}
+	return &authpb.GetRoleUsersResponse{Usernames: usernames}, nil
+}
+
+func (s *Server) AddRoleToUser(ctx context.Context, req *authpb.UserRoleRequest) (*authpb.Empty, error) {
+	if req.Username == "" || req.RoleName == "" {
+		return nil, errMissingParams
+	}
+	return empty, s.service.AddRoleToUser(req.Username, req.RoleName)
+}
+
+func (s *Server) RemoveRoleFromUser(ctx context.Context, req *authpb.UserRoleRequest) (*authpb.Empty, error) {
+	if req.Username == "" || req.RoleName == "" {
+		return nil, errMissingParams
+	}
+	return empty, s.service.RemoveRoleFromUser(req.Username, req.RoleName)
+}
+
+func (s *Server) GrantPermission(ctx context.Context, req *authpb.RolePermissionRequest) (*authpb.Empty, error) {
+	if req.RoleName == "" || req.Permission == "" {
+		return nil, errMissingParams
+	}
+	return empty, s.service.GrantPermission(req.RoleName, req.Permission)
+}
+
+func (s *Server) RevokePermission(ctx context.Context, req *authpb.RolePermissionRequest) (*authpb.Empty, error) {
+	if req.RoleName == "" || req.Permission == "" {
+		return nil, errMissingParams
+	}
+	return empty, s.service.RevokePermission(req.RoleName, req.Permission)
+}
+
+func (s *Server) AddChildRole(ctx context.Context, req *authpb.ChildRoleRequest) (*authpb.Empty, error) {
+	if req.RoleName == "" || req.ChildRoleName == "" {
+		return nil, errMissingParams
+	}
+	return empty, s.service.AddChildRole(req.RoleName, req.ChildRoleName)
+}
+
+func (s *Server) RemoveChildRole(ctx context.Context, req *authpb.ChildRoleRequest) (*authpb.Empty, error) {
+	if req.RoleName == "" || req.ChildRoleName == "" {
+		return nil, errMissingParams
+	}
+	return empty, s.service.RemoveChildRole(req.RoleName, req.ChildRoleName)
+}
+
+func (s *Server) Authenticate(ctx context.Context, req *authpb.AuthenticateRequest) (*authpb.TokenDetails, error) {
+	if req.Username == "" || req.Password == "" {
+		return nil, errMissingParams
+	}
+	tokens, err := s.service.Authenticate(req.Username, req.Password)
+	if err != nil {
+		return nil, err
+	}
+	return tokenDetails(tokens), nil
+}
+
+func (s *Server) RefreshToken(ctx context.Context, req *authpb.RefreshTokenRequest) (*authpb.TokenDetails, error) {
+	if req.RefreshToken == "" {
+		return nil, errMissingParams
+	}
+	tokens, err := s.service.RefreshToken(req.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+	return tokenDetails(tokens), nil
+}
+
+func (s *Server) InvalidateToken(ctx context.Context, _ *authpb.Empty) (*authpb.Empty, error) {
+	token, _ := TokenFromContext(ctx)
+	return empty, s.service.InvalidateToken(token)
+}
+
+func (s *Server) ValidateToken(ctx context.Context, _ *authpb.Empty) (*authpb.ValidateTokenResponse, error) {
+	token, _ := TokenFromContext(ctx)
+	username, err := s.service.ValidateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return &authpb.ValidateTokenResponse{Username: username}, nil
+}
+
+func (s *Server) CheckUserRole(ctx context.Context, req *authpb.CheckUserRoleRequest) (*authpb.CheckResponse, error) {
+	if req.RoleName == "" {
+		return nil, errMissingParams
+	}
+	token, _ := TokenFromContext(ctx)
+	allowed, err := s.service.CheckUserRole(token, req.RoleName)
+	if err != nil {
+		return nil, err
+	}
+	return &authpb.CheckResponse{Allowed: allowed}, nil
+}
+
+func (s *Server) CheckPermission(ctx context.Context, req *authpb.CheckPermissionRequest) (*authpb.CheckResponse, error) {
+	if req.Permission == "" {
+		return nil, errMissingParams
+	}
+	token, _ := TokenFromContext(ctx)
+	allowed, err := s.service.CheckPermission(token, req.Permission)
+	if err != nil {
+		return nil, err
+	}
+	return &authpb.CheckResponse{Allowed: allowed}, nil
+}
+
+func (s *Server) GetAllRoles(ctx context.Context, _ *authpb.Empty) (*authpb.RolesResponse, error) {
+	token, _ := TokenFromContext(ctx)
+	roles, err := s.service.GetAllRoles(token)
+	if err != nil {
+		return nil, err
+	}
+	return rolesResponse(roles), nil
+}
+
+func (s *Server) GetDirectRoles(ctx context.Context, _ *authpb.Empty) (*authpb.RolesResponse, error) {
+	token, _ := TokenFromContext(ctx)
+	roles, err := s.service.GetDirectRoles(token)
+	if err != nil {
+		return nil, err
+	}
+	return rolesResponse(roles), nil
+}
+
+func tokenDetails(tokens auth.TokenDetails) *authpb.TokenDetails {
+	return &authpb.TokenDetails{
+		Token:            tokens.Token,
+		ExpiresAt:        tokens.ExpiresAt,
+		RefreshToken:     tokens.RefreshToken,
+		RefreshExpiresAt: tokens.RefreshExpiresAt,
+	}
+}
+
+func rolesResponse(roles []auth.Role) *authpb.RolesResponse {
+	resp := &authpb.RolesResponse{Roles: make([]*authpb.Role, 0, len(roles))}
+	for _, role := range roles {
+		resp.Roles = append(resp.Roles, &authpb.Role{
+			Name:        role.Name,
+			Permissions: role.Ability,
+			Children:    role.Children,
+		})
+	}
+	return resp
+}
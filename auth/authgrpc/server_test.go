@@ -0,0 +1,182 @@
+// auth/authgrpc/server_test.go
+
+package authgrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/gogorush/simple_auth/auth"
+	"github.com/gogorush/simple_auth/auth/authgrpc/authpb"
+	"github.com/gogorush/simple_auth/auth/authtest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// setupServer serves a fresh service over an in-process listener
+func setupServer(t *testing.T) (*auth.InMemoryAuthService, authpb.AuthServiceClient) {
+	service := authtest.NewService(t)
+
+	listener := bufconn.Listen(1 << 20)
+	server := NewServer(service)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return service, authpb.NewAuthServiceClient(conn)
+}
+
+func TestServer(t *testing.T) {
+	_, client := setupServer(t)
+	ctx := context.Background()
+
+	root, err := client.Authenticate(ctx, &authpb.AuthenticateRequest{Username: authtest.Admin, Password: authtest.AdminPassword})
+	assert.Nil(t, err, "Error should be nil")
+	admin := WithAccessToken(ctx, root.Token)
+
+	_, err = client.CreateUser(admin, &authpb.CreateUserRequest{Username: "alice", Password: "alicepass"})
+	assert.Nil(t, err, "Error should be nil")
+	_, err = client.CreateRole(admin, &authpb.CreateRoleRequest{RoleName: "editor"})
+	assert.Nil(t, err, "Error should be nil")
+	_, err = client.CreateRole(admin, &authpb.CreateRoleRequest{RoleName: "viewer"})
+	assert.Nil(t, err, "Error should be nil")
+	_, err = client.AddChildRole(admin, &authpb.ChildRoleRequest{RoleName: "editor", ChildRoleName: "viewer"})
+	assert.Nil(t, err, "Error should be nil")
+	_, err = client.GrantPermission(admin, &authpb.RolePermissionRequest{RoleName: "viewer", Permission: "orders:read"})
+	assert.Nil(t, err, "Error should be nil")
+	_, err = client.AddRoleToUser(admin, &authpb.UserRoleRequest{Username: "alice", RoleName: "editor"})
+	assert.Nil(t, err, "Error should be nil")
+
+	users, err := client.GetRoleUsers(admin, &authpb.GetRoleUsersRequest{RoleName: "editor"})
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, []string{"alice"}, users.Usernames)
+
+	alice, err := client.Authenticate(ctx, &authpb.AuthenticateRequest{Username: "alice", Password: "alicepass"})
+	assert.Nil(t, err, "Error should be nil")
+	caller := WithAccessToken(ctx, alice.Token)
+
+	me, err := client.ValidateToken(caller, &authpb.Empty{})
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, "alice", me.Username)
+	check, err := client.CheckUserRole(caller, &authpb.CheckUserRoleRequest{RoleName: "viewer"})
+	assert.Nil(t, err, "Error should be nil")
+	assert.True(t, check.Allowed, "The role should be inherited")
+	check, err = client.CheckPermission(caller, &authpb.CheckPermissionRequest{Permission: "orders:read"})
+	assert.Nil(t, err, "Error should be nil")
+	assert.True(t, check.Allowed, "The permission should be inherited")
+	roles, err := client.GetAllRoles(caller, &authpb.Empty{})
+	assert.Nil(t, err, "Error should be nil")
+	assert.Len(t, roles.Roles, 2, "Both the direct and the inherited role should be listed")
+	roles, err = client.GetDirectRoles(caller, &authpb.Empty{})
+	assert.Nil(t, err, "Error should be nil")
+	assert.Len(t, roles.Roles, 1, "Only the direct role should be listed")
+
+	sessions, err := client.ListSessions(admin, &authpb.ListSessionsRequest{Username: "alice"})
+	assert.Nil(t, err, "Error should be nil")
+	assert.Len(t, sessions.Sessions, 1, "The login should be a session")
+
+	refreshed, err := client.RefreshToken(ctx, &authpb.RefreshTokenRequest{RefreshToken: alice.RefreshToken})
+	assert.Nil(t, err, "Error should be nil")
+	_, err = client.InvalidateToken(WithAccessToken(ctx, refreshed.Token), &authpb.Empty{})
+	assert.Nil(t, err, "Error should be nil")
+	_, err = client.ValidateToken(WithAccessToken(ctx, refreshed.Token), &authpb.Empty{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.DeleteRole(admin, &authpb.DeleteRoleRequest{RoleName: "editor"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, "role_in_use", ProblemCode(err))
+	_, err = client.DeleteRole(admin, &authpb.DeleteRoleRequest{RoleName: "editor", Cascade: true})
+	assert.Nil(t, err, "Error should be nil")
+	_, err = client.ChangePassword(ctx, &authpb.ChangePasswordRequest{Username: "alice", OldPassword: "alicepass", NewPassword: "newpass"})
+	assert.Nil(t, err, "Error should be nil")
+	_, err = client.DeleteUser(admin, &authpb.DeleteUserRequest{Username: "alice"})
+	assert.Nil(t, err, "Error should be nil")
+}
+
+func TestServerErrors(t *testing.T) {
+	service, client := setupServer(t)
+	ctx := context.Background()
+	service.CreateUser("alice", "alicepass")
+	root, _ := service.Authenticate(authtest.Admin, authtest.AdminPassword)
+	alice, _ := service.Authenticate("alice", "alicepass")
+	admin := WithAccessToken(ctx, root.Token)
+
+	cases := []struct {
+		name    string
+		call    func() error
+		code    codes.Code
+		problem string
+	}{
+		{"wrong password", func() error {
+			_, err := client.Authenticate(ctx, &authpb.AuthenticateRequest{Username: "alice", Password: "wrong"})
+			return err
+		}, codes.Unauthenticated, "invalid_credentials"},
+		{"missing parameters", func() error {
+			_, err := client.Authenticate(ctx, &authpb.AuthenticateRequest{Username: "alice"})
+			return err
+		}, codes.InvalidArgument, "missing_parameters"},
+		{"existing user", func() error {
+			_, err := client.CreateUser(admin, &authpb.CreateUserRequest{Username: "alice", Password: "alicepass"})
+			return err
+		}, codes.AlreadyExists, "user_exists"},
+		{"missing role", func() error {
+			_, err := client.AddRoleToUser(admin, &authpb.UserRoleRequest{Username: "alice", RoleName: "nope"})
+			return err
+		}, codes.NotFound, "role_not_found"},
+		{"no token", func() error {
+			_, err := client.CreateRole(ctx, &authpb.CreateRoleRequest{RoleName: "editor"})
+			return err
+		}, codes.Unauthenticated, "missing_token"},
+		{"not an admin", func() error {
+			_, err := client.CreateRole(WithAccessToken(ctx, alice.Token), &authpb.CreateRoleRequest{RoleName: "editor"})
+			return err
+		}, codes.PermissionDenied, "insufficient_scope"},
+		{"invalid token", func() error {
+			_, err := client.CreateRole(WithAccessToken(ctx, "not-a-token"), &authpb.CreateRoleRequest{RoleName: "editor"})
+			return err
+		}, codes.Unauthenticated, "invalid_token"},
+		{"caller without token", func() error {
+			_, err := client.GetAllRoles(ctx, &authpb.Empty{})
+			return err
+		}, codes.Unauthenticated, "missing_token"},
+		{"refresh token as access token", func() error {
+			_, err := client.ValidateToken(WithAccessToken(ctx, alice.RefreshToken), &authpb.Empty{})
+			return err
+		}, codes.Unauthenticated, "invalid_token"},
+	}
+	for _, tc := range cases {
+		err := tc.call()
+		assert.Equal(t, tc.code, status.Code(err), tc.name)
+		assert.Equal(t, tc.problem, ProblemCode(err), tc.name)
+	}
+}
+
+func TestServerSharesService(t *testing.T) {
+	service, client := setupServer(t)
+	ctx := context.Background()
+	service.CreateUser("alice", "alicepass")
+
+	// a token issued by the service outside gRPC, as the HTTP API would
+	tokens, _ := service.Authenticate("alice", "alicepass")
+	me, err := client.ValidateToken(WithAccessToken(ctx, tokens.Token), &authpb.Empty{})
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, "alice", me.Username)
+
+	// and revoked outside it
+	service.RevokeUserTokens("alice")
+	_, err = client.ValidateToken(WithAccessToken(ctx, tokens.Token), &authpb.Empty{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
@@ -0,0 +1,42 @@
+// auth/authtest/authtest.go
+
+// Package authtest runs the auth service for the tests of the packages built
+// on top of it. Each call starts from a fresh memory store, so tests do not
+// share users, roles or tokens.
+package authtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gogorush/simple_auth/auth"
+)
+
+// The credentials of the admin NewService bootstraps
+const (
+	Admin         = "root"
+	AdminPassword = "rootpass"
+)
+
+// NewService returns a service on a fresh memory store, with Admin holding
+// auth.AdminPermission. opts are passed on to auth.NewInMemoryAuthService.
+func NewService(t testing.TB, opts ...auth.ServiceOption) *auth.InMemoryAuthService {
+	t.Helper()
+	service := auth.NewInMemoryAuthService(auth.NewMemoryStore(), opts...)
+	if err := service.EnsureAdmin(Admin, AdminPassword); err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+// NewServer serves the HTTP API of service behind a test server, which is
+// closed when the test ends
+func NewServer(t testing.TB, service auth.AuthService) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	auth.NewHandler(service).RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
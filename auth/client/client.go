@@ -0,0 +1,376 @@
+// auth/client/client.go
+
+// Package client talks to the auth service's /v1 API. Its Client implements
+// auth.AuthService, so code written against the service runs unchanged
+// against a remote instance.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogorush/simple_auth/auth"
+)
+
+// ErrNoCredentials is returned by calls to management endpoints on a Client
+// created without WithCredentials
+var ErrNoCredentials = errors.New("client has no admin credentials")
+
+// refreshSkew is how long before its expiry the client's own access token
+// is refreshed, so it does not lapse in flight
+const refreshSkew = 30 * time.Second
+
+// Client is an auth.AuthService backed by the HTTP API. Errors received from
+// the service are auth.Problem values that match the auth package's errors
+// with errors.Is. A Client is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	timeout    time.Duration
+	retries    int
+	backoff    time.Duration
+
+	// the client's own session, used for the management endpoints
+	mu       sync.Mutex
+	username string
+	password string
+	tokens   auth.TokenDetails
+}
+
+var _ auth.AuthService = (*Client)(nil)
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sends requests with httpClient instead of http.DefaultClient
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTimeout bounds every attempt of a call; the default is ten seconds
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries retries idempotent calls up to retries times when the service
+// cannot be reached or answers 502, 503 or 504, waiting backoff before the
+// first retry and twice as long before each next one. The default is two
+// retries starting at 100ms. POST calls, such as logins, are never retried,
+// as the first attempt may have taken effect.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// WithCredentials has the client log in as an admin user for the management
+// endpoints. It logs in on first use and refreshes its tokens as they expire
+// or are revoked.
+func WithCredentials(username, password string) Option {
+	return func(c *Client) {
+		c.username = username
+		c.password = password
+	}
+}
+
+// New returns a Client for the service at baseURL, e.g. https://auth.example.com
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		timeout:    10 * time.Second,
+		retries:    2,
+		backoff:    100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Client) CreateUser(username, password string) error {
+	return c.admin(http.MethodPost, "/v1/users", auth.UserRequest{Username: username, Password: password}, nil)
+}
+
+func (c *Client) DeleteUser(username string) error {
+	return c.admin(http.MethodDelete, apiPath("users", username), nil, nil)
+}
+
+func (c *Client) ChangePassword(username, oldPassword, newPassword string) error {
+	body := auth.UserRequest{Password: oldPassword, NewPassword: newPassword}
+	return c.call(http.MethodPut, apiPath("users", username, "password"), "", body, nil)
+}
+
+func (c *Client) RevokeUserTokens(username string) error {
+	return c.admin(http.MethodDelete, apiPath("users", username, "tokens"), nil, nil)
+}
+
+func (c *Client) ListSessions(username string) ([]auth.Session, error) {
+	var sessions []auth.Session
+	err := c.admin(http.MethodGet, apiPath("users", username, "sessions"), nil, &sessions)
+	return sessions, err
+}
+
+func (c *Client) RevokeSession(username, sessionID string) error {
+	return c.admin(http.MethodDelete, apiPath("users", username, "sessions", sessionID), nil, nil)
+}
+
+func (c *Client) CreateRole(roleName string) error {
+	return c.admin(http.MethodPost, "/v1/roles", auth.UserRequest{RoleName: roleName}, nil)
+}
+
+func (c *Client) DeleteRole(roleName string) error {
+	return c.admin(http.MethodDelete, apiPath("roles", roleName), nil, nil)
+}
+
+func (c *Client) DeleteRoleCascade(roleName string) error {
+	return c.admin(http.MethodDelete, apiPath("roles", roleName)+"?cascade=true", nil, nil)
+}
+
+func (c *Client) GetRoleUsers(roleName string) ([]string, error) {
+	var usernames []string
+	err := c.admin(http.MethodGet, apiPath("roles", roleName, "users"), nil, &usernames)
+	return usernames, err
+}
+
+func (c *Client) AddRoleToUser(username, roleName string) error {
+	return c.admin(http.MethodPut, apiPath("users", username, "roles", roleName), nil, nil)
+}
+
+func (c *Client) RemoveRoleFromUser(username, roleName string) error {
+	return c.admin(http.MethodDelete, apiPath("users", username, "roles", roleName), nil, nil)
+}
+
+func (c *Client) GrantPermission(roleName, permission string) error {
+	return c.admin(http.MethodPut, apiPath("roles", roleName, "permissions", permission), nil, nil)
+}
+
+func (c *Client) RevokePermission(roleName, permission string) error {
+	return c.admin(http.MethodDelete, apiPath("roles", roleName, "permissions", permission), nil, nil)
+}
+
+func (c *Client) AddChildRole(parentRoleName, childRoleName string) error {
+	return c.admin(http.MethodPut, apiPath("roles", parentRoleName, "children", childRoleName), nil, nil)
+}
+
+func (c *Client) RemoveChildRole(parentRoleName, childRoleName string) error {
+	return c.admin(http.MethodDelete, apiPath("roles", parentRoleName, "children", childRoleName), nil, nil)
+}
+
+func (c *Client) Authenticate(username, password string) (auth.TokenDetails, error) {
+	var tokens auth.TokenDetails
+	err := c.call(http.MethodPost, "/v1/tokens", "", auth.UserRequest{Username: username, Password: password}, &tokens)
+	return tokens, err
+}
+
+func (c *Client) RefreshToken(refreshToken string) (auth.TokenDetails, error) {
+	var tokens auth.TokenDetails
+	err := c.call(http.MethodPost, "/v1/tokens/refresh", "", auth.UserRequest{RefreshToken: refreshToken}, &tokens)
+	return tokens, err
+}
+
+func (c *Client) InvalidateToken(tokenString string) error {
+	return c.call(http.MethodDelete, "/v1/tokens/current", tokenString, nil, nil)
+}
+
+func (c *Client) ValidateToken(tokenString string) (string, error) {
+	var me struct {
+		Username string `json:"username"`
+	}
+	err := c.call(http.MethodGet, "/v1/me", tokenString, nil, &me)
+	return me.Username, err
+}
+
+func (c *Client) CheckUserRole(tokenString, roleName string) (bool, error) {
+	var result struct {
+		HasRole bool `json:"hasRole"`
+	}
+	err := c.call(http.MethodGet, apiPath("me", "roles", roleName), tokenString, nil, &result)
+	return result.HasRole, err
+}
+
+func (c *Client) GetAllRoles(tokenString string) ([]auth.Role, error) {
+	var roles []auth.Role
+	err := c.call(http.MethodGet, "/v1/me/roles", tokenString, nil, &roles)
+	return roles, err
+}
+
+func (c *Client) GetDirectRoles(tokenString string) ([]auth.Role, error) {
+	var roles []auth.Role
+	err := c.call(http.MethodGet, "/v1/me/direct-roles", tokenString, nil, &roles)
+	return roles, err
+}
+
+func (c *Client) CheckPermission(tokenString, permission string) (bool, error) {
+	var result struct {
+		HasPermission bool `json:"hasPermission"`
+	}
+	err := c.call(http.MethodGet, apiPath("me", "permissions", permission), tokenString, nil, &result)
+	return result.HasPermission, err
+}
+
+// apiPath joins segments under /v1, escaping each so that names may hold any character
+func apiPath(segments ...string) string {
+	var b strings.Builder
+	b.WriteString("/v1")
+	for _, segment := range segments {
+		b.WriteByte('/')
+		b.WriteString(url.PathEscape(segment))
+	}
+	return b.String()
+}
+
+// admin makes a call authenticated as the client's own admin session. A
+// token the service turns down is renewed and the call made once more, as
+// it may have been revoked or have expired early.
+func (c *Client) admin(method, path string, body, out interface{}) error {
+	token, err := c.sessionToken("")
+	if err != nil {
+		return err
+	}
+	err = c.call(method, path, token, body, out)
+	if !errors.Is(err, auth.ErrInvalidToken) && !errors.Is(err, auth.ErrTokenExpired) {
+		return err
+	}
+	if token, err = c.sessionToken(token); err != nil {
+		return err
+	}
+	return c.call(method, path, token, body, out)
+}
+
+// sessionToken returns the access token of the client's own session, logging
+// in or refreshing as needed. A non-empty rejected names a token the service
+// turned down; it is replaced unless another call replaced it already.
+func (c *Client) sessionToken(rejected string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := c.tokens.Token != "" && c.tokens.Token != rejected
+	if current && (rejected != "" || time.Now().Add(refreshSkew).Unix() < c.tokens.ExpiresAt) {
+		return c.tokens.Token, nil
+	}
+	// refresh tokens rotate on every use, so only one refresh may be in
+	// flight: presenting a rotated-out one would revoke the whole session
+	if c.tokens.RefreshToken != "" {
+		tokens, err := c.RefreshToken(c.tokens.RefreshToken)
+		if err == nil {
+			c.tokens = tokens
+			return tokens.Token, nil
+		}
+		// expired or revoked: log in again
+	}
+	if c.username == "" {
+		return "", ErrNoCredentials
+	}
+	tokens, err := c.Authenticate(c.username, c.password)
+	if err != nil {
+		return "", err
+	}
+	c.tokens = tokens
+	return tokens.Token, nil
+}
+
+// call sends one API call, retrying as configured, and decodes the JSON
+// response into out. token, when set, is sent as a bearer token.
+func (c *Client) call(method, path, token string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	retries := c.retries
+	if method == http.MethodPost {
+		retries = 0
+	}
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := c.attempt(method, path, token, payload, out)
+		if err == nil || !retry || attempt >= retries {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// attempt makes one request, reporting whether a failure is worth retrying
+func (c *Client) attempt(method, path, token string, payload []byte, out interface{}) (retry bool, err error) {
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+
+	if resp.StatusCode >= 400 {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			retry = true
+		}
+		return retry, problem(resp, data)
+	}
+	// lists come back as an empty body when there is nothing in them
+	if out == nil || len(bytes.TrimSpace(data)) == 0 {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return false, fmt.Errorf("decoding %s %s response: %w", method, path, err)
+	}
+	return false, nil
+}
+
+// problem turns an error response into an auth.Problem. Responses that are
+// not problem documents, such as a proxy's error page, keep their status.
+func problem(resp *http.Response, data []byte) auth.Problem {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "application/problem+json" {
+		var p auth.Problem
+		if err := json.Unmarshal(data, &p); err == nil {
+			return p
+		}
+	}
+	return auth.Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(resp.StatusCode),
+		Status: resp.StatusCode,
+		Detail: strings.TrimSpace(string(data)),
+	}
+}
@@ -0,0 +1,147 @@
+// auth/client/client_test.go
+
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogorush/simple_auth/auth"
+	"github.com/gogorush/simple_auth/auth/authtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	server := authtest.NewServer(t, authtest.NewService(t))
+	c := New(server.URL, WithHTTPClient(server.Client()), WithCredentials(authtest.Admin, authtest.AdminPassword))
+
+	assert.Nil(t, c.CreateUser("alice", "alicepass"), "Error should be nil")
+	assert.ErrorIs(t, c.CreateUser("alice", "alicepass"), auth.ErrUserExists)
+	assert.Nil(t, c.CreateRole("editor"), "Error should be nil")
+	assert.Nil(t, c.CreateRole("viewer"), "Error should be nil")
+	assert.Nil(t, c.AddChildRole("editor", "viewer"), "Error should be nil")
+	assert.ErrorIs(t, c.AddChildRole("viewer", "editor"), auth.ErrRoleCycle)
+	assert.Nil(t, c.GrantPermission("viewer", "orders/archive:read"), "Permissions may hold a slash")
+	assert.Nil(t, c.AddRoleToUser("alice", "editor"), "Error should be nil")
+	assert.ErrorIs(t, c.AddRoleToUser("bob", "editor"), auth.ErrUserNotFound)
+
+	usernames, err := c.GetRoleUsers("editor")
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, []string{"alice"}, usernames)
+
+	_, err = c.Authenticate("alice", "wrong")
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+	tokens, err := c.Authenticate("alice", "alicepass")
+	assert.Nil(t, err, "Error should be nil")
+
+	username, err := c.ValidateToken(tokens.Token)
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, "alice", username)
+	hasRole, err := c.CheckUserRole(tokens.Token, "viewer")
+	assert.Nil(t, err, "Error should be nil")
+	assert.True(t, hasRole, "The role should be inherited")
+	hasPermission, err := c.CheckPermission(tokens.Token, "orders/archive:read")
+	assert.Nil(t, err, "Error should be nil")
+	assert.True(t, hasPermission, "The permission should be inherited")
+	roles, err := c.GetAllRoles(tokens.Token)
+	assert.Nil(t, err, "Error should be nil")
+	assert.Len(t, roles, 2, "Both the direct and the inherited role should be listed")
+	roles, err = c.GetDirectRoles(tokens.Token)
+	assert.Nil(t, err, "Error should be nil")
+	assert.Len(t, roles, 1, "Only the direct role should be listed")
+
+	sessions, err := c.ListSessions("alice")
+	assert.Nil(t, err, "Error should be nil")
+	assert.Len(t, sessions, 1, "The login should be a session")
+
+	refreshed, err := c.RefreshToken(tokens.RefreshToken)
+	assert.Nil(t, err, "Error should be nil")
+	_, err = c.RefreshToken(tokens.RefreshToken)
+	assert.ErrorIs(t, err, auth.ErrRefreshTokenReused)
+
+	_, err = c.ValidateToken(refreshed.Token)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken, "Reuse should have revoked the session")
+
+	assert.ErrorIs(t, c.DeleteRole("editor"), auth.ErrRoleInUse)
+	assert.Nil(t, c.DeleteRoleCascade("editor"), "Error should be nil")
+	assert.Nil(t, c.ChangePassword("alice", "alicepass", "newpass"), "Error should be nil")
+	assert.Nil(t, c.DeleteUser("alice"), "Error should be nil")
+}
+
+func TestClientTokenRefresh(t *testing.T) {
+	service := authtest.NewService(t)
+	server := authtest.NewServer(t, service)
+	c := New(server.URL, WithHTTPClient(server.Client()), WithCredentials(authtest.Admin, authtest.AdminPassword))
+
+	assert.Nil(t, c.CreateRole("first"), "The client should log in on first use")
+	first := c.tokens
+
+	// about to expire: refreshed before use
+	c.tokens.ExpiresAt = time.Now().Unix()
+	assert.Nil(t, c.CreateRole("second"), "Error should be nil")
+	assert.NotEqual(t, first.Token, c.tokens.Token, "The access token should have been refreshed")
+	assert.NotEqual(t, first.RefreshToken, c.tokens.RefreshToken, "The refresh token should have rotated")
+
+	// revoked behind the client's back: renewed and the call retried
+	service.InvalidateToken(c.tokens.Token)
+	assert.Nil(t, c.CreateRole("third"), "Error should be nil")
+
+	// the whole session revoked: the client logs in again
+	service.RevokeUserTokens(authtest.Admin)
+	assert.Nil(t, c.CreateRole("fourth"), "Error should be nil")
+
+	anonymous := New(server.URL, WithHTTPClient(server.Client()))
+	assert.ErrorIs(t, anonymous.CreateRole("fifth"), ErrNoCredentials)
+}
+
+func TestClientRetries(t *testing.T) {
+	server := authtest.NewServer(t, authtest.NewService(t))
+
+	// the first request of every call fails as if the service were restarting
+	var requests, failures atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1)%2 == 1 {
+			failures.Add(1)
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+			return
+		}
+		proxy, _ := http.NewRequest(r.Method, server.URL+r.URL.String(), r.Body)
+		proxy.Header = r.Header
+		resp, err := server.Client().Do(proxy)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer flaky.Close()
+
+	direct := New(server.URL, WithHTTPClient(server.Client()), WithCredentials(authtest.Admin, authtest.AdminPassword))
+	tokens, _ := direct.Authenticate(authtest.Admin, authtest.AdminPassword)
+
+	c := New(flaky.URL, WithRetries(2, time.Millisecond))
+	username, err := c.ValidateToken(tokens.Token)
+	assert.Nil(t, err, "The failed attempt should have been retried")
+	assert.Equal(t, authtest.Admin, username)
+	assert.Equal(t, int32(1), failures.Load())
+
+	// logins are not retried: the failed attempt might have gone through
+	_, err = c.Authenticate(authtest.Admin, authtest.AdminPassword)
+	var problem auth.Problem
+	assert.ErrorAs(t, err, &problem)
+	assert.Equal(t, http.StatusServiceUnavailable, problem.Status)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	_, err = New(slow.URL, WithTimeout(20*time.Millisecond), WithRetries(0, 0)).ValidateToken(tokens.Token)
+	assert.NotNil(t, err, "The call should time out")
+}
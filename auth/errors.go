@@ -0,0 +1,37 @@
+// auth/errors.go
+
+package auth
+
+import "errors"
+
+// Errors returned by the service. Callers should match them with errors.Is,
+// as some are wrapped with details; the HTTP API reports each under a
+// stable code, see problem.go.
+var (
+	ErrUserExists         = errors.New("user already exists")
+	ErrUserNotFound       = errors.New("user does not exist")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	ErrRoleExists        = errors.New("role already exists")
+	ErrRoleNotFound      = errors.New("role does not exist")
+	ErrRoleInUse         = errors.New("role is still assigned to users")
+	ErrRoleCycle         = errors.New("role hierarchy would contain a cycle")
+	ErrInvalidPermission = errors.New("invalid permission")
+
+	// ErrInvalidToken covers access tokens that are malformed, badly signed,
+	// revoked or unknown; expired ones get ErrTokenExpired instead
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token has expired")
+
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+	ErrRefreshTokenExpired = errors.New("refresh token expired")
+
+	ErrSessionNotFound = errors.New("session does not exist")
+
+	ErrKeyExists   = errors.New("signing key already exists")
+	ErrKeyNotFound = errors.New("signing key does not exist")
+	ErrKeyActive   = errors.New("cannot retire the active signing key")
+
+	ErrAdminNeedsPassword = errors.New("a password is needed to create the admin user")
+)
@@ -0,0 +1,904 @@
+// auth/file_store.go
+
+package auth
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls when the write-ahead log is flushed to stable storage
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every mutation; nothing acknowledged is ever lost
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background every FileStoreOptions.SyncInterval
+	SyncInterval
+	// SyncNever leaves flushing to the operating system
+	SyncNever
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+
+	// every WAL record is framed as <payload length><crc32 of payload><payload>
+	walHeaderSize = 8
+	// records larger than this are treated as corruption rather than allocated
+	walMaxRecordSize = 16 << 20
+)
+
+var walChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTruncatedRecord reports a WAL record cut short by the end of the log
+var errTruncatedRecord = errors.New("truncated record")
+
+// FileStoreOptions tunes durability and compaction of a FileStore
+type FileStoreOptions struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration // used with SyncInterval, defaults to one second
+	// SnapshotEvery compacts the log into a new snapshot after this many
+	// records; zero disables automatic snapshots.
+	SnapshotEvery int
+}
+
+var _ Store = (*FileStore)(nil)
+
+// FileStore is a Store that survives restarts. Every mutation is appended to
+// a write-ahead log before it is applied in memory, and the log is
+// periodically folded into a snapshot so replay at startup stays short.
+type FileStore struct {
+	mu    sync.RWMutex
+	dir   string
+	opts  FileStoreOptions
+	state fileStoreState
+
+	wal        *os.File
+	walSize    int64 // offset the next record is appended at
+	walRecords int   // records appended since the last snapshot
+	failed     error // set when a failed append could not be rolled back
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// fileStoreState is the in-memory image of the store, and also the snapshot
+// format. Like SQLStore it keeps only digests of access and refresh tokens,
+// so neither the log nor the snapshot holds a usable credential.
+type fileStoreState struct {
+	Seq           uint64                  `json:"seq"` // sequence number of the last applied record
+	Users         map[string]User         `json:"users"`
+	Roles         map[string]Role         `json:"roles"`
+	Tokens        map[string]string       `json:"tokens"`        // access token digest -> username
+	TokenExpiry   map[string]int64        `json:"tokenExpiry"`   // access token digest -> Unix expiry, when known
+	RefreshTokens map[string]RefreshToken `json:"refreshTokens"` // refresh token digest -> record holding the access token digest
+	Sessions      map[string]Session      `json:"sessions"`
+
+	byUser map[string]map[string]struct{} // username -> access and refresh tokens
+	byRole map[string]map[string]struct{} // role name -> usernames holding it
+}
+
+type walOp string
+
+const (
+	opPutUser     walOp = "put_user"
+	opDeleteUser  walOp = "delete_user"
+	opPutRole     walOp = "put_role"
+	opDeleteRole  walOp = "delete_role"
+	opSaveToken   walOp = "save_token"
+	opDeleteToken walOp = "delete_token"
+
+	opDeleteUserTokens walOp = "delete_user_tokens"
+	opResetUser        walOp = "reset_user" // put_user and delete_user_tokens at once
+
+	opSaveRefresh  walOp = "save_refresh"
+	opUseRefresh   walOp = "use_refresh"
+	opDeleteFamily walOp = "delete_family"
+
+	opSaveSession  walOp = "save_session"
+	opRenewSession walOp = "renew_session" // save_token, save_refresh and save_session at once
+
+	opDeleteExpired walOp = "delete_expired"
+)
+
+type walRecord struct {
+	Seq      uint64        `json:"seq"`
+	Op       walOp         `json:"op"`
+	User     *User         `json:"user,omitempty"`
+	Role     *Role         `json:"role,omitempty"`
+	Refresh  *RefreshToken `json:"refresh,omitempty"`
+	Session  *Session      `json:"session,omitempty"`
+	Key      string        `json:"key,omitempty"`
+	Username string        `json:"username,omitempty"`
+	Time     int64         `json:"time,omitempty"` // token expiry, or the cutoff of delete_expired
+}
+
+// OpenFileStore loads the snapshot and replays the log found in dir, creating
+// the directory if needed. A record torn by a crash at the end of the log is
+// discarded and the log truncated back to the last complete record. A bad
+// record with more of the log after it cannot come from a crash, so it fails
+// the open and the log is left untouched.
+func OpenFileStore(dir string, opts FileStoreOptions) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if opts.Sync == SyncInterval && opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+
+	f := &FileStore{dir: dir, opts: opts, state: newFileStoreState()}
+	if err := f.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := f.replayWAL(); err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval {
+		f.stop = make(chan struct{})
+		f.done = make(chan struct{})
+		go f.syncLoop()
+	}
+	return f, nil
+}
+
+func newFileStoreState() fileStoreState {
+	return fileStoreState{
+		Users:  make(map[string]User),
+		Roles:  make(map[string]Role),
+		Tokens: make(map[string]string),
+
+		TokenExpiry:   make(map[string]int64),
+		RefreshTokens: make(map[string]RefreshToken),
+		Sessions:      make(map[string]Session),
+
+		byUser: make(map[string]map[string]struct{}),
+		byRole: make(map[string]map[string]struct{}),
+	}
+}
+
+func (f *FileStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(f.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := newFileStoreState()
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("corrupt snapshot: %w", err)
+	}
+	state.reindex()
+	f.state = state
+	return nil
+}
+
+func (f *FileStore) replayWAL() error {
+	wal, err := os.OpenFile(filepath.Join(f.dir, walFileName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := wal.Stat()
+	if err != nil {
+		wal.Close()
+		return err
+	}
+
+	reader := bufio.NewReader(wal)
+	var offset int64
+	for {
+		record, size, err := readWALRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// a crash mid-append can only damage the record running to the
+			// end of the log; dropping a bad record in the middle would
+			// silently lose every record after it
+			if !errors.Is(err, errTruncatedRecord) && offset+size < info.Size() {
+				wal.Close()
+				return fmt.Errorf("corrupt log record at offset %d: %w", offset, err)
+			}
+			if err := wal.Truncate(offset); err != nil {
+				wal.Close()
+				return err
+			}
+			break
+		}
+		offset += size
+		// records already folded into the snapshot are skipped
+		if record.Seq > f.state.Seq {
+			f.state.apply(record)
+		}
+		f.walRecords++
+	}
+
+	if _, err := wal.Seek(offset, io.SeekStart); err != nil {
+		wal.Close()
+		return err
+	}
+	f.wal = wal
+	f.walSize = offset
+	return nil
+}
+
+// readWALRecord reads the next record and its size on disk. The size is also
+// returned alongside errors for records whose header could be read, so the
+// caller can tell how far the bad record claims to reach.
+func readWALRecord(r io.Reader) (walRecord, int64, error) {
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return walRecord{}, 0, fmt.Errorf("%w header", errTruncatedRecord)
+		}
+		return walRecord{}, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	size := int64(walHeaderSize) + int64(length)
+	if length > walMaxRecordSize {
+		return walRecord{}, size, errors.New("record length out of range")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return walRecord{}, size, fmt.Errorf("%w payload", errTruncatedRecord)
+	}
+	if crc32.Checksum(payload, walChecksumTable) != checksum {
+		return walRecord{}, size, errors.New("record checksum mismatch")
+	}
+
+	var record walRecord
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return walRecord{}, size, err
+	}
+	return record, size, nil
+}
+
+func (s *fileStoreState) apply(record walRecord) {
+	switch record.Op {
+	case opPutUser:
+		s.indexRoles(record.User.Username, false)
+		s.Users[record.User.Username] = cloneUser(*record.User)
+		s.indexRoles(record.User.Username, true)
+	case opDeleteUser:
+		s.indexRoles(record.Key, false)
+		delete(s.Users, record.Key)
+		s.deleteUserTokens(record.Key)
+	case opPutRole:
+		s.Roles[record.Role.Name] = *record.Role
+	case opDeleteRole:
+		s.deleteRole(record.Key)
+	case opSaveToken:
+		s.Tokens[record.Key] = record.Username
+		if record.Time > 0 {
+			s.TokenExpiry[record.Key] = record.Time
+		}
+		s.index(record.Username, record.Key)
+	case opDeleteToken:
+		s.deleteAccessToken(record.Key)
+	case opDeleteUserTokens:
+		s.deleteUserTokens(record.Key)
+	case opResetUser:
+		s.indexRoles(record.User.Username, false)
+		s.Users[record.User.Username] = cloneUser(*record.User)
+		s.indexRoles(record.User.Username, true)
+		s.deleteUserTokens(record.User.Username)
+	case opSaveRefresh:
+		s.RefreshTokens[record.Key] = *record.Refresh
+		s.index(record.Refresh.Username, record.Key)
+	case opUseRefresh:
+		if refresh, exists := s.RefreshTokens[record.Key]; exists {
+			refresh.Used = true
+			s.RefreshTokens[record.Key] = refresh
+		}
+	case opDeleteFamily:
+		for token, refresh := range s.RefreshTokens {
+			if refresh.Family == record.Key {
+				s.deleteAccessToken(refresh.AccessToken)
+				delete(s.RefreshTokens, token)
+				s.unindex(refresh.Username, token)
+			}
+		}
+		delete(s.Sessions, record.Key)
+	case opSaveSession:
+		s.Sessions[record.Session.ID] = *record.Session
+	case opRenewSession:
+		s.apply(walRecord{Seq: record.Seq, Op: opSaveToken, Key: record.Refresh.AccessToken, Username: record.Refresh.Username, Time: record.Time})
+		s.apply(walRecord{Seq: record.Seq, Op: opSaveRefresh, Key: record.Key, Refresh: record.Refresh})
+		s.Sessions[record.Session.ID] = *record.Session
+	case opDeleteExpired:
+		access, refresh, sessions := s.expired(record.Time)
+		for _, token := range access {
+			s.deleteAccessToken(token)
+		}
+		for _, token := range refresh {
+			s.unindex(s.RefreshTokens[token].Username, token)
+			delete(s.RefreshTokens, token)
+		}
+		for _, id := range sessions {
+			delete(s.Sessions, id)
+		}
+	}
+	s.Seq = record.Seq
+}
+
+// reindex rebuilds the per-user token and per-role user indexes, which are
+// derived data and not part of the snapshot
+func (s *fileStoreState) reindex() {
+	s.byUser = make(map[string]map[string]struct{})
+	for token, username := range s.Tokens {
+		s.index(username, token)
+	}
+	for token, refresh := range s.RefreshTokens {
+		s.index(refresh.Username, token)
+	}
+	s.byRole = make(map[string]map[string]struct{})
+	for username := range s.Users {
+		s.indexRoles(username, true)
+	}
+}
+
+// indexRoles adds the user to, or removes them from, byRole for each role they hold
+func (s *fileStoreState) indexRoles(username string, add bool) {
+	for _, role := range s.Users[username].Roles {
+		holders, exists := s.byRole[role.Name]
+		if add && !exists {
+			holders = make(map[string]struct{})
+			s.byRole[role.Name] = holders
+		}
+		if add {
+			holders[username] = struct{}{}
+			continue
+		}
+		delete(holders, username)
+		if len(holders) == 0 {
+			delete(s.byRole, role.Name)
+		}
+	}
+}
+
+// deleteRole removes the role along with every assignment of it and every
+// link to it from a parent role
+func (s *fileStoreState) deleteRole(roleName string) {
+	for username := range s.byRole[roleName] {
+		user := cloneUser(s.Users[username])
+		user.Roles = slices.DeleteFunc(user.Roles, func(r Role) bool { return r.Name == roleName })
+		s.Users[username] = user
+	}
+	delete(s.byRole, roleName)
+	delete(s.Roles, roleName)
+	for name, role := range s.Roles {
+		if slices.Contains(role.Children, roleName) {
+			role = cloneRole(role)
+			role.Children = slices.DeleteFunc(role.Children, func(child string) bool { return child == roleName })
+			s.Roles[name] = role
+		}
+	}
+}
+
+// hasFamily reports whether any refresh token of the family is left
+func (s *fileStoreState) hasFamily(family string) bool {
+	for _, refresh := range s.RefreshTokens {
+		if refresh.Family == family {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fileStoreState) index(username, token string) {
+	tokens, exists := s.byUser[username]
+	if !exists {
+		tokens = make(map[string]struct{})
+		s.byUser[username] = tokens
+	}
+	tokens[token] = struct{}{}
+}
+
+func (s *fileStoreState) unindex(username, token string) {
+	delete(s.byUser[username], token)
+	if len(s.byUser[username]) == 0 {
+		delete(s.byUser, username)
+	}
+}
+
+func (s *fileStoreState) deleteAccessToken(token string) {
+	if username, exists := s.Tokens[token]; exists {
+		delete(s.Tokens, token)
+		delete(s.TokenExpiry, token)
+		s.unindex(username, token)
+	}
+}
+
+func (s *fileStoreState) deleteUserTokens(username string) {
+	for token := range s.byUser[username] {
+		delete(s.Tokens, token)
+		delete(s.TokenExpiry, token)
+		delete(s.RefreshTokens, token)
+	}
+	delete(s.byUser, username)
+	for id, session := range s.Sessions {
+		if session.Username == username {
+			delete(s.Sessions, id)
+		}
+	}
+}
+
+// expired lists the records that expired before now
+func (s *fileStoreState) expired(now int64) (access, refresh, sessions []string) {
+	for token, expiresAt := range s.TokenExpiry {
+		if expiresAt < now {
+			access = append(access, token)
+		}
+	}
+	for token, r := range s.RefreshTokens {
+		if r.ExpiresAt > 0 && r.ExpiresAt < now {
+			refresh = append(refresh, token)
+		}
+	}
+	for id, session := range s.Sessions {
+		if session.ExpiresAt > 0 && session.ExpiresAt < now {
+			sessions = append(sessions, id)
+		}
+	}
+	return access, refresh, sessions
+}
+
+// commit appends record to the log and applies it. Callers must hold f.mu.
+func (f *FileStore) commit(record walRecord) error {
+	if f.wal == nil {
+		return errors.New("file store is closed")
+	}
+	if f.failed != nil {
+		return f.failed
+	}
+	record.Seq = f.state.Seq + 1
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, walChecksumTable))
+	copy(frame[walHeaderSize:], payload)
+
+	if _, err := f.wal.Write(frame); err != nil {
+		return f.rollback(err)
+	}
+	if f.opts.Sync == SyncAlways {
+		if err := f.wal.Sync(); err != nil {
+			// the caller is told the write failed, so a restart must not replay it
+			return f.rollback(err)
+		}
+	}
+	f.walSize += int64(len(frame))
+
+	f.state.apply(record)
+	f.walRecords++
+	if f.opts.SnapshotEvery > 0 && f.walRecords >= f.opts.SnapshotEvery {
+		// the record is already durable in the log, so a failed compaction is
+		// only reported and retried on the next append
+		if err := f.snapshotLocked(); err != nil {
+			log.Printf("file store: snapshot failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// rollback drops whatever part of a failed append made it into the log, so
+// that later appends stay readable and memory and disk keep agreeing. When
+// that fails too, they may not, and the store refuses writes until reopened.
+func (f *FileStore) rollback(cause error) error {
+	err := f.wal.Truncate(f.walSize)
+	if err == nil {
+		_, err = f.wal.Seek(f.walSize, io.SeekStart)
+	}
+	if err != nil {
+		f.failed = fmt.Errorf("file store failed: rolling back %v: %w", cause, err)
+		log.Print(f.failed)
+		return f.failed
+	}
+	return cause
+}
+
+// Snapshot writes the current state to disk and truncates the log
+func (f *FileStore) Snapshot() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.snapshotLocked()
+}
+
+func (f *FileStore) snapshotLocked() error {
+	if f.wal == nil {
+		return errors.New("file store is closed")
+	}
+	data, err := json.Marshal(f.state)
+	if err != nil {
+		return err
+	}
+
+	// write-then-rename so a crash leaves either the old or the new snapshot
+	tmpPath := filepath.Join(f.dir, snapshotFileName+".tmp")
+	if err := writeFileSync(tmpPath, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(f.dir, snapshotFileName)); err != nil {
+		return err
+	}
+	if err := syncDir(f.dir); err != nil {
+		return err
+	}
+
+	// the snapshot carries the sequence number, so a crash before this
+	// truncation only means some records get skipped on the next replay
+	if err := f.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f.walSize = 0
+	f.walRecords = 0
+	return f.wal.Sync()
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (f *FileStore) syncLoop() {
+	defer close(f.done)
+	ticker := time.NewTicker(f.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			if f.wal != nil {
+				f.wal.Sync()
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+// Close flushes and closes the log. The store must not be used afterwards.
+func (f *FileStore) Close() error {
+	if f.stop != nil {
+		close(f.stop)
+		<-f.done
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.wal == nil {
+		return nil
+	}
+	err := f.wal.Sync()
+	if closeErr := f.wal.Close(); err == nil {
+		err = closeErr
+	}
+	f.wal = nil
+	return err
+}
+
+func (f *FileStore) CreateUser(ctx context.Context, user User) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.state.Users[user.Username]; exists {
+		return ErrAlreadyExists
+	}
+	return f.commit(walRecord{Op: opPutUser, User: &user})
+}
+
+func (f *FileStore) GetUser(ctx context.Context, username string) (User, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	user, exists := f.state.Users[username]
+	if !exists {
+		return User{}, ErrNotFound
+	}
+	return cloneUser(user), nil
+}
+
+func (f *FileStore) UpdateUser(ctx context.Context, user User) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.state.Users[user.Username]; !exists {
+		return ErrNotFound
+	}
+	return f.commit(walRecord{Op: opPutUser, User: &user})
+}
+
+func (f *FileStore) ModifyUser(ctx context.Context, username string, fn func(user *User) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, exists := f.state.Users[username]
+	if !exists {
+		return ErrNotFound
+	}
+	user := cloneUser(current)
+	if err := fn(&user); err != nil {
+		return err
+	}
+	user.Username = username
+	return f.commit(walRecord{Op: opPutUser, User: &user})
+}
+
+func (f *FileStore) ModifyUserRevokingTokens(ctx context.Context, username string, fn func(user *User) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, exists := f.state.Users[username]
+	if !exists {
+		return ErrNotFound
+	}
+	user := cloneUser(current)
+	if err := fn(&user); err != nil {
+		return err
+	}
+	user.Username = username
+	return f.commit(walRecord{Op: opResetUser, User: &user})
+}
+
+func (f *FileStore) AddUserRole(ctx context.Context, username, roleName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, exists := f.state.Users[username]
+	if _, found := f.state.Roles[roleName]; !exists || !found {
+		return ErrNotFound
+	}
+	user := cloneUser(current)
+	user.Roles = withRole(user.Roles, roleName)
+	return f.commit(walRecord{Op: opPutUser, User: &user})
+}
+
+func (f *FileStore) DeleteUser(ctx context.Context, username string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.state.Users[username]; !exists && len(f.state.byUser[username]) == 0 {
+		return nil
+	}
+	return f.commit(walRecord{Op: opDeleteUser, Key: username})
+}
+
+func (f *FileStore) CreateRole(ctx context.Context, role Role) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.state.Roles[role.Name]; exists {
+		return ErrAlreadyExists
+	}
+	role = cloneRole(role)
+	return f.commit(walRecord{Op: opPutRole, Role: &role})
+}
+
+func (f *FileStore) GetRole(ctx context.Context, roleName string) (Role, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	role, exists := f.state.Roles[roleName]
+	if !exists {
+		return Role{}, ErrNotFound
+	}
+	return cloneRole(role), nil
+}
+
+func (f *FileStore) ModifyRole(ctx context.Context, roleName string, fn func(role *Role) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, exists := f.state.Roles[roleName]
+	if !exists {
+		return ErrNotFound
+	}
+	role := cloneRole(current)
+	if err := fn(&role); err != nil {
+		return err
+	}
+	role.Name = roleName
+	return f.commit(walRecord{Op: opPutRole, Role: &role})
+}
+
+func (f *FileStore) DeleteRole(ctx context.Context, roleName string, cascade bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !cascade && len(f.state.byRole[roleName]) > 0 {
+		return ErrInUse
+	}
+	if _, exists := f.state.Roles[roleName]; !exists && len(f.state.byRole[roleName]) == 0 {
+		return nil
+	}
+	return f.commit(walRecord{Op: opDeleteRole, Key: roleName})
+}
+
+func (f *FileStore) ListRoleUsers(ctx context.Context, roleName string) ([]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	usernames := make([]string, 0, len(f.state.byRole[roleName]))
+	for username := range f.state.byRole[roleName] {
+		usernames = append(usernames, username)
+	}
+	slices.Sort(usernames)
+	return usernames, nil
+}
+
+func (f *FileStore) SaveToken(ctx context.Context, token, username string, expiresAt int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commit(walRecord{Op: opSaveToken, Key: hashToken(token), Username: username, Time: expiresAt})
+}
+
+func (f *FileStore) GetToken(ctx context.Context, token string) (string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	username, exists := f.state.Tokens[hashToken(token)]
+	if !exists {
+		return "", ErrNotFound
+	}
+	return username, nil
+}
+
+func (f *FileStore) DeleteToken(ctx context.Context, token string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hash := hashToken(token)
+	if _, exists := f.state.Tokens[hash]; !exists {
+		return nil
+	}
+	return f.commit(walRecord{Op: opDeleteToken, Key: hash})
+}
+
+func (f *FileStore) DeleteUserTokens(ctx context.Context, username string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.state.byUser[username]) == 0 {
+		return nil
+	}
+	return f.commit(walRecord{Op: opDeleteUserTokens, Key: username})
+}
+
+func (f *FileStore) SaveRefreshToken(ctx context.Context, token string, refresh RefreshToken) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	refresh.AccessToken = hashToken(refresh.AccessToken)
+	return f.commit(walRecord{Op: opSaveRefresh, Key: hashToken(token), Refresh: &refresh})
+}
+
+// GetRefreshToken returns the record without AccessToken, since only its digest is stored
+func (f *FileStore) GetRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	refresh, exists := f.state.RefreshTokens[hashToken(token)]
+	if !exists {
+		return RefreshToken{}, ErrNotFound
+	}
+	refresh.AccessToken = ""
+	return refresh, nil
+}
+
+// UseRefreshToken returns the record without AccessToken, since only its digest is stored
+func (f *FileStore) UseRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hash := hashToken(token)
+	refresh, exists := f.state.RefreshTokens[hash]
+	if !exists {
+		return RefreshToken{}, ErrNotFound
+	}
+	if !refresh.Used {
+		if err := f.commit(walRecord{Op: opUseRefresh, Key: hash}); err != nil {
+			return RefreshToken{}, err
+		}
+	}
+	refresh.AccessToken = ""
+	return refresh, nil
+}
+
+func (f *FileStore) RenewSession(ctx context.Context, token string, refresh RefreshToken, accessExpiresAt, usedAt int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	session, exists := f.state.Sessions[refresh.Family]
+	if !exists || session.Username != refresh.Username || !f.state.hasFamily(refresh.Family) {
+		return ErrNotFound
+	}
+	session.ExpiresAt = refresh.ExpiresAt
+	session.LastUsedAt = usedAt
+	refresh.AccessToken = hashToken(refresh.AccessToken)
+	return f.commit(walRecord{Op: opRenewSession, Key: hashToken(token), Refresh: &refresh, Session: &session, Time: accessExpiresAt})
+}
+
+func (f *FileStore) DeleteRefreshFamily(ctx context.Context, family string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commit(walRecord{Op: opDeleteFamily, Key: family})
+}
+
+func (f *FileStore) SaveSession(ctx context.Context, session Session) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commit(walRecord{Op: opSaveSession, Session: &session})
+}
+
+func (f *FileStore) GetSession(ctx context.Context, id string) (Session, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	session, exists := f.state.Sessions[id]
+	if !exists {
+		return Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+func (f *FileStore) ListSessions(ctx context.Context, username string) ([]Session, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	sessions := []Session{}
+	for _, session := range f.state.Sessions {
+		if session.Username == username {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (f *FileStore) TouchSession(ctx context.Context, id string, lastUsedAt int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	session, exists := f.state.Sessions[id]
+	if !exists || session.LastUsedAt >= lastUsedAt {
+		return nil
+	}
+	session.LastUsedAt = lastUsedAt
+	return f.commit(walRecord{Op: opSaveSession, Session: &session})
+}
+
+func (f *FileStore) DeleteExpired(ctx context.Context, now int64) (SweepResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	access, refresh, sessions := f.state.expired(now)
+	result := SweepResult{AccessTokens: len(access), RefreshTokens: len(refresh), Sessions: len(sessions)}
+	if result == (SweepResult{}) {
+		return result, nil
+	}
+	// one record for the whole sweep; replay recomputes the same set from the same state
+	if err := f.commit(walRecord{Op: opDeleteExpired, Time: now}); err != nil {
+		return SweepResult{}, err
+	}
+	return result, nil
+}
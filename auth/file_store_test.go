@@ -0,0 +1,383 @@
+// auth/file_store_test.go
+
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestFileStore(t *testing.T, dir string, opts FileStoreOptions) *FileStore {
+	store, err := OpenFileStore(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open file store: %v", err)
+	}
+	return store
+}
+
+func TestFileStorePersistsAcrossRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store := openTestFileStore(t, dir, FileStoreOptions{})
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "alice", Password: "hash"}))
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "bob", Password: "hash"}))
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "admin"}))
+	assert.Nil(t, store.ModifyRole(ctx, "admin", func(role *Role) error {
+		role.Ability = []string{"users:write"}
+		role.Children = []string{"viewer"}
+		return nil
+	}))
+	assert.Nil(t, store.UpdateUser(ctx, User{Username: "alice", Password: "hash", Roles: []Role{{Name: "admin"}}}))
+	assert.Nil(t, store.DeleteUser(ctx, "bob"))
+	assert.Nil(t, store.SaveToken(ctx, "tok", "alice", 0))
+	assert.Nil(t, store.SaveSession(ctx, Session{ID: "fam", Username: "alice", UserAgent: "laptop"}))
+	assert.Nil(t, store.Close())
+
+	store = openTestFileStore(t, dir, FileStoreOptions{})
+	defer store.Close()
+
+	alice, err := store.GetUser(ctx, "alice")
+	assert.Nil(t, err, "User should survive a restart")
+	assert.Equal(t, []Role{{Name: "admin"}}, alice.Roles, "Role assignment should survive a restart")
+	_, err = store.GetUser(ctx, "bob")
+	assert.Equal(t, ErrNotFound, err, "Deleted user should stay deleted")
+	role, err := store.GetRole(ctx, "admin")
+	assert.Nil(t, err, "Role should survive a restart")
+	assert.Equal(t, []string{"users:write"}, role.Ability, "Permissions should survive a restart")
+	assert.Equal(t, []string{"viewer"}, role.Children, "Role hierarchy should survive a restart")
+	username, err := store.GetToken(ctx, "tok")
+	assert.Nil(t, err, "Token should survive a restart")
+	assert.Equal(t, "alice", username)
+	session, err := store.GetSession(ctx, "fam")
+	assert.Nil(t, err, "Session should survive a restart")
+	assert.Equal(t, "laptop", session.UserAgent)
+}
+
+func TestFileStoreSnapshotCompactsLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store := openTestFileStore(t, dir, FileStoreOptions{SnapshotEvery: 4})
+	for _, name := range []string{"r1", "r2", "r3", "r4", "r5"} {
+		assert.Nil(t, store.CreateRole(ctx, Role{Name: name}))
+	}
+	assert.Nil(t, store.DeleteRole(ctx, "r1", true))
+	assert.Nil(t, store.Close())
+
+	_, err := os.Stat(filepath.Join(dir, snapshotFileName))
+	assert.Nil(t, err, "A snapshot should have been written")
+	assert.Equal(t, 2, countWALRecords(t, dir), "Only records after the snapshot should remain in the log")
+
+	store = openTestFileStore(t, dir, FileStoreOptions{SnapshotEvery: 4})
+	defer store.Close()
+	_, err = store.GetRole(ctx, "r1")
+	assert.Equal(t, ErrNotFound, err, "Deleted role should stay deleted")
+	for _, name := range []string{"r2", "r3", "r4", "r5"} {
+		_, err := store.GetRole(ctx, name)
+		assert.Nil(t, err, "Role %s should be restored from snapshot and log", name)
+	}
+}
+
+func TestFileStoreSkipsRecordsAlreadyInSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, walFileName)
+
+	store := openTestFileStore(t, dir, FileStoreOptions{})
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "alice", Password: "hash"}))
+	assert.Nil(t, store.DeleteUser(ctx, "alice"))
+	staleLog, err := os.ReadFile(walPath)
+	assert.Nil(t, err)
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "alice", Password: "new"}))
+	assert.Nil(t, store.Snapshot())
+	assert.Nil(t, store.Close())
+
+	// Simulate a crash after the snapshot was renamed but before the log was truncated
+	assert.Nil(t, os.WriteFile(walPath, staleLog, 0o600))
+
+	store = openTestFileStore(t, dir, FileStoreOptions{})
+	defer store.Close()
+	alice, err := store.GetUser(ctx, "alice")
+	assert.Nil(t, err, "Replaying stale records must not undo the snapshot")
+	assert.Equal(t, "new", alice.Password)
+}
+
+func TestFileStoreRecoversFromTornRecord(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, walFileName)
+
+	store := openTestFileStore(t, dir, FileStoreOptions{})
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "alice", Password: "hash"}))
+	info, err := os.Stat(walPath)
+	assert.Nil(t, err)
+	firstRecordEnd := info.Size()
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "bob", Password: "hash"}))
+	assert.Nil(t, store.Close())
+
+	info, err = os.Stat(walPath)
+	assert.Nil(t, err)
+
+	// Cut the second record in its header and in its payload
+	for _, cut := range []int64{firstRecordEnd + 3, info.Size() - 5} {
+		t.Run("", func(t *testing.T) {
+			crashDir := t.TempDir()
+			data, err := os.ReadFile(walPath)
+			assert.Nil(t, err)
+			assert.Nil(t, os.WriteFile(filepath.Join(crashDir, walFileName), data[:cut], 0o600))
+
+			store := openTestFileStore(t, crashDir, FileStoreOptions{})
+			_, err = store.GetUser(ctx, "alice")
+			assert.Nil(t, err, "Complete records before the tear should be replayed")
+			_, err = store.GetUser(ctx, "bob")
+			assert.Equal(t, ErrNotFound, err, "The torn record should be discarded")
+
+			// The log must accept new records after the truncated tail
+			assert.Nil(t, store.CreateUser(ctx, User{Username: "carol", Password: "hash"}))
+			assert.Nil(t, store.Close())
+
+			store = openTestFileStore(t, crashDir, FileStoreOptions{})
+			defer store.Close()
+			_, err = store.GetUser(ctx, "carol")
+			assert.Nil(t, err, "Records appended after recovery should be replayed")
+			assert.Equal(t, 2, countWALRecords(t, crashDir))
+		})
+	}
+}
+
+func TestFileStoreRejectsCorruptRecord(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, walFileName)
+
+	store := openTestFileStore(t, dir, FileStoreOptions{Sync: SyncNever})
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "kept"}))
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "flipped"}))
+	assert.Nil(t, store.Close())
+
+	data, err := os.ReadFile(walPath)
+	assert.Nil(t, err)
+	data[len(data)-3] ^= 0xff
+	assert.Nil(t, os.WriteFile(walPath, data, 0o600))
+
+	store = openTestFileStore(t, dir, FileStoreOptions{Sync: SyncNever})
+	defer store.Close()
+	_, err = store.GetRole(ctx, "kept")
+	assert.Nil(t, err)
+	_, err = store.GetRole(ctx, "flipped")
+	assert.Equal(t, ErrNotFound, err, "A last record failing its checksum should be discarded")
+}
+
+func TestFileStoreFailsOnCorruptionMidLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, walFileName)
+
+	store := openTestFileStore(t, dir, FileStoreOptions{Sync: SyncNever})
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "flipped"}))
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "later"}))
+	assert.Nil(t, store.Close())
+
+	data, err := os.ReadFile(walPath)
+	assert.Nil(t, err)
+	data[walHeaderSize+3] ^= 0xff
+	assert.Nil(t, os.WriteFile(walPath, data, 0o600))
+
+	_, err = OpenFileStore(dir, FileStoreOptions{Sync: SyncNever})
+	assert.NotNil(t, err, "A bad record followed by more records is not a torn tail")
+	after, err := os.ReadFile(walPath)
+	assert.Nil(t, err)
+	assert.Equal(t, data, after, "The log should be left as it was")
+}
+
+func TestFileStoreReplaysUserReset(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store := openTestFileStore(t, dir, FileStoreOptions{})
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "alice", Password: "hash"}))
+	assert.Nil(t, store.SaveToken(ctx, "tok", "alice", 0))
+	assert.Nil(t, store.ModifyUserRevokingTokens(ctx, "alice", func(user *User) error {
+		user.Password = "newhash"
+		return nil
+	}))
+	assert.Nil(t, store.Close())
+
+	store = openTestFileStore(t, dir, FileStoreOptions{})
+	defer store.Close()
+	alice, err := store.GetUser(ctx, "alice")
+	assert.Nil(t, err)
+	assert.Equal(t, "newhash", alice.Password, "The change should survive a restart")
+	_, err = store.GetToken(ctx, "tok")
+	assert.Equal(t, ErrNotFound, err, "Revoked tokens should stay revoked")
+}
+
+func TestFileStoreRefusesWritesAfterFailedRollback(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store := openTestFileStore(t, dir, FileStoreOptions{})
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "kept"}))
+
+	// a read-only handle fails the append, and then the truncation undoing it
+	wal := store.wal
+	readOnly, err := os.Open(filepath.Join(dir, walFileName))
+	assert.Nil(t, err)
+	store.wal = readOnly
+	assert.NotNil(t, store.CreateRole(ctx, Role{Name: "lost"}))
+	_, err = store.GetRole(ctx, "lost")
+	assert.Equal(t, ErrNotFound, err, "A failed write should not be applied")
+
+	store.wal = wal
+	readOnly.Close()
+	assert.ErrorContains(t, store.CreateRole(ctx, Role{Name: "later"}), "file store failed", "Writes should be refused once the log may be inconsistent")
+	assert.Nil(t, store.Close())
+
+	store = openTestFileStore(t, dir, FileStoreOptions{})
+	defer store.Close()
+	_, err = store.GetRole(ctx, "kept")
+	assert.Nil(t, err)
+	_, err = store.GetRole(ctx, "lost")
+	assert.Equal(t, ErrNotFound, err, "A failed write should not come back on replay")
+}
+
+func TestFileStoreBacksAuthService(t *testing.T) {
+	dir := t.TempDir()
+	// a restarted server only accepts old tokens if it signs with the same key
+	keys := WithKeyRing(NewKeyRing(NewHMACKey([]byte("restart-secret"))))
+
+	store := openTestFileStore(t, dir, FileStoreOptions{Sync: SyncInterval})
+	s := NewInMemoryAuthService(store, keys)
+	assert.Nil(t, s.CreateUser("fileUser", "password123"))
+	assert.Nil(t, s.CreateRole("fileRole"))
+	assert.Nil(t, s.AddRoleToUser("fileUser", "fileRole"))
+	tokenDetails, err := s.Authenticate("fileUser", "password123")
+	assert.Nil(t, err)
+	assert.Nil(t, store.Close())
+
+	store = openTestFileStore(t, dir, FileStoreOptions{Sync: SyncInterval})
+	s = NewInMemoryAuthService(store, keys)
+	hasRole, err := s.CheckUserRole(tokenDetails.Token, "fileRole")
+	assert.Nil(t, err, "Tokens issued before a restart should still validate")
+	assert.True(t, hasRole, "Role assignment should survive a restart")
+
+	rotated, err := s.RefreshToken(tokenDetails.RefreshToken)
+	assert.Nil(t, err, "Refresh tokens issued before a restart should still work")
+	assert.Nil(t, store.Close())
+
+	store = openTestFileStore(t, dir, FileStoreOptions{Sync: SyncInterval})
+	defer store.Close()
+	s = NewInMemoryAuthService(store, keys)
+	_, err = s.GetAllRoles(rotated.Token)
+	assert.Nil(t, err, "The pair from a refresh should survive a restart")
+	sessions, err := s.ListSessions("fileUser")
+	assert.Nil(t, err)
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, rotated.RefreshExpiresAt, sessions[0].ExpiresAt, "The session renewal should survive a restart")
+	}
+	_, err = s.RefreshToken(tokenDetails.RefreshToken)
+	assert.NotNil(t, err, "A rotated-out refresh token should stay used across restarts")
+	_, err = s.GetAllRoles(tokenDetails.Token)
+	assert.NotNil(t, err, "Family revocation should remove the access token")
+}
+
+func TestFileStoreTokensAreHashed(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store := openTestFileStore(t, dir, FileStoreOptions{Sync: SyncNever})
+	assert.Nil(t, store.SaveToken(ctx, "raw-access", "fileUser", 0))
+	assert.Nil(t, store.SaveRefreshToken(ctx, "raw-refresh", RefreshToken{Username: "fileUser", Family: "fam", AccessToken: "raw-access"}))
+	logged, err := os.ReadFile(filepath.Join(dir, walFileName))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Snapshot())
+	snapshot, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	assert.Nil(t, err)
+	for _, data := range [][]byte{logged, snapshot} {
+		assert.NotContains(t, string(data), "raw-access", "Raw tokens should never be written to disk")
+		assert.NotContains(t, string(data), "raw-refresh", "Raw tokens should never be written to disk")
+	}
+
+	username, err := store.GetToken(ctx, "raw-access")
+	assert.Nil(t, err)
+	assert.Equal(t, "fileUser", username)
+	assert.Nil(t, store.DeleteRefreshFamily(ctx, "fam"))
+	_, err = store.GetToken(ctx, "raw-access")
+	assert.Equal(t, ErrNotFound, err, "The family's access token should go with it")
+	assert.Nil(t, store.Close())
+}
+
+func countWALRecords(t *testing.T, dir string) int {
+	file, err := os.Open(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	defer file.Close()
+	count := 0
+	for {
+		if _, _, err := readWALRecord(file); err != nil {
+			return count
+		}
+		count++
+	}
+}
+
+func TestFileStoreUserTokenIndexSurvivesSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store := openTestFileStore(t, dir, FileStoreOptions{})
+	assert.Nil(t, store.SaveToken(ctx, "access", "alice", 0))
+	assert.Nil(t, store.SaveRefreshToken(ctx, "refresh", RefreshToken{Username: "alice", Family: "fam", AccessToken: "access"}))
+	assert.Nil(t, store.SaveSession(ctx, Session{ID: "fam", Username: "alice"}))
+	assert.Nil(t, store.SaveToken(ctx, "other", "bob", 0))
+	assert.Nil(t, store.Snapshot())
+	assert.Nil(t, store.Close())
+
+	// the index is rebuilt from the snapshot rather than stored in it
+	store = openTestFileStore(t, dir, FileStoreOptions{})
+	defer store.Close()
+	assert.Nil(t, store.DeleteUserTokens(ctx, "alice"))
+	_, err := store.GetToken(ctx, "access")
+	assert.Equal(t, ErrNotFound, err, "Access tokens of the user should be gone")
+	_, err = store.GetRefreshToken(ctx, "refresh")
+	assert.Equal(t, ErrNotFound, err, "Refresh tokens of the user should be gone")
+	_, err = store.GetSession(ctx, "fam")
+	assert.Equal(t, ErrNotFound, err, "Sessions of the user should be gone")
+	_, err = store.GetToken(ctx, "other")
+	assert.Nil(t, err, "Other users' tokens should be kept")
+}
+
+func TestFileStoreRoleIndexSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store := openTestFileStore(t, dir, FileStoreOptions{})
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "editor"}))
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "admin", Children: []string{"editor"}}))
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "alice", Roles: []Role{{Name: "editor"}}}))
+	assert.Nil(t, store.Snapshot())
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "bob", Roles: []Role{{Name: "editor"}, {Name: "admin"}}}))
+	assert.Nil(t, store.Close())
+
+	// alice comes from the snapshot, bob from the log
+	store = openTestFileStore(t, dir, FileStoreOptions{})
+	usernames, err := store.ListRoleUsers(ctx, "editor")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, usernames, "The role index should be rebuilt on open")
+	assert.Equal(t, ErrInUse, store.DeleteRole(ctx, "editor", false), "A held role should not be deleted without cascade")
+	assert.Nil(t, store.DeleteRole(ctx, "editor", true))
+	assert.Nil(t, store.Close())
+
+	store = openTestFileStore(t, dir, FileStoreOptions{})
+	defer store.Close()
+	bob, _ := store.GetUser(ctx, "bob")
+	assert.Equal(t, []Role{{Name: "admin"}}, bob.Roles, "The cascade should be replayed")
+	admin, _ := store.GetRole(ctx, "admin")
+	assert.Empty(t, admin.Children, "Links from parent roles should be replayed away too")
+}
@@ -4,214 +4,716 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
-var service AuthService = &InMemoryAuthService{} // Create an instance of the AuthService
+// Handler serves the HTTP API on top of an AuthService. Several handlers,
+// each with their own service, may be registered in the same process.
+type Handler struct {
+	service AuthService
+}
 
-type UserRequest struct {
-	Username string `json:"username,omitempty"`
-	Password string `json:"password,omitempty"`
-	RoleName string `json:"roleName,omitempty"`
-	Token    string `json:"token,omitempty"`
+// NewHandler returns a Handler delegating to service
+func NewHandler(service AuthService) *Handler {
+	return &Handler{service: service}
 }
 
-func ensureMethod(next http.HandlerFunc, method string) http.HandlerFunc {
+// TokenCookieName is the cookie an access token is read from when a request
+// has no Authorization header
+const TokenCookieName = "access_token"
+
+// bearerRealm is the protection space named in WWW-Authenticate challenges
+const bearerRealm = "simple_auth"
+
+// RequireAdmin wraps a management handler so that it only runs for requests
+// carrying an access token whose user holds AdminPermission. The token must
+// come in the Authorization header: a cookie would let any site a logged-in
+// admin visits make management calls on their behalf.
+func (h *Handler) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != method {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		token, ok := bearerHeader(r)
+		if !ok {
+			challenge(w, "", errMissingToken)
+			return
+		}
+		allowed, err := h.service.CheckPermission(token, AdminPermission)
+		if isTokenError(err) {
+			challenge(w, "invalid_token", err)
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if !allowed {
+			challenge(w, "insufficient_scope", errNotAdmin)
 			return
 		}
-		next.ServeHTTP(w, r)
+		next(w, r)
+	}
+}
+
+// AccessToken returns the access token of the request's "Authorization:
+// Bearer" header or, without one, of the TokenCookieName cookie. Browsers
+// send cookies along with cross-site requests too, so the cookie is only
+// taken for GET and HEAD requests, which must not change state.
+func AccessToken(r *http.Request) (string, bool) {
+	if r.Header.Get("Authorization") != "" {
+		return bearerHeader(r)
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", false
+	}
+	if cookie, err := r.Cookie(TokenCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// bearerHeader returns the token of the request's "Authorization: Bearer" header
+func bearerHeader(r *http.Request) (string, bool) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// requestToken is AccessToken falling back to the token field of the JSON
+// body. That fallback is deprecated, and flagged as such on the response.
+func requestToken(w http.ResponseWriter, r *http.Request, requestData UserRequest) (string, bool) {
+	if token, ok := AccessToken(r); ok {
+		return token, true
+	}
+	if requestData.Token == "" {
+		return "", false
+	}
+	w.Header().Set("Deprecation", "true")
+	return requestData.Token, true
+}
+
+// authenticateBearer returns the caller's access token once it has been
+// validated. Otherwise it answers with a challenge and returns false.
+func (h *Handler) authenticateBearer(w http.ResponseWriter, r *http.Request, requestData UserRequest) (string, bool) {
+	token, ok := requestToken(w, r, requestData)
+	if !ok {
+		challenge(w, "", errMissingToken)
+		return "", false
+	}
+	_, err := h.service.ValidateToken(token)
+	if isTokenError(err) {
+		challenge(w, "invalid_token", err)
+		return "", false
+	}
+	if err != nil {
+		writeError(w, err)
+		return "", false
+	}
+	return token, true
+}
+
+// challenge fails the request with err and an RFC 6750 Bearer challenge.
+// errorCode is left empty when the request carried no token at all.
+func challenge(w http.ResponseWriter, errorCode string, err error) {
+	w.Header().Set("WWW-Authenticate", BearerChallenge(bearerRealm, errorCode, err.Error()))
+	writeError(w, err)
+}
+
+// BearerChallenge formats an RFC 6750 WWW-Authenticate value. realm may be
+// empty, and so may errorCode when the request carried no token, in which
+// case description is left out too.
+func BearerChallenge(realm, errorCode, description string) string {
+	var params []string
+	if realm != "" {
+		params = append(params, fmt.Sprintf(`realm="%s"`, realm))
+	}
+	if errorCode != "" {
+		params = append(params, fmt.Sprintf(`error="%s"`, errorCode), fmt.Sprintf(`error_description="%s"`, challengeText(description)))
+	}
+	if len(params) == 0 {
+		return "Bearer"
+	}
+	return "Bearer " + strings.Join(params, ", ")
+}
+
+// challengeText drops the characters RFC 6750 does not allow in error_description
+func challengeText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// decodeOptionalBody decodes the JSON body like the other handlers do, but
+// accepts an empty one, as requests authenticated by header may have no body
+func decodeOptionalBody(r *http.Request, requestData *UserRequest) error {
+	if r.Body == nil {
+		return nil
+	}
+	err := json.NewDecoder(r.Body).Decode(requestData)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// decodeRequest decodes the request's JSON body, which may be empty, then
+// takes the parameters carried in the path of /v1 routes. Path parameters are
+// named after the JSON fields and win over the body.
+func decodeRequest(r *http.Request, requestData *UserRequest) error {
+	if err := decodeOptionalBody(r, requestData); err != nil {
+		return err
+	}
+	for name, field := range map[string]*string{
+		"username":      &requestData.Username,
+		"roleName":      &requestData.RoleName,
+		"childRoleName": &requestData.ChildRoleName,
+		"permission":    &requestData.Permission,
+		"sessionId":     &requestData.SessionID,
+		"keyId":         &requestData.KeyID,
+	} {
+		if value := r.PathValue(name); value != "" {
+			*field = value
+		}
 	}
+	return nil
+}
+
+type UserRequest struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	NewPassword   string `json:"newPassword,omitempty"`
+	RoleName      string `json:"roleName,omitempty"`
+	ChildRoleName string `json:"childRoleName,omitempty"`
+	Permission    string `json:"permission,omitempty"`
+	Token         string `json:"token,omitempty"` // deprecated where it is the caller's token: send it as a bearer token
+	RefreshToken  string `json:"refreshToken,omitempty"`
+	KeyID         string `json:"keyId,omitempty"`
+	SessionID     string `json:"sessionId,omitempty"`
+	Cascade       bool   `json:"cascade,omitempty"` // delete-role: also take the role away from its holders; also ?cascade=true
+}
+
+// clientAuthenticator is implemented by services that record where a login came from
+type clientAuthenticator interface {
+	AuthenticateClient(username, password string, client ClientInfo) (TokenDetails, error)
+}
+
+// tokenIntrospector is implemented by services that can describe tokens per
+// RFC 7662 to the clients registered with them
+type tokenIntrospector interface {
+	AuthenticateIntrospectionClient(clientID, secret string) bool
+	IntrospectToken(tokenString string) (TokenIntrospection, error)
+}
+
+// keyHolder is implemented by services that can publish their key ring
+type keyHolder interface {
+	Keys() *KeyRing
+}
+
+// keyRotator is implemented by services whose signing keys can be rotated at runtime
+type keyRotator interface {
+	RotateSigningKey() (string, error)
+	RetireSigningKey(keyID string) error
 }
 
-func HandleCreateUser(w http.ResponseWriter, r *http.Request) {
+// authenticate logs the user in, passing the caller's address and user agent
+// along when the service keeps track of them
+func (h *Handler) authenticate(r *http.Request, username, password string) (TokenDetails, error) {
+	authenticator, ok := h.service.(clientAuthenticator)
+	if !ok {
+		return h.service.Authenticate(username, password)
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return authenticator.AuthenticateClient(username, password, ClientInfo{IP: ip, UserAgent: r.UserAgent()})
+}
+
+func (h *Handler) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
 	var requestData UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
 		return
 	}
 	if requestData.Username == "" || requestData.Password == "" {
-		http.Error(w, "error parameters", http.StatusBadRequest)
+		writeError(w, errMissingParams)
 		return
 	}
 
-	err := service.CreateUser(requestData.Username, requestData.Password)
+	err := h.service.CreateUser(requestData.Username, requestData.Password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
 
-func HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
 	var requestData UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
 		return
 	}
 
 	if requestData.Username == "" {
-		http.Error(w, "error parameters", http.StatusBadRequest)
+		writeError(w, errMissingParams)
 		return
 	}
 
-	err := service.DeleteUser(requestData.Username)
+	err := h.service.DeleteUser(requestData.Username)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func HandleCreateRole(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
 	var requestData UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	if requestData.Username == "" || requestData.Password == "" || requestData.NewPassword == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	err := h.service.ChangePassword(requestData.Username, requestData.Password, requestData.NewPassword)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) HandleRevokeUserTokens(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	if requestData.Username == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	err := h.service.RevokeUserTokens(requestData.Username)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	if requestData.Username == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	sessions, err := h.service.ListSessions(requestData.Username)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (h *Handler) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	if requestData.Username == "" || requestData.SessionID == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	err := h.service.RevokeSession(requestData.Username, requestData.SessionID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) HandleCreateRole(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
 		return
 	}
 
 	if requestData.RoleName == "" {
-		http.Error(w, "error parameters", http.StatusBadRequest)
+		writeError(w, errMissingParams)
 		return
 	}
-	err := service.CreateRole(requestData.RoleName)
+	err := h.service.CreateRole(requestData.RoleName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
 
-func HandleDeleteRole(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleDeleteRole(w http.ResponseWriter, r *http.Request) {
 	var requestData UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
 		return
 	}
 
 	if requestData.RoleName == "" {
-		http.Error(w, "error parameters", http.StatusBadRequest)
+		writeError(w, errMissingParams)
 		return
 	}
-	err := service.DeleteRole(requestData.RoleName)
+	if cascade := r.URL.Query().Get("cascade"); cascade != "" {
+		var err error
+		if requestData.Cascade, err = strconv.ParseBool(cascade); err != nil {
+			writeError(w, errMissingParams)
+			return
+		}
+	}
+	deleteRole := h.service.DeleteRole
+	if requestData.Cascade {
+		deleteRole = h.service.DeleteRoleCascade
+	}
+	err := deleteRole(requestData.RoleName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func HandleAddRoleToUser(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleGetRoleUsers(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	if requestData.RoleName == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	usernames, err := h.service.GetRoleUsers(requestData.RoleName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(usernames)
+}
+
+func (h *Handler) HandleAddRoleToUser(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	if requestData.Username == "" || requestData.RoleName == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	err := h.service.AddRoleToUser(requestData.Username, requestData.RoleName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *Handler) HandleRemoveRoleFromUser(w http.ResponseWriter, r *http.Request) {
 	var requestData UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
 		return
 	}
 
 	if requestData.Username == "" || requestData.RoleName == "" {
-		http.Error(w, "error parameters", http.StatusBadRequest)
+		writeError(w, errMissingParams)
+		return
+	}
+	err := h.service.RemoveRoleFromUser(requestData.Username, requestData.RoleName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) HandleAddChildRole(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	if requestData.RoleName == "" || requestData.ChildRoleName == "" {
+		writeError(w, errMissingParams)
 		return
 	}
-	err := service.AddRoleToUser(requestData.Username, requestData.RoleName)
+	err := h.service.AddChildRole(requestData.RoleName, requestData.ChildRoleName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
 
-func HandleAuthenticate(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleRemoveChildRole(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	if requestData.RoleName == "" || requestData.ChildRoleName == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	err := h.service.RemoveChildRole(requestData.RoleName, requestData.ChildRoleName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) HandleGrantPermission(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	if requestData.RoleName == "" || requestData.Permission == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	err := h.service.GrantPermission(requestData.RoleName, requestData.Permission)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *Handler) HandleRevokePermission(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	if requestData.RoleName == "" || requestData.Permission == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	err := h.service.RevokePermission(requestData.RoleName, requestData.Permission)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) HandleAuthenticate(w http.ResponseWriter, r *http.Request) {
 	var requestData UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
 		return
 	}
 	if requestData.Username == "" || requestData.Password == "" {
-		http.Error(w, "error parameters", http.StatusBadRequest)
+		writeError(w, errMissingParams)
 		return
 	}
 
-	tokenDetails, err := service.Authenticate(requestData.Username, requestData.Password)
+	tokenDetails, err := h.authenticate(r, requestData.Username, requestData.Password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
 	json.NewEncoder(w).Encode(tokenDetails)
 }
 
-func HandleGenerateToken(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleGenerateToken(w http.ResponseWriter, r *http.Request) {
 	var requestData UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
 		return
 	}
 
 	if requestData.Username == "" || requestData.Password == "" {
-		http.Error(w, "error parameters", http.StatusBadRequest)
+		writeError(w, errMissingParams)
 		return
 	}
-	tokenDetails, err := service.Authenticate(requestData.Username, requestData.Password)
+	tokenDetails, err := h.authenticate(r, requestData.Username, requestData.Password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
 	json.NewEncoder(w).Encode(tokenDetails)
 }
 
-func HandleInvalidateToken(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
 	var requestData UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
 		return
 	}
 
-	if requestData.Token == "" {
-		http.Error(w, "error parameters", http.StatusBadRequest)
+	if requestData.RefreshToken == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	tokenDetails, err := h.service.RefreshToken(requestData.RefreshToken)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokenDetails)
+}
+
+func (h *Handler) HandleInvalidateToken(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	// not validated first: logging out with an expired token is fine
+	token, ok := requestToken(w, r, requestData)
+	if !ok {
+		challenge(w, "", errMissingToken)
+		return
+	}
+	if err := h.service.InvalidateToken(token); err != nil {
+		writeError(w, err)
 		return
 	}
-	InvalidateToken(requestData.Token)
 	w.WriteHeader(http.StatusOK)
 }
 
-func HandleCheckRole(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleCheckRole(w http.ResponseWriter, r *http.Request) {
 	var requestData UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
 		return
 	}
+	if requestData.RoleName == "" {
+		requestData.RoleName = r.URL.Query().Get("roleName")
+	}
 
-	hasRole, err := service.CheckUserRole(requestData.Token, requestData.RoleName)
+	token, ok := h.authenticateBearer(w, r, requestData)
+	if !ok {
+		return
+	}
+	hasRole, err := h.service.CheckUserRole(token, requestData.RoleName)
 	if err != nil {
-		if err.Error() == "token has expired" {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
 	json.NewEncoder(w).Encode(map[string]bool{"hasRole": hasRole})
 }
 
-func HandleGetAllRoles(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleCheckPermission(w http.ResponseWriter, r *http.Request) {
 	var requestData UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
 		return
 	}
+	if requestData.Permission == "" {
+		requestData.Permission = r.URL.Query().Get("permission")
+	}
 
-	roles, err := service.GetAllRoles(requestData.Token)
+	if requestData.Permission == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	token, ok := h.authenticateBearer(w, r, requestData)
+	if !ok {
+		return
+	}
+	hasPermission, err := h.service.CheckPermission(token, requestData.Permission)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{"hasPermission": hasPermission})
+}
+
+// HandleGetMe tells the caller which user their access token belongs to
+func (h *Handler) HandleGetMe(w http.ResponseWriter, r *http.Request) {
+	token, ok := AccessToken(r)
+	if !ok {
+		challenge(w, "", errMissingToken)
+		return
+	}
+	username, err := h.service.ValidateToken(token)
+	if isTokenError(err) {
+		challenge(w, "invalid_token", err)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"username": username})
+}
+
+func (h *Handler) HandleGetAllRoles(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	token, ok := h.authenticateBearer(w, r, requestData)
+	if !ok {
+		return
+	}
+	roles, err := h.service.GetAllRoles(token)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 	if len(roles) == 0 {
@@ -221,3 +723,117 @@ func HandleGetAllRoles(w http.ResponseWriter, r *http.Request) {
 
 	json.NewEncoder(w).Encode(roles)
 }
+
+func (h *Handler) HandleGetDirectRoles(w http.ResponseWriter, r *http.Request) {
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+
+	token, ok := h.authenticateBearer(w, r, requestData)
+	if !ok {
+		return
+	}
+	roles, err := h.service.GetDirectRoles(token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(roles) == 0 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	json.NewEncoder(w).Encode(roles)
+}
+
+func (h *Handler) HandleRotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	rotator, ok := h.service.(keyRotator)
+	if !ok {
+		writeError(w, fmt.Errorf("key rotation %w", errNotSupported))
+		return
+	}
+
+	keyID, err := rotator.RotateSigningKey()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"keyId": keyID})
+}
+
+func (h *Handler) HandleRetireSigningKey(w http.ResponseWriter, r *http.Request) {
+	rotator, ok := h.service.(keyRotator)
+	if !ok {
+		writeError(w, fmt.Errorf("key rotation %w", errNotSupported))
+		return
+	}
+
+	var requestData UserRequest
+	if err := decodeRequest(r, &requestData); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+	if requestData.KeyID == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	if err := rotator.RetireSigningKey(requestData.KeyID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	holder, ok := h.service.(keyHolder)
+	if !ok {
+		writeError(w, fmt.Errorf("key set %w", errNotSupported))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	// short enough that verifiers pick up a rotated key before its first token matters
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(holder.Keys().JWKS())
+}
+
+// HandleIntrospect implements RFC 7662 token introspection for registered clients
+func (h *Handler) HandleIntrospect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodNotAllowed)
+		return
+	}
+	introspector, ok := h.service.(tokenIntrospector)
+	if !ok {
+		writeError(w, fmt.Errorf("introspection %w", errNotSupported))
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || !introspector.AuthenticateIntrospectionClient(clientID, secret) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+		writeError(w, errInvalidClient)
+		return
+	}
+
+	// RFC 7662 requests are form encoded; token_type_hint is optional and
+	// ignored because both token kinds are looked up anyway
+	token := r.PostFormValue("token")
+	if token == "" {
+		writeError(w, errMissingParams)
+		return
+	}
+	result, err := introspector.IntrospectToken(token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(result)
+}
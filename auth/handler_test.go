@@ -8,18 +8,23 @@ import (
 	//"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
+)
 
-	"github.com/gogorush/simple_auth/utils"
+// service backs api, the handlers under test
+var (
+	service AuthService
+	api     *Handler
 )
 
 func setupService() {
 
-	// Reset the global maps to ensure a fresh state for each test
-	Users = utils.NewConcurrentMap()
-	Roles = utils.NewConcurrentMap()
-	Tokens = utils.NewConcurrentMap()
-	service = &InMemoryAuthService{} // Reset to mock service for each test
+	// Give each test its own store to ensure a fresh state
+	service = NewInMemoryAuthService(NewMemoryStore())
+	api = NewHandler(service)
 }
 
 func TestHandleCreateUser(t *testing.T) {
@@ -32,7 +37,7 @@ func TestHandleCreateUser(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	HandleCreateUser(rr, req)
+	api.HandleCreateUser(rr, req)
 
 	if status := rr.Code; status != http.StatusCreated {
 		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusCreated)
@@ -49,7 +54,7 @@ func TestHandleDeleteUser(t *testing.T) {
 		t.Fatal(err)
 	}
 	createRR := httptest.NewRecorder()
-	HandleCreateUser(createRR, createReq)
+	api.HandleCreateUser(createRR, createReq)
 	if status := createRR.Code; status != http.StatusCreated {
 		t.Fatalf("Failed to create mock user: got %v want %v", status, http.StatusCreated)
 	}
@@ -61,7 +66,7 @@ func TestHandleDeleteUser(t *testing.T) {
 		t.Fatal(err)
 	}
 	deleteRR := httptest.NewRecorder()
-	HandleDeleteUser(deleteRR, deleteReq)
+	api.HandleDeleteUser(deleteRR, deleteReq)
 	if status := deleteRR.Code; status != http.StatusOK {
 		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
@@ -77,7 +82,7 @@ func TestHandleCreateRole(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	HandleCreateRole(rr, req)
+	api.HandleCreateRole(rr, req)
 
 	if status := rr.Code; status != http.StatusCreated {
 		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusCreated)
@@ -94,7 +99,7 @@ func TestHandleDeleteRole(t *testing.T) {
 		t.Fatal(err)
 	}
 	createRR := httptest.NewRecorder()
-	HandleCreateRole(createRR, createReq)
+	api.HandleCreateRole(createRR, createReq)
 	if status := createRR.Code; status != http.StatusCreated {
 		t.Fatalf("Failed to create mock role: got %v want %v", status, http.StatusCreated)
 	}
@@ -106,7 +111,7 @@ func TestHandleDeleteRole(t *testing.T) {
 		t.Fatal(err)
 	}
 	deleteRR := httptest.NewRecorder()
-	HandleDeleteRole(deleteRR, deleteReq)
+	api.HandleDeleteRole(deleteRR, deleteReq)
 	if status := deleteRR.Code; status != http.StatusOK {
 		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
@@ -123,7 +128,7 @@ func TestHandleAddRoleToUser(t *testing.T) {
 	}
 
 	userRR := httptest.NewRecorder()
-	HandleCreateUser(userRR, userReq)
+	api.HandleCreateUser(userRR, userReq)
 
 	if status := userRR.Code; status != http.StatusCreated {
 		t.Fatalf("Failed to create mock user: got %v want %v", status, http.StatusCreated)
@@ -137,7 +142,7 @@ func TestHandleAddRoleToUser(t *testing.T) {
 	}
 
 	roleRR := httptest.NewRecorder()
-	HandleCreateRole(roleRR, roleReq)
+	api.HandleCreateRole(roleRR, roleReq)
 
 	if status := roleRR.Code; status != http.StatusCreated {
 		t.Fatalf("Failed to create mock role: got %v want %v", status, http.StatusCreated)
@@ -151,7 +156,7 @@ func TestHandleAddRoleToUser(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	HandleAddRoleToUser(rr, req)
+	api.HandleAddRoleToUser(rr, req)
 
 	if status := rr.Code; status != http.StatusCreated {
 		t.Errorf("Handler returned wrong status code for adding role to user: got %v want %v", status, http.StatusCreated)
@@ -159,7 +164,7 @@ func TestHandleAddRoleToUser(t *testing.T) {
 
 	// Test adding the same role again to the user
 	//dupRoleRR := httptest.NewRecorder()
-	HandleAddRoleToUser(rr, req)
+	api.HandleAddRoleToUser(rr, req)
 
 	// Assuming the handler doesn't throw an error for duplicate roles, it should return StatusCreated again
 	if status := rr.Code; status != http.StatusCreated {
@@ -178,10 +183,10 @@ func TestHandleAuthenticate(t *testing.T) {
 	}
 
 	rr1 := httptest.NewRecorder()
-	HandleAuthenticate(rr1, req1)
+	api.HandleAuthenticate(rr1, req1)
 
-	if status := rr1.Code; status != http.StatusBadRequest {
-		t.Errorf("Handler returned wrong status code for non-existent user: got %v want %v", status, http.StatusBadRequest)
+	if status := rr1.Code; status != http.StatusUnauthorized {
+		t.Errorf("Handler returned wrong status code for non-existent user: got %v want %v", status, http.StatusUnauthorized)
 	}
 
 	// 2. Create a user and authenticate with the correct password
@@ -192,7 +197,7 @@ func TestHandleAuthenticate(t *testing.T) {
 	}
 
 	userRR := httptest.NewRecorder()
-	HandleCreateUser(userRR, userReq)
+	api.HandleCreateUser(userRR, userReq)
 
 	if status := userRR.Code; status != http.StatusCreated {
 		t.Fatalf("Failed to create mock user: got %v want %v", status, http.StatusCreated)
@@ -205,7 +210,7 @@ func TestHandleAuthenticate(t *testing.T) {
 	}
 
 	rr2 := httptest.NewRecorder()
-	HandleAuthenticate(rr2, req2)
+	api.HandleAuthenticate(rr2, req2)
 
 	if status := rr2.Code; status != http.StatusOK {
 		t.Errorf("Handler returned wrong status code for correct password: got %v want %v", status, http.StatusOK)
@@ -226,10 +231,10 @@ func TestHandleAuthenticate(t *testing.T) {
 	}
 
 	rr3 := httptest.NewRecorder()
-	HandleAuthenticate(rr3, req3)
+	api.HandleAuthenticate(rr3, req3)
 
-	if status := rr3.Code; status != http.StatusBadRequest {
-		t.Errorf("Handler returned wrong status code for wrong password: got %v want %v", status, http.StatusBadRequest)
+	if status := rr3.Code; status != http.StatusUnauthorized {
+		t.Errorf("Handler returned wrong status code for wrong password: got %v want %v", status, http.StatusUnauthorized)
 	}
 }
 func TestHandleGenerateToken(t *testing.T) {
@@ -243,7 +248,7 @@ func TestHandleGenerateToken(t *testing.T) {
 		t.Fatal(err)
 	}
 	userRR := httptest.NewRecorder()
-	HandleCreateUser(userRR, userReq)
+	api.HandleCreateUser(userRR, userReq)
 	if status := userRR.Code; status != http.StatusCreated {
 		t.Fatalf("Failed to create mock user: got %v want %v", status, http.StatusCreated)
 	}
@@ -255,7 +260,7 @@ func TestHandleGenerateToken(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	HandleGenerateToken(rr, req)
+	api.HandleGenerateToken(rr, req)
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
@@ -279,7 +284,7 @@ func TestHandleInvalidateToken(t *testing.T) {
         t.Fatal(err)
     }
     userRR := httptest.NewRecorder()
-    HandleCreateUser(userRR, userReq)
+    api.HandleCreateUser(userRR, userReq)
 
 	tokenDetails, _ := service.Authenticate("testuser", "testpass")
 	reqBody := bytes.NewBufferString(`{"token":"` + tokenDetails.Token + `"}`)
@@ -289,7 +294,7 @@ func TestHandleInvalidateToken(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	HandleInvalidateToken(rr, req)
+	api.HandleInvalidateToken(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
@@ -306,7 +311,7 @@ func TestHandleCheckRole(t *testing.T) {
         t.Fatal(err)
     }
     userRR := httptest.NewRecorder()
-    HandleCreateUser(userRR, userReq)
+    api.HandleCreateUser(userRR, userReq)
     if status := userRR.Code; status != http.StatusCreated {
         t.Fatalf("Failed to create mock user: got %v want %v", status, http.StatusCreated)
     }
@@ -318,7 +323,7 @@ func TestHandleCheckRole(t *testing.T) {
         t.Fatal(err)
     }
     authRR := httptest.NewRecorder()
-    HandleAuthenticate(authRR, authReq)
+    api.HandleAuthenticate(authRR, authReq)
     if status := authRR.Code; status != http.StatusOK {
         t.Fatalf("Failed to authenticate mock user: got %v want %v", status, http.StatusOK)
     }
@@ -335,7 +340,7 @@ func TestHandleCheckRole(t *testing.T) {
         t.Fatal(err)
     }
     roleRR := httptest.NewRecorder()
-    HandleCreateRole(roleRR, roleReq)
+    api.HandleCreateRole(roleRR, roleReq)
     if status := roleRR.Code; status != http.StatusCreated {
         t.Fatalf("Failed to create mock role: got %v want %v", status, http.StatusCreated)
     }
@@ -347,7 +352,7 @@ func TestHandleCheckRole(t *testing.T) {
         t.Fatal(err)
     }
     assignRR := httptest.NewRecorder()
-    HandleAddRoleToUser(assignRR, assignReq)
+    api.HandleAddRoleToUser(assignRR, assignReq)
     if status := assignRR.Code; status != http.StatusCreated {
         t.Fatalf("Failed to assign role to user: got %v want %v", status, http.StatusCreated)
     }
@@ -360,7 +365,7 @@ func TestHandleCheckRole(t *testing.T) {
         t.Fatal(err)
     }
     checkRR := httptest.NewRecorder()
-    HandleCheckRole(checkRR, checkReq)
+    api.HandleCheckRole(checkRR, checkReq)
     if status := checkRR.Code; status != http.StatusOK {
         t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
     }
@@ -385,7 +390,7 @@ func TestHandleGetAllRoles(t *testing.T) {
         t.Fatal(err)
     }
     userRR := httptest.NewRecorder()
-    HandleCreateUser(userRR, userReq)
+    api.HandleCreateUser(userRR, userReq)
     if status := userRR.Code; status != http.StatusCreated {
         t.Fatalf("Failed to create mock user: got %v want %v", status, http.StatusCreated)
     }
@@ -397,7 +402,7 @@ func TestHandleGetAllRoles(t *testing.T) {
         t.Fatal(err)
     }
     authRR := httptest.NewRecorder()
-    HandleAuthenticate(authRR, authReq)
+    api.HandleAuthenticate(authRR, authReq)
     if status := authRR.Code; status != http.StatusOK {
         t.Fatalf("Failed to authenticate mock user: got %v want %v", status, http.StatusOK)
     }
@@ -416,7 +421,7 @@ func TestHandleGetAllRoles(t *testing.T) {
             t.Fatal(err)
         }
         roleRR := httptest.NewRecorder()
-        HandleCreateRole(roleRR, roleReq)
+        api.HandleCreateRole(roleRR, roleReq)
         if status := roleRR.Code; status != http.StatusCreated {
             t.Fatalf("Failed to create role %s: got %v want %v", roleName, status, http.StatusCreated)
         }
@@ -428,7 +433,7 @@ func TestHandleGetAllRoles(t *testing.T) {
             t.Fatal(err)
         }
         assignRR := httptest.NewRecorder()
-        HandleAddRoleToUser(assignRR, assignReq)
+        api.HandleAddRoleToUser(assignRR, assignReq)
         if status := assignRR.Code; status != http.StatusCreated {
             t.Fatalf("Failed to assign role %s to user: got %v want %v", roleName, status, http.StatusCreated)
         }
@@ -441,7 +446,7 @@ func TestHandleGetAllRoles(t *testing.T) {
         t.Fatal(err)
     }
     rr := httptest.NewRecorder()
-    HandleGetAllRoles(rr, req)
+    api.HandleGetAllRoles(rr, req)
     if status := rr.Code; status != http.StatusOK {
         t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
     }
@@ -456,3 +461,587 @@ func TestHandleGetAllRoles(t *testing.T) {
     }
 }
 
+
+func TestHandleRefreshToken(t *testing.T) {
+	setupService()
+
+	service.CreateUser("testuser", "testpass")
+	tokenDetails, _ := service.Authenticate("testuser", "testpass")
+
+	reqBody := bytes.NewBufferString(`{"refreshToken":"` + tokenDetails.RefreshToken + `"}`)
+	req, err := http.NewRequest("POST", "/refresh-token", reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	api.HandleRefreshToken(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var refreshed TokenDetails
+	if err := json.NewDecoder(rr.Body).Decode(&refreshed); err != nil {
+		t.Fatal("Failed decoding response body")
+	}
+	if refreshed.Token == "" || refreshed.RefreshToken == "" {
+		t.Errorf("Expected a new token pair but got %+v", refreshed)
+	}
+
+	// Replaying the old refresh token is rejected
+	replayBody := bytes.NewBufferString(`{"refreshToken":"` + tokenDetails.RefreshToken + `"}`)
+	replayReq, err := http.NewRequest("POST", "/refresh-token", replayBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayRR := httptest.NewRecorder()
+	api.HandleRefreshToken(replayRR, replayReq)
+	if status := replayRR.Code; status != http.StatusUnauthorized {
+		t.Errorf("Handler returned wrong status code for reused token: got %v want %v", status, http.StatusUnauthorized)
+	}
+}
+
+func TestHandleRotateAndRetireSigningKey(t *testing.T) {
+	setupService()
+
+	oldKeyID := service.(*InMemoryAuthService).Keys().Active().ID
+
+	req, err := http.NewRequest("POST", "/rotate-signing-key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	api.HandleRotateSigningKey(rr, req)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var rotated map[string]string
+	if err := json.NewDecoder(rr.Body).Decode(&rotated); err != nil {
+		t.Fatal("Failed decoding response body")
+	}
+	if rotated["keyId"] == "" || rotated["keyId"] == oldKeyID {
+		t.Errorf("Expected a new key id but got %q", rotated["keyId"])
+	}
+
+	// The new active key cannot be retired, the old one can
+	for keyID, want := range map[string]int{rotated["keyId"]: http.StatusConflict, oldKeyID: http.StatusOK} {
+		retireReq, err := http.NewRequest("POST", "/retire-signing-key", bytes.NewBufferString(`{"keyId":"`+keyID+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		retireRR := httptest.NewRecorder()
+		api.HandleRetireSigningKey(retireRR, retireReq)
+		if status := retireRR.Code; status != want {
+			t.Errorf("Handler returned wrong status code retiring %s: got %v want %v", keyID, status, want)
+		}
+	}
+}
+
+func TestHandleJWKS(t *testing.T) {
+	key, err := GenerateSigningKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service = NewInMemoryAuthService(NewMemoryStore(), WithKeyRing(NewKeyRing(key)))
+	api = NewHandler(service)
+
+	req, err := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	api.HandleJWKS(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var jwks JSONWebKeySet
+	if err := json.NewDecoder(rr.Body).Decode(&jwks); err != nil {
+		t.Fatal("Failed decoding response body")
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != key.ID || jwks.Keys[0].Kty != "OKP" {
+		t.Errorf("Expected the signing key in the key set but got %+v", jwks)
+	}
+}
+
+func TestHandleIntrospect(t *testing.T) {
+	setupService()
+	service.(*InMemoryAuthService).AddIntrospectionClient("gateway", "gateway-secret")
+
+	service.CreateUser("testuser", "testpass")
+	tokenDetails, _ := service.Authenticate("testuser", "testpass")
+
+	introspect := func(clientID, secret, token string) *httptest.ResponseRecorder {
+		form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+		req, err := http.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if clientID != "" {
+			req.SetBasicAuth(clientID, secret)
+		}
+		rr := httptest.NewRecorder()
+		api.HandleIntrospect(rr, req)
+		return rr
+	}
+
+	if status := introspect("", "", tokenDetails.Token).Code; status != http.StatusUnauthorized {
+		t.Errorf("Handler returned wrong status code without credentials: got %v want %v", status, http.StatusUnauthorized)
+	}
+	if status := introspect("gateway", "wrong", tokenDetails.Token).Code; status != http.StatusUnauthorized {
+		t.Errorf("Handler returned wrong status code with a bad secret: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	rr := introspect("gateway", "gateway-secret", tokenDetails.Token)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var result map[string]interface{}
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatal("Failed decoding response body")
+	}
+	if result["active"] != true || result["sub"] != "testuser" {
+		t.Errorf("Expected an active token for testuser but got %v", result)
+	}
+
+	rr = introspect("gateway", "gateway-secret", "not-a-token")
+	result = nil
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatal("Failed decoding response body")
+	}
+	if len(result) != 1 || result["active"] != false {
+		t.Errorf("Expected only active=false for an unknown token but got %v", result)
+	}
+}
+
+func TestHandleChangePasswordAndRevokeUserTokens(t *testing.T) {
+	setupService()
+	service.CreateUser("testuser", "testpass")
+	tokenDetails, _ := service.Authenticate("testuser", "testpass")
+
+	changeReq, err := http.NewRequest("POST", "/change-password", bytes.NewBufferString(`{"username":"testuser", "password":"testpass", "newPassword":"newpass"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changeRR := httptest.NewRecorder()
+	api.HandleChangePassword(changeRR, changeReq)
+	if status := changeRR.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if _, err := service.GetAllRoles(tokenDetails.Token); err == nil {
+		t.Errorf("Expected the old session to be revoked after a password change")
+	}
+
+	tokenDetails, _ = service.Authenticate("testuser", "newpass")
+	revokeReq, err := http.NewRequest("POST", "/revoke-user-tokens", bytes.NewBufferString(`{"username":"testuser"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokeRR := httptest.NewRecorder()
+	api.HandleRevokeUserTokens(revokeRR, revokeReq)
+	if status := revokeRR.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if _, err := service.GetAllRoles(tokenDetails.Token); err == nil {
+		t.Errorf("Expected every session to be revoked")
+	}
+}
+
+func TestHandleListAndRevokeSessions(t *testing.T) {
+	setupService()
+	service.CreateUser("testuser", "testpass")
+
+	authReq, err := http.NewRequest("POST", "/authenticate", bytes.NewBufferString(`{"username":"testuser", "password":"testpass"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authReq.RemoteAddr = "192.0.2.1:54321"
+	authReq.Header.Set("User-Agent", "session-test")
+	authRR := httptest.NewRecorder()
+	api.HandleAuthenticate(authRR, authReq)
+	var tokenDetails TokenDetails
+	if err := json.NewDecoder(authRR.Body).Decode(&tokenDetails); err != nil {
+		t.Fatal("Failed decoding response body")
+	}
+
+	listReq, err := http.NewRequest("POST", "/list-sessions", bytes.NewBufferString(`{"username":"testuser"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listRR := httptest.NewRecorder()
+	api.HandleListSessions(listRR, listReq)
+	if status := listRR.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var sessions []Session
+	if err := json.NewDecoder(listRR.Body).Decode(&sessions); err != nil {
+		t.Fatal("Failed decoding response body")
+	}
+	if len(sessions) != 1 || sessions[0].ClientIP != "192.0.2.1" || sessions[0].UserAgent != "session-test" {
+		t.Fatalf("Expected one session from 192.0.2.1 with user agent session-test but got %+v", sessions)
+	}
+
+	revokeReq, err := http.NewRequest("POST", "/revoke-session", bytes.NewBufferString(`{"username":"testuser", "sessionId":"`+sessions[0].ID+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokeRR := httptest.NewRecorder()
+	api.HandleRevokeSession(revokeRR, revokeReq)
+	if status := revokeRR.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if _, err := service.GetAllRoles(tokenDetails.Token); err == nil {
+		t.Errorf("Expected the revoked session's token to be invalid")
+	}
+
+	revokeReq, err = http.NewRequest("POST", "/revoke-session", bytes.NewBufferString(`{"username":"testuser", "sessionId":"unknown"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokeRR = httptest.NewRecorder()
+	api.HandleRevokeSession(revokeRR, revokeReq)
+	if status := revokeRR.Code; status != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestHandleGrantAndCheckPermission(t *testing.T) {
+	setupService()
+	service.CreateUser("testuser", "testpass")
+	service.CreateRole("testrole")
+	service.AddRoleToUser("testuser", "testrole")
+	tokenDetails, _ := service.Authenticate("testuser", "testpass")
+
+	checkPermission := func() bool {
+		req, err := http.NewRequest("POST", "/check-permission", bytes.NewBufferString(`{"token":"`+tokenDetails.Token+`", "permission":"orders:read"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		api.HandleCheckPermission(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var response map[string]bool
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal("Failed decoding response body")
+		}
+		return response["hasPermission"]
+	}
+
+	if checkPermission() {
+		t.Errorf("Expected the permission to be missing before it is granted")
+	}
+
+	grantReq, err := http.NewRequest("POST", "/grant-permission", bytes.NewBufferString(`{"roleName":"testrole", "permission":"orders:read"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grantRR := httptest.NewRecorder()
+	api.HandleGrantPermission(grantRR, grantReq)
+	if status := grantRR.Code; status != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	if !checkPermission() {
+		t.Errorf("Expected the granted permission to be present")
+	}
+
+	revokeReq, err := http.NewRequest("POST", "/revoke-permission", bytes.NewBufferString(`{"roleName":"testrole", "permission":"orders:read"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokeRR := httptest.NewRecorder()
+	api.HandleRevokePermission(revokeRR, revokeReq)
+	if status := revokeRR.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if checkPermission() {
+		t.Errorf("Expected the revoked permission to be missing")
+	}
+
+	grantReq, err = http.NewRequest("POST", "/grant-permission", bytes.NewBufferString(`{"roleName":"unknown", "permission":"orders:read"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grantRR = httptest.NewRecorder()
+	api.HandleGrantPermission(grantRR, grantReq)
+	if status := grantRR.Code; status != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestHandleRoleHierarchy(t *testing.T) {
+	setupService()
+	service.CreateUser("testuser", "testpass")
+	service.CreateRole("admin")
+	service.CreateRole("viewer")
+	service.AddRoleToUser("testuser", "admin")
+	tokenDetails, _ := service.Authenticate("testuser", "testpass")
+
+	addReq, err := http.NewRequest("POST", "/add-child-role", bytes.NewBufferString(`{"roleName":"admin", "childRoleName":"viewer"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addRR := httptest.NewRecorder()
+	api.HandleAddChildRole(addRR, addReq)
+	if status := addRR.Code; status != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	cycleReq, err := http.NewRequest("POST", "/add-child-role", bytes.NewBufferString(`{"roleName":"viewer", "childRoleName":"admin"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cycleRR := httptest.NewRecorder()
+	api.HandleAddChildRole(cycleRR, cycleReq)
+	if status := cycleRR.Code; status != http.StatusConflict {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	listings := []struct {
+		path    string
+		handler http.HandlerFunc
+		want    int
+	}{
+		{"/get-all-roles", api.HandleGetAllRoles, 2},
+		{"/get-direct-roles", api.HandleGetDirectRoles, 1},
+	}
+	for _, listing := range listings {
+		req, err := http.NewRequest("POST", listing.path, bytes.NewBufferString(`{"token":"`+tokenDetails.Token+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		listing.handler(rr, req)
+		var roles []Role
+		if err := json.NewDecoder(rr.Body).Decode(&roles); err != nil {
+			t.Fatal("Failed decoding response body")
+		}
+		if len(roles) != listing.want {
+			t.Errorf("%s: expected %d roles but got %d", listing.path, listing.want, len(roles))
+		}
+	}
+
+	removeReq, err := http.NewRequest("POST", "/remove-child-role", bytes.NewBufferString(`{"roleName":"admin", "childRoleName":"viewer"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeRR := httptest.NewRecorder()
+	api.HandleRemoveChildRole(removeRR, removeReq)
+	if status := removeRR.Code; status != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+}
+
+func TestHandleRemoveRoleFromUser(t *testing.T) {
+	setupService()
+	service.CreateUser("testuser", "testpass")
+	service.CreateRole("testrole")
+	service.AddRoleToUser("testuser", "testrole")
+	tokenDetails, _ := service.Authenticate("testuser", "testpass")
+
+	req, err := http.NewRequest("POST", "/remove-role-from-user", bytes.NewBufferString(`{"username":"testuser", "roleName":"testrole"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	api.HandleRemoveRoleFromUser(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if hasRole, _ := service.CheckUserRole(tokenDetails.Token, "testrole"); hasRole {
+		t.Errorf("Expected the role to be removed from the user")
+	}
+
+	req, err = http.NewRequest("POST", "/remove-role-from-user", bytes.NewBufferString(`{"username":"unknown", "roleName":"testrole"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	api.HandleRemoveRoleFromUser(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestHandleDeleteAssignedRole(t *testing.T) {
+	setupService()
+	service.CreateUser("testuser", "testpass")
+	service.CreateRole("testrole")
+	service.AddRoleToUser("testuser", "testrole")
+
+	usersReq, err := http.NewRequest("POST", "/get-role-users", bytes.NewBufferString(`{"roleName":"testrole"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersRR := httptest.NewRecorder()
+	api.HandleGetRoleUsers(usersRR, usersReq)
+	var usernames []string
+	if err := json.NewDecoder(usersRR.Body).Decode(&usernames); err != nil {
+		t.Fatal("Failed decoding response body")
+	}
+	if len(usernames) != 1 || usernames[0] != "testuser" {
+		t.Errorf("Expected [testuser] but got %v", usernames)
+	}
+
+	deleteReq, err := http.NewRequest("POST", "/delete-role", bytes.NewBufferString(`{"roleName":"testrole"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteRR := httptest.NewRecorder()
+	api.HandleDeleteRole(deleteRR, deleteReq)
+	if status := deleteRR.Code; status != http.StatusConflict {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	deleteReq, err = http.NewRequest("POST", "/delete-role", bytes.NewBufferString(`{"roleName":"testrole", "cascade":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteRR = httptest.NewRecorder()
+	api.HandleDeleteRole(deleteRR, deleteReq)
+	if status := deleteRR.Code; status != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	setupService()
+	admin := service.(*InMemoryAuthService)
+	admin.EnsureAdmin("root", "rootpass")
+	admin.CreateUser("testuser", "testpass")
+	adminToken, _ := admin.Authenticate("root", "rootpass")
+	userToken, _ := admin.Authenticate("testuser", "testpass")
+
+	handler := api.RequireAdmin(api.HandleCreateRole)
+	cases := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"other scheme", "Basic " + adminToken.Token, http.StatusUnauthorized},
+		{"invalid token", "Bearer not-a-token", http.StatusUnauthorized},
+		{"not an admin", "Bearer " + userToken.Token, http.StatusForbidden},
+		{"admin", "Bearer " + adminToken.Token, http.StatusCreated},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest("POST", "/create-role", bytes.NewBufferString(`{"roleName":"testrole"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if status := rr.Code; status != tc.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, status, tc.want)
+		}
+		if rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a WWW-Authenticate challenge", tc.name)
+		}
+	}
+}
+
+func TestHandleBearerToken(t *testing.T) {
+	setupService()
+	service.CreateUser("testuser", "testpass")
+	service.CreateRole("testrole")
+	service.AddRoleToUser("testuser", "testrole")
+	tokenDetails, _ := service.Authenticate("testuser", "testpass")
+
+	cases := []struct {
+		name       string
+		prepare    func(req *http.Request)
+		body       string
+		want       int
+		challenge  string
+		deprecated bool
+	}{
+		{"header", func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+tokenDetails.Token) }, "", http.StatusOK, "", false},
+		{"cookie", func(req *http.Request) { req.AddCookie(&http.Cookie{Name: TokenCookieName, Value: tokenDetails.Token}) }, "", http.StatusOK, "", false},
+		{"cookie on a POST", func(req *http.Request) {
+			req.Method = "POST"
+			req.AddCookie(&http.Cookie{Name: TokenCookieName, Value: tokenDetails.Token})
+		}, "", http.StatusUnauthorized, `Bearer realm="simple_auth"`, false},
+		{"body", func(req *http.Request) {}, `{"token":"` + tokenDetails.Token + `"}`, http.StatusOK, "", true},
+		{"missing", func(req *http.Request) {}, "", http.StatusUnauthorized, `Bearer realm="simple_auth"`, false},
+		{"invalid", func(req *http.Request) { req.Header.Set("Authorization", "Bearer not-a-token") }, "", http.StatusUnauthorized,
+			`Bearer realm="simple_auth", error="invalid_token", error_description="invalid token"`, false},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest("GET", "/check-role?roleName=testrole", bytes.NewBufferString(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.prepare(req)
+		rr := httptest.NewRecorder()
+		api.HandleCheckRole(rr, req)
+		if status := rr.Code; status != tc.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, status, tc.want)
+			continue
+		}
+		if got := rr.Header().Get("WWW-Authenticate"); got != tc.challenge {
+			t.Errorf("%s: got challenge %q want %q", tc.name, got, tc.challenge)
+		}
+		if deprecated := rr.Header().Get("Deprecation") != ""; deprecated != tc.deprecated {
+			t.Errorf("%s: got deprecation %v want %v", tc.name, deprecated, tc.deprecated)
+		}
+		if tc.want == http.StatusOK && !strings.Contains(rr.Body.String(), `"hasRole":true`) {
+			t.Errorf("%s: expected the role to be found but got %s", tc.name, rr.Body.String())
+		}
+	}
+}
+
+func TestHandleErrorProblem(t *testing.T) {
+	setupService()
+	service.CreateUser("testuser", "testpass")
+	service.CreateRole("testrole")
+
+	// a token that expired a minute ago
+	defer setTokenDuration(tokenDuration)
+	setTokenDuration(-time.Minute)
+	expired, _ := service.Authenticate("testuser", "testpass")
+
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		token   string
+		status  int
+		code    string
+	}{
+		{"expired token", api.HandleCheckRole, `{"roleName":"testrole"}`, expired.Token, http.StatusUnauthorized, "token_expired"},
+		{"expired token checking a permission", api.HandleCheckPermission, `{"permission":"orders:read"}`, expired.Token, http.StatusUnauthorized, "token_expired"},
+		{"duplicate user", api.HandleCreateUser, `{"username":"testuser","password":"testpass"}`, "", http.StatusConflict, "user_exists"},
+		{"wrong password", api.HandleAuthenticate, `{"username":"testuser","password":"wrong"}`, "", http.StatusUnauthorized, "invalid_credentials"},
+		{"missing role", api.HandleDeleteRole, `{"roleName":"missing"}`, "", http.StatusNotFound, "role_not_found"},
+		{"missing parameters", api.HandleCreateRole, `{}`, "", http.StatusBadRequest, "missing_parameters"},
+		{"malformed body", api.HandleCreateRole, `{`, "", http.StatusBadRequest, "malformed_request"},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest("POST", "/", bytes.NewBufferString(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rr := httptest.NewRecorder()
+		tc.handler(rr, req)
+		if status := rr.Code; status != tc.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, status, tc.status)
+		}
+		if contentType := rr.Header().Get("Content-Type"); contentType != "application/problem+json" {
+			t.Errorf("%s: got content type %q", tc.name, contentType)
+		}
+		var problem Problem
+		if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if problem.Code != tc.code || problem.Status != tc.status || problem.Title != http.StatusText(tc.status) {
+			t.Errorf("%s: got problem %+v want code %q", tc.name, problem, tc.code)
+		}
+	}
+}
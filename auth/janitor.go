@@ -0,0 +1,90 @@
+// auth/janitor.go
+
+package auth
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// JanitorStats reports what a Janitor has done since it was created
+type JanitorStats struct {
+	Sweeps    int64 // sweeps that completed
+	Failures  int64 // sweeps the store returned an error for
+	Removed   SweepResult
+	LastSweep time.Time // start of the last completed sweep
+}
+
+// Janitor periodically removes expired tokens and sessions from a store, so
+// tokens nobody presents again do not accumulate.
+type Janitor struct {
+	store    ExpiringStore
+	interval time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	stats JanitorStats
+}
+
+// JanitorOption configures a Janitor
+type JanitorOption func(*Janitor)
+
+// WithClock makes the janitor read the time from now instead of time.Now
+func WithClock(now func() time.Time) JanitorOption {
+	return func(j *Janitor) {
+		j.now = now
+	}
+}
+
+// NewJanitor returns a janitor that sweeps store every interval once Run is called
+func NewJanitor(store ExpiringStore, interval time.Duration, opts ...JanitorOption) *Janitor {
+	j := &Janitor{store: store, interval: interval, now: time.Now}
+	for _, opt := range opts {
+		opt(j)
+	}
+	return j
+}
+
+// Run sweeps every interval until ctx is cancelled
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := j.Sweep(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("auth: sweeping expired tokens: %v", err)
+			}
+		}
+	}
+}
+
+// Sweep removes everything that has expired by now and updates the stats
+func (j *Janitor) Sweep(ctx context.Context) (SweepResult, error) {
+	started := j.now()
+	result, err := j.store.DeleteExpired(ctx, started.Unix())
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err != nil {
+		j.stats.Failures++
+		return SweepResult{}, err
+	}
+	j.stats.Sweeps++
+	j.stats.Removed.AccessTokens += result.AccessTokens
+	j.stats.Removed.RefreshTokens += result.RefreshTokens
+	j.stats.Removed.Sessions += result.Sessions
+	j.stats.LastSweep = started
+	return result, nil
+}
+
+// Stats returns a snapshot of the janitor's counters
+func (j *Janitor) Stats() JanitorStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stats
+}
@@ -0,0 +1,116 @@
+// auth/janitor_test.go
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJanitorSweepsExpiredTokens(t *testing.T) {
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			s := NewInMemoryAuthService(store)
+			assert.Nil(t, s.CreateUser("sweptUser", "password123"))
+			first, err := s.Authenticate("sweptUser", "password123")
+			assert.Nil(t, err)
+			rotated, err := s.RefreshToken(first.RefreshToken)
+			assert.Nil(t, err)
+
+			now := time.Now()
+			janitor := NewJanitor(store, time.Minute, WithClock(func() time.Time { return now }))
+
+			result, err := janitor.Sweep(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, SweepResult{}, result, "Nothing has expired yet")
+
+			now = now.Add(tokenDuration + 2*time.Second)
+			result, err = janitor.Sweep(ctx)
+			assert.Nil(t, err)
+			// rotating does not revoke the previous access token, it just runs out
+			assert.Equal(t, SweepResult{AccessTokens: 2}, result, "Only the access tokens should have expired")
+			_, err = store.GetToken(ctx, rotated.Token)
+			assert.Equal(t, ErrNotFound, err, "The expired access token should be gone")
+			_, err = store.GetRefreshToken(ctx, rotated.RefreshToken)
+			assert.Nil(t, err, "Refresh tokens should outlive access tokens")
+
+			now = now.Add(refreshTokenDuration)
+			result, err = janitor.Sweep(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, SweepResult{RefreshTokens: 2, Sessions: 1}, result)
+			_, err = store.GetRefreshToken(ctx, first.RefreshToken)
+			assert.Equal(t, ErrNotFound, err, "Used refresh tokens should be swept too")
+			sessions, err := store.ListSessions(ctx, "sweptUser")
+			assert.Nil(t, err)
+			assert.Len(t, sessions, 0, "The expired session should be gone")
+
+			stats := janitor.Stats()
+			assert.Equal(t, int64(3), stats.Sweeps)
+			assert.Equal(t, SweepResult{AccessTokens: 2, RefreshTokens: 2, Sessions: 1}, stats.Removed)
+			assert.Equal(t, now, stats.LastSweep)
+		})
+	}
+}
+
+func TestJanitorSweepsReplayedFromLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store := openTestFileStore(t, dir, FileStoreOptions{})
+	assert.Nil(t, store.SaveToken(ctx, "expired", "alice", 100))
+	assert.Nil(t, store.SaveToken(ctx, "live", "alice", 300))
+	assert.Nil(t, store.SaveToken(ctx, "legacy", "alice", 0))
+	result, err := store.DeleteExpired(ctx, 200)
+	assert.Nil(t, err)
+	assert.Equal(t, SweepResult{AccessTokens: 1}, result)
+	assert.Nil(t, store.Close())
+
+	store = openTestFileStore(t, dir, FileStoreOptions{})
+	defer store.Close()
+	_, err = store.GetToken(ctx, "expired")
+	assert.Equal(t, ErrNotFound, err, "The sweep should be replayed")
+	_, err = store.GetToken(ctx, "live")
+	assert.Nil(t, err)
+	_, err = store.GetToken(ctx, "legacy")
+	assert.Nil(t, err, "Tokens without an expiry are never swept")
+}
+
+type failingSweepStore struct{}
+
+func (failingSweepStore) DeleteExpired(ctx context.Context, now int64) (SweepResult, error) {
+	return SweepResult{}, errors.New("store unavailable")
+}
+
+func TestJanitorCountsFailures(t *testing.T) {
+	janitor := NewJanitor(failingSweepStore{}, time.Minute)
+	_, err := janitor.Sweep(context.Background())
+	assert.NotNil(t, err)
+	stats := janitor.Stats()
+	assert.Equal(t, int64(1), stats.Failures)
+	assert.Equal(t, int64(0), stats.Sweeps)
+}
+
+func TestJanitorRunStopsWithContext(t *testing.T) {
+	janitor := NewJanitor(NewMemoryStore(), time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		janitor.Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return janitor.Stats().Sweeps > 0 }, time.Second, time.Millisecond,
+		"Run should sweep on every tick")
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run should return once its context is cancelled")
+	}
+}
@@ -0,0 +1,408 @@
+// auth/jwks.go
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JSONWebKey is the public half of a signing key in RFC 7517 form
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // EC and OKP curve
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is the document served at /.well-known/jwks.json
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// GenerateSigningKey creates a fresh key for the given JWT algorithm: HS256,
+// RS256, ES256 or EdDSA
+func GenerateSigningKey(alg string) (SigningKey, error) {
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		return GenerateHMACKey()
+	case jwt.SigningMethodRS256.Alg():
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		return NewAsymmetricKey(private)
+	case jwt.SigningMethodES256.Alg():
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		return NewAsymmetricKey(private)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		return NewAsymmetricKey(private)
+	}
+	return SigningKey{}, fmt.Errorf("unsupported signing algorithm %q", alg)
+}
+
+// NewAsymmetricKey wraps an RSA, P-256 ECDSA or Ed25519 private key. The ID is
+// the RFC 7638 thumbprint of the public key, so it is stable for a given key.
+func NewAsymmetricKey(private crypto.Signer) (SigningKey, error) {
+	key := SigningKey{SignKey: private, VerifyKey: private.Public(), CreatedAt: time.Now()}
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		key.Method = jwt.SigningMethodES256
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported private key type %T", private)
+	}
+
+	jwk, err := publicJWK(key)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	key.ID = thumbprint(jwk)
+	return key, nil
+}
+
+// ParsePrivateKeyPEM reads a PKCS#8, PKCS#1 (RSA) or SEC 1 (EC) private key
+func ParsePrivateKeyPEM(data []byte) (SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, errors.New("no PEM block found")
+	}
+
+	var private interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return SigningKey{}, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return SigningKey{}, fmt.Errorf("unsupported private key type %T", private)
+	}
+	return NewAsymmetricKey(signer)
+}
+
+// MarshalPrivateKeyPEM encodes an asymmetric key as PKCS#8
+func MarshalPrivateKeyPEM(key SigningKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key.SignKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// LoadOrGenerateKeyFile reads the private key at path, or on first boot
+// generates one for alg and writes it there so later starts reuse it
+func LoadOrGenerateKeyFile(path, alg string) (SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return ParsePrivateKeyPEM(data)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return SigningKey{}, err
+	}
+
+	if alg == jwt.SigningMethodHS256.Alg() {
+		return SigningKey{}, errors.New("HS256 keys are not stored as PEM; use a shared secret instead")
+	}
+	key, err := GenerateSigningKey(alg)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	data, err = MarshalPrivateKeyPEM(key)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	// O_EXCL so two processes booting at once never overwrite each other's key
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return SigningKey{}, err
+	}
+	return key, file.Close()
+}
+
+// activeKeyFileName names the file of a key directory holding the active key's ID
+const activeKeyFileName = "active"
+
+// OpenKeyDir loads the key ring kept in dir: one PEM private key per file,
+// named after the key's ID, and a file naming the active key. On first boot
+// it creates dir with a key generated for alg. Keys later added, rotated in
+// or retired are written to dir, so the ring survives restarts. Only
+// asymmetric keys can be kept this way.
+func OpenKeyDir(dir, alg string) (*KeyRing, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ring := &KeyRing{keys: make(map[string]SigningKey), dir: dir}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".pem" {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParsePrivateKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		// the file's age orders the ring the way it was built
+		if info, err := entry.Info(); err == nil {
+			key.CreatedAt = info.ModTime()
+		}
+		ring.keys[key.ID] = key
+	}
+
+	active, err := os.ReadFile(filepath.Join(dir, activeKeyFileName))
+	if errors.Is(err, os.ErrNotExist) && len(ring.keys) == 0 {
+		key, err := GenerateSigningKey(alg)
+		if err != nil {
+			return nil, err
+		}
+		if err := ring.Rotate(key); err != nil {
+			return nil, err
+		}
+		return ring, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ring.active = strings.TrimSpace(string(active))
+	if _, exists := ring.keys[ring.active]; !exists {
+		return nil, fmt.Errorf("%w: active key %q is not in %s", ErrKeyNotFound, ring.active, dir)
+	}
+	return ring, nil
+}
+
+// writeKey stores key in the ring's directory, if it has one. Callers must
+// hold mu.
+func (k *KeyRing) writeKey(key SigningKey) error {
+	if k.dir == "" {
+		return nil
+	}
+	if key.Method.Alg() == jwt.SigningMethodHS256.Alg() {
+		return errors.New("HS256 keys are not stored as PEM; use a shared secret instead")
+	}
+	data, err := MarshalPrivateKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	return replaceFile(filepath.Join(k.dir, key.ID+".pem"), data)
+}
+
+// writeActive records keyID as the active key in the ring's directory, if it
+// has one. Callers must hold mu.
+func (k *KeyRing) writeActive(keyID string) error {
+	if k.dir == "" {
+		return nil
+	}
+	return replaceFile(filepath.Join(k.dir, activeKeyFileName), []byte(keyID+"\n"))
+}
+
+// removeKey deletes a key from the ring's directory, if it has one. Callers
+// must hold mu.
+func (k *KeyRing) removeKey(keyID string) error {
+	if k.dir == "" {
+		return nil
+	}
+	err := os.Remove(filepath.Join(k.dir, keyID+".pem"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// replaceFile writes data to path by write-then-rename, so a crash leaves
+// either the old or the new content
+func replaceFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := writeFileSync(tmpPath, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// JWKS returns the public keys of every asymmetric key in the ring. Shared
+// HMAC secrets are never published.
+func (k *KeyRing) JWKS() JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range k.All() {
+		jwk, err := publicJWK(key)
+		if err != nil {
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+func publicJWK(key SigningKey) (JSONWebKey, error) {
+	jwk := JSONWebKey{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+	switch public := key.VerifyKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return JSONWebKey{}, errors.New("only P-256 ECDSA keys are supported")
+		}
+		point, err := public.ECDH()
+		if err != nil {
+			return JSONWebKey{}, err
+		}
+		// uncompressed point: 0x04 || X || Y
+		raw := point.Bytes()
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(raw[1:33])
+		jwk.Y = base64.RawURLEncoding.EncodeToString(raw[33:])
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	default:
+		return JSONWebKey{}, fmt.Errorf("key %q has no public form", key.ID)
+	}
+	return jwk, nil
+}
+
+// ParseJSONWebKey turns a published key back into a SigningKey that can only
+// verify, as downstream services do with the keys of /.well-known/jwks.json
+func ParseJSONWebKey(jwk JSONWebKey) (SigningKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	key := SigningKey{ID: jwk.Kid}
+	switch {
+	case jwk.Kty == "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return SigningKey{}, errors.New("RSA exponent out of range")
+		}
+		key.Method = jwt.SigningMethodRS256
+		key.VerifyKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	case jwk.Kty == "EC" && jwk.Crv == "P-256":
+		x, err := decode(jwk.X)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return SigningKey{}, errors.New("bad P-256 coordinates")
+		}
+		// crypto/ecdh rejects points that are not on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return SigningKey{}, err
+		}
+		key.Method = jwt.SigningMethodES256
+		key.VerifyKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+		x, err := decode(jwk.X)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return SigningKey{}, errors.New("bad Ed25519 key length")
+		}
+		key.Method = jwt.SigningMethodEdDSA
+		key.VerifyKey = ed25519.PublicKey(x)
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+	if jwk.Alg != "" && jwk.Alg != key.Method.Alg() {
+		return SigningKey{}, fmt.Errorf("key type %q does not fit algorithm %q", jwk.Kty, jwk.Alg)
+	}
+	return key, nil
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint: the hash of the required
+// members only, in lexicographic order
+func thumbprint(jwk JSONWebKey) string {
+	var members interface{}
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,149 @@
+// auth/jwks_test.go
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsymmetricSigning(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		t.Run(alg, func(t *testing.T) {
+			key, err := GenerateSigningKey(alg)
+			assert.Nil(t, err, "Error should be nil")
+			assert.Equal(t, alg, key.Method.Alg())
+
+			s := NewInMemoryAuthService(NewMemoryStore(), WithKeyRing(NewKeyRing(key)))
+			tokenDetails, err := s.GenerateToken("asymmetricUser")
+			assert.Nil(t, err, "Error should be nil")
+			username, err := s.ValidateToken(tokenDetails.Token)
+			assert.Nil(t, err, "Error should be nil")
+			assert.Equal(t, "asymmetricUser", username)
+
+			// A downstream service verifies with nothing but the published key
+			jwks := s.Keys().JWKS()
+			assert.Len(t, jwks.Keys, 1, "The public key should be published")
+			public := publicKeyFromJWK(t, jwks.Keys[0])
+			token, err := jwt.Parse(tokenDetails.Token, func(token *jwt.Token) (interface{}, error) {
+				return public, nil
+			}, jwt.WithValidMethods([]string{alg}))
+			assert.Nil(t, err, "The token should verify against the JWKS key")
+			assert.Equal(t, jwks.Keys[0].Kid, token.Header["kid"])
+
+			parsed, err := ParseJSONWebKey(jwks.Keys[0])
+			assert.Nil(t, err, "The published key should parse")
+			assert.Equal(t, public, parsed.VerifyKey)
+			assert.Equal(t, alg, parsed.Method.Alg())
+
+			// Rotation keeps the algorithm
+			_, err = s.RotateSigningKey()
+			assert.Nil(t, err, "Error should be nil")
+			assert.Equal(t, alg, s.Keys().Active().Method.Alg())
+			assert.Len(t, s.Keys().JWKS().Keys, 2, "Both keys should be published until one is retired")
+		})
+	}
+}
+
+func TestJWKSOmitsSharedSecrets(t *testing.T) {
+	ring := NewKeyRing(NewHMACKey([]byte("secret")))
+	assert.Len(t, ring.JWKS().Keys, 0, "HMAC secrets must never be published")
+}
+
+func TestParseJSONWebKeyRejectsBadKeys(t *testing.T) {
+	for name, jwk := range map[string]JSONWebKey{
+		"unknown type":  {Kty: "oct", Kid: "k"},
+		"off curve":     {Kty: "EC", Crv: "P-256", X: base64.RawURLEncoding.EncodeToString(make([]byte, 32)), Y: base64.RawURLEncoding.EncodeToString(make([]byte, 32))},
+		"short Ed25519": {Kty: "OKP", Crv: "Ed25519", X: "AAAA"},
+		"wrong alg":     {Kty: "OKP", Crv: "Ed25519", Alg: "RS256", X: base64.RawURLEncoding.EncodeToString(make([]byte, 32))},
+		"tiny exponent": {Kty: "RSA", N: "AQAB", E: "AQ"},
+	} {
+		_, err := ParseJSONWebKey(jwk)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestLoadOrGenerateKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing.pem")
+
+	generated, err := LoadOrGenerateKeyFile(path, "ES256")
+	assert.Nil(t, err, "The key should be generated on first boot")
+	info, err := os.Stat(path)
+	assert.Nil(t, err, "The generated key should be written out")
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm(), "The key file should be private")
+
+	loaded, err := LoadOrGenerateKeyFile(path, "ES256")
+	assert.Nil(t, err, "The key should be loaded on later boots")
+	assert.Equal(t, generated.ID, loaded.ID, "The same key should keep the same id")
+
+	_, err = ParsePrivateKeyPEM([]byte("not a key"))
+	assert.NotNil(t, err, "Garbage should not parse")
+}
+
+func TestKeyDirPersistsRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	ring, err := OpenKeyDir(dir, "ES256")
+	assert.Nil(t, err, "The first key should be generated on first boot")
+	first := ring.Active()
+	s := NewInMemoryAuthService(NewMemoryStore(), WithKeyRing(ring))
+	second, err := s.RotateSigningKey()
+	assert.Nil(t, err)
+	third, err := s.RotateSigningKey()
+	assert.Nil(t, err)
+	assert.Nil(t, s.RetireSigningKey(second))
+	tokenString, err := ring.Sign(jwt.MapClaims{"user": "keyUser"})
+	assert.Nil(t, err)
+
+	reopened, err := OpenKeyDir(dir, "ES256")
+	assert.Nil(t, err, "The key directory should be loaded on later boots")
+	assert.Equal(t, third, reopened.Active().ID, "The rotated-in key should stay active")
+	ids := []string{}
+	for _, key := range reopened.All() {
+		ids = append(ids, key.ID)
+	}
+	assert.ElementsMatch(t, []string{first.ID, third}, ids, "Retired keys should stay retired")
+	_, err = jwt.Parse(tokenString, reopened.Keyfunc)
+	assert.Nil(t, err, "Tokens signed before a restart should still verify")
+
+	assert.Nil(t, os.Remove(filepath.Join(dir, third+".pem")))
+	_, err = OpenKeyDir(dir, "ES256")
+	assert.NotNil(t, err, "A directory missing its active key should not load")
+
+	_, err = OpenKeyDir(t.TempDir(), "HS256")
+	assert.NotNil(t, err, "Shared secrets cannot be kept in a key directory")
+}
+
+func publicKeyFromJWK(t *testing.T, jwk JSONWebKey) interface{} {
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("Bad base64 in JWK: %v", err)
+		}
+		return b
+	}
+	switch jwk.Kty {
+	case "RSA":
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(decode(jwk.N)), E: int(new(big.Int).SetBytes(decode(jwk.E)).Int64())}
+	case "EC":
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(decode(jwk.X)),
+			Y:     new(big.Int).SetBytes(decode(jwk.Y)),
+		}
+	case "OKP":
+		return ed25519.PublicKey(decode(jwk.X))
+	}
+	t.Fatalf("Unexpected key type %q", jwk.Kty)
+	return nil
+}
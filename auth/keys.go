@@ -0,0 +1,174 @@
+// auth/keys.go
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is one key of a KeyRing, identified in token headers by its ID
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	SignKey   interface{} // handed to Method.Sign
+	VerifyKey interface{} // handed to Method.Verify
+	CreatedAt time.Time
+}
+
+// NewHMACKey wraps a shared secret as an HS256 key. The ID is derived from the
+// secret, so the same secret keeps the same ID across restarts.
+func NewHMACKey(secret []byte) SigningKey {
+	sum := sha256.Sum256(secret)
+	return SigningKey{
+		ID:        hex.EncodeToString(sum[:8]),
+		Method:    jwt.SigningMethodHS256,
+		SignKey:   secret,
+		VerifyKey: secret,
+		CreatedAt: time.Now(),
+	}
+}
+
+// GenerateHMACKey returns an HS256 key with a fresh random secret
+func GenerateHMACKey() (SigningKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return SigningKey{}, err
+	}
+	return NewHMACKey(secret), nil
+}
+
+// KeyRing holds the keys tokens are signed and verified with. New tokens are
+// always signed with the active key; every key still in the ring verifies,
+// so tokens in flight survive a rotation until their key is retired.
+type KeyRing struct {
+	mu     sync.RWMutex
+	active string
+	keys   map[string]SigningKey
+	dir    string // key directory changes are written to, see OpenKeyDir
+}
+
+// NewKeyRing returns a ring whose only, and active, key is initial
+func NewKeyRing(initial SigningKey) *KeyRing {
+	return &KeyRing{
+		active: initial.ID,
+		keys:   map[string]SigningKey{initial.ID: initial},
+	}
+}
+
+// Add puts a key in the ring for verification without activating it
+func (k *KeyRing) Add(key SigningKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, exists := k.keys[key.ID]; exists {
+		return fmt.Errorf("%w: %q", ErrKeyExists, key.ID)
+	}
+	if err := k.writeKey(key); err != nil {
+		return err
+	}
+	k.keys[key.ID] = key
+	return nil
+}
+
+// Rotate adds key and makes it the active signing key. The previous key
+// stays in the ring until retired.
+func (k *KeyRing) Rotate(key SigningKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, exists := k.keys[key.ID]; exists {
+		return fmt.Errorf("%w: %q", ErrKeyExists, key.ID)
+	}
+	if err := k.writeKey(key); err != nil {
+		return err
+	}
+	if err := k.writeActive(key.ID); err != nil {
+		return err
+	}
+	k.keys[key.ID] = key
+	k.active = key.ID
+	return nil
+}
+
+// Retire removes a key so tokens signed with it stop validating. The active
+// key cannot be retired.
+func (k *KeyRing) Retire(keyID string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, exists := k.keys[keyID]; !exists {
+		return fmt.Errorf("%w: %q", ErrKeyNotFound, keyID)
+	}
+	if keyID == k.active {
+		return ErrKeyActive
+	}
+	if err := k.removeKey(keyID); err != nil {
+		return err
+	}
+	delete(k.keys, keyID)
+	return nil
+}
+
+// Active returns the key new tokens are signed with
+func (k *KeyRing) Active() SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[k.active]
+}
+
+// Lookup returns the key with the given ID
+func (k *KeyRing) Lookup(keyID string) (SigningKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[keyID]
+	return key, ok
+}
+
+// All returns every key in the ring, oldest first
+func (k *KeyRing) All() []SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make([]SigningKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// Sign signs claims with the active key and records its ID in the kid header
+func (k *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	key := k.Active()
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.SignKey)
+}
+
+// Keyfunc resolves the verification key named by a token's kid header. It is
+// meant to be passed to jwt.Parse.
+func (k *KeyRing) Keyfunc(token *jwt.Token) (interface{}, error) {
+	keyID, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("token has no key id")
+	}
+	key, ok := k.Lookup(keyID)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", keyID)
+	}
+	// never let the token pick a different algorithm than the key was made for
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	return key.VerifyKey, nil
+}
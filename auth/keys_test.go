@@ -0,0 +1,59 @@
+// auth/keys_test.go
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRingRotateAndRetire(t *testing.T) {
+	first, err := GenerateHMACKey()
+	assert.Nil(t, err, "Error should be nil")
+	ring := NewKeyRing(first)
+	assert.Equal(t, first.ID, ring.Active().ID, "The initial key should be active")
+
+	second, _ := GenerateHMACKey()
+	assert.Nil(t, ring.Rotate(second), "Error should be nil")
+	assert.Equal(t, second.ID, ring.Active().ID, "The rotated-in key should be active")
+	_, ok := ring.Lookup(first.ID)
+	assert.True(t, ok, "The previous key should be kept for verification")
+
+	assert.NotNil(t, ring.Retire(second.ID), "The active key cannot be retired")
+	assert.Nil(t, ring.Retire(first.ID), "Error should be nil")
+	_, ok = ring.Lookup(first.ID)
+	assert.False(t, ok, "A retired key should be gone")
+	assert.NotNil(t, ring.Retire(first.ID), "Retiring an unknown key should fail")
+	assert.NotNil(t, ring.Rotate(second), "Adding a key twice should fail")
+}
+
+func TestKeyRingSignsWithKeyID(t *testing.T) {
+	key := NewHMACKey([]byte("secret"))
+	assert.Equal(t, key.ID, NewHMACKey([]byte("secret")).ID, "The same secret should give the same key id")
+	ring := NewKeyRing(key)
+
+	tokenString, err := ring.Sign(jwt.MapClaims{"user": "keyUser"})
+	assert.Nil(t, err, "Error should be nil")
+
+	token, err := jwt.Parse(tokenString, ring.Keyfunc)
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, key.ID, token.Header["kid"], "The kid header should name the signing key")
+}
+
+func TestKeyRingRejectsForeignTokens(t *testing.T) {
+	ring := NewKeyRing(NewHMACKey([]byte("secret")))
+
+	// no kid header
+	unnamed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{}).SignedString([]byte("secret"))
+	_, err := jwt.Parse(unnamed, ring.Keyfunc)
+	assert.NotNil(t, err, "Tokens without a kid should be rejected")
+
+	// right kid, different algorithm
+	mismatched := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{})
+	mismatched.Header["kid"] = ring.Active().ID
+	mismatchedString, _ := mismatched.SignedString([]byte("secret"))
+	_, err = jwt.Parse(mismatchedString, ring.Keyfunc)
+	assert.NotNil(t, err, "Tokens using another algorithm than their key should be rejected")
+}
@@ -0,0 +1,599 @@
+// auth/memory_store.go
+
+package auth
+
+import (
+	"container/heap"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gogorush/simple_auth/utils"
+)
+
+var _ Store = (*MemoryStore)(nil)
+
+// MemoryStore is a Store backed by concurrent maps. Its contents are lost when
+// the process exits.
+type MemoryStore struct {
+	users *utils.ConcurrentMap[string, User]
+	roles *utils.ConcurrentMap[string, Role]
+	// access token -> username, read on every validation; entries vanish at
+	// the token's expiry even before the sweeper gets to them
+	tokens *utils.ShardedConcurrentMap[string, string]
+
+	// roleMu serializes changes to role assignments so roleUsers always
+	// matches the roles the users hold
+	roleMu    sync.Mutex
+	roleUsers *utils.ConcurrentMap[string, []string] // role name -> usernames holding it
+
+	// tokenMu serializes token writes so the maps and indexes below never
+	// disagree; reads go straight to the maps
+	tokenMu       sync.Mutex
+	refreshTokens *utils.ConcurrentMap[string, RefreshToken]
+	families      *utils.ConcurrentMap[string, []string] // family -> refresh tokens
+	userTokens    *utils.ConcurrentMap[string, []string] // username -> access and refresh tokens
+	sessions      *utils.ConcurrentMap[string, Session]
+	userSessions  *utils.ConcurrentMap[string, []string] // username -> session IDs
+	expiry        expiryQueue
+}
+
+type expiryKind int
+
+const (
+	expiryAccess expiryKind = iota
+	expiryRefresh
+	expirySession
+)
+
+type expiryEntry struct {
+	at    int64
+	kind  expiryKind
+	key   string
+	owner string // username, to unindex tokens the map already dropped
+}
+
+// expiryQueue is a min-heap of expiry times. Entries are left in place when
+// their record goes away early; DeleteExpired skips them once they come due.
+type expiryQueue []expiryEntry
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].at < q[j].at }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(expiryEntry)) }
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:  utils.NewConcurrentMap[string, User](),
+		roles:  utils.NewConcurrentMap[string, Role](),
+		tokens: utils.NewShardedConcurrentMap[string](0),
+
+		roleUsers: utils.NewConcurrentMap[string, []string](),
+
+		refreshTokens: utils.NewConcurrentMap[string, RefreshToken](),
+		families:      utils.NewConcurrentMap[string, []string](),
+		userTokens:    utils.NewConcurrentMap[string, []string](),
+		sessions:      utils.NewConcurrentMap[string, Session](),
+		userSessions:  utils.NewConcurrentMap[string, []string](),
+	}
+}
+
+func (m *MemoryStore) CreateUser(ctx context.Context, user User) error {
+	m.roleMu.Lock()
+	defer m.roleMu.Unlock()
+	if !m.users.SetIfAbsent(user.Username, cloneUser(user)) {
+		return ErrAlreadyExists
+	}
+	m.reindexRoles(user.Username, nil, user.Roles)
+	return nil
+}
+
+func (m *MemoryStore) GetUser(ctx context.Context, username string) (User, error) {
+	user, exists := m.users.Get(username)
+	if !exists {
+		return User{}, ErrNotFound
+	}
+	return cloneUser(user), nil
+}
+
+func (m *MemoryStore) UpdateUser(ctx context.Context, user User) error {
+	m.roleMu.Lock()
+	defer m.roleMu.Unlock()
+	var before []Role
+	_, exists := m.users.Update(user.Username, func(current User, exists bool) (User, bool) {
+		if !exists {
+			return current, false
+		}
+		before = current.Roles
+		return cloneUser(user), true
+	})
+	if !exists {
+		return ErrNotFound
+	}
+	m.reindexRoles(user.Username, before, user.Roles)
+	return nil
+}
+
+func (m *MemoryStore) ModifyUser(ctx context.Context, username string, fn func(user *User) error) error {
+	m.roleMu.Lock()
+	defer m.roleMu.Unlock()
+	return m.modifyUser(username, fn)
+}
+
+func (m *MemoryStore) ModifyUserRevokingTokens(ctx context.Context, username string, fn func(user *User) error) error {
+	m.roleMu.Lock()
+	defer m.roleMu.Unlock()
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	if err := m.modifyUser(username, fn); err != nil {
+		return err
+	}
+	m.deleteUserTokens(username)
+	return nil
+}
+
+// modifyUser implements ModifyUser. Callers must hold roleMu.
+func (m *MemoryStore) modifyUser(username string, fn func(user *User) error) error {
+	err := ErrNotFound
+	var before, after []Role
+	m.users.Update(username, func(current User, exists bool) (User, bool) {
+		if !exists {
+			return current, false
+		}
+		modified := cloneUser(current)
+		if err = fn(&modified); err != nil {
+			return current, true
+		}
+		modified.Username = username
+		before, after = current.Roles, modified.Roles
+		return cloneUser(modified), true
+	})
+	if err == nil {
+		m.reindexRoles(username, before, after)
+	}
+	return err
+}
+
+func (m *MemoryStore) AddUserRole(ctx context.Context, username, roleName string) error {
+	m.roleMu.Lock()
+	defer m.roleMu.Unlock()
+	if _, exists := m.roles.Get(roleName); !exists {
+		return ErrNotFound
+	}
+	return m.modifyUser(username, func(user *User) error {
+		user.Roles = withRole(user.Roles, roleName)
+		return nil
+	})
+}
+
+func (m *MemoryStore) DeleteUser(ctx context.Context, username string) error {
+	m.roleMu.Lock()
+	defer m.roleMu.Unlock()
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	if user, exists := m.users.Get(username); exists {
+		m.users.Delete(username)
+		m.reindexRoles(username, user.Roles, nil)
+	}
+	m.deleteUserTokens(username)
+	return nil
+}
+
+func (m *MemoryStore) CreateRole(ctx context.Context, role Role) error {
+	if !m.roles.SetIfAbsent(role.Name, cloneRole(role)) {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetRole(ctx context.Context, roleName string) (Role, error) {
+	role, exists := m.roles.Get(roleName)
+	if !exists {
+		return Role{}, ErrNotFound
+	}
+	return cloneRole(role), nil
+}
+
+func (m *MemoryStore) ModifyRole(ctx context.Context, roleName string, fn func(role *Role) error) error {
+	err := ErrNotFound
+	m.roles.Update(roleName, func(current Role, exists bool) (Role, bool) {
+		if !exists {
+			return current, false
+		}
+		modified := cloneRole(current)
+		if err = fn(&modified); err != nil {
+			return current, true
+		}
+		modified.Name = roleName
+		return cloneRole(modified), true
+	})
+	return err
+}
+
+func (m *MemoryStore) DeleteRole(ctx context.Context, roleName string, cascade bool) error {
+	m.roleMu.Lock()
+	defer m.roleMu.Unlock()
+	holders, _ := m.roleUsers.Get(roleName)
+	if !cascade && len(holders) > 0 {
+		return ErrInUse
+	}
+	for _, username := range holders {
+		m.users.Update(username, func(current User, exists bool) (User, bool) {
+			if !exists {
+				return current, false
+			}
+			current = cloneUser(current)
+			current.Roles = slices.DeleteFunc(current.Roles, func(r Role) bool { return r.Name == roleName })
+			return current, true
+		})
+	}
+	m.roleUsers.Delete(roleName)
+	m.roles.Delete(roleName)
+
+	for _, parent := range m.roles.Keys() {
+		m.roles.Update(parent, func(current Role, exists bool) (Role, bool) {
+			if !exists || !slices.Contains(current.Children, roleName) {
+				return current, exists
+			}
+			current = cloneRole(current)
+			current.Children = without(current.Children, roleName)
+			return current, true
+		})
+	}
+	return nil
+}
+
+func (m *MemoryStore) ListRoleUsers(ctx context.Context, roleName string) ([]string, error) {
+	holders, _ := m.roleUsers.Get(roleName)
+	usernames := append([]string{}, holders...)
+	slices.Sort(usernames)
+	return usernames, nil
+}
+
+func (m *MemoryStore) SaveToken(ctx context.Context, token, username string, expiresAt int64) error {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	m.saveToken(token, username, expiresAt)
+	return nil
+}
+
+// saveToken implements SaveToken. Callers must hold tokenMu.
+func (m *MemoryStore) saveToken(token, username string, expiresAt int64) {
+	if expiresAt > 0 {
+		m.tokens.SetWithExpiry(token, username, time.Unix(expiresAt, 0))
+	} else {
+		m.tokens.Set(token, username)
+	}
+	m.indexToken(username, token)
+	m.expireAt(expiresAt, expiryAccess, token, username)
+}
+
+func (m *MemoryStore) GetToken(ctx context.Context, token string) (string, error) {
+	username, exists := m.tokens.Get(token)
+	if !exists {
+		return "", ErrNotFound
+	}
+	return username, nil
+}
+
+func (m *MemoryStore) DeleteToken(ctx context.Context, token string) error {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	m.deleteAccessToken(token)
+	return nil
+}
+
+func (m *MemoryStore) DeleteUserTokens(ctx context.Context, username string) error {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	m.deleteUserTokens(username)
+	return nil
+}
+
+func (m *MemoryStore) SaveRefreshToken(ctx context.Context, token string, refresh RefreshToken) error {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	m.saveRefreshToken(token, refresh)
+	return nil
+}
+
+// saveRefreshToken implements SaveRefreshToken. Callers must hold tokenMu.
+func (m *MemoryStore) saveRefreshToken(token string, refresh RefreshToken) {
+	m.refreshTokens.Set(token, refresh)
+	m.indexToken(refresh.Username, token)
+	family, _ := m.families.Get(refresh.Family)
+	m.families.Set(refresh.Family, appendCopy(family, token))
+	m.expireAt(refresh.ExpiresAt, expiryRefresh, token, refresh.Username)
+}
+
+func (m *MemoryStore) GetRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	refresh, exists := m.refreshTokens.Get(token)
+	if !exists {
+		return RefreshToken{}, ErrNotFound
+	}
+	return refresh, nil
+}
+
+func (m *MemoryStore) UseRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	refresh, exists := m.refreshTokens.Get(token)
+	if !exists {
+		return RefreshToken{}, ErrNotFound
+	}
+	used := refresh
+	used.Used = true
+	m.refreshTokens.Set(token, used)
+	return refresh, nil
+}
+
+func (m *MemoryStore) RenewSession(ctx context.Context, token string, refresh RefreshToken, accessExpiresAt, usedAt int64) error {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	session, exists := m.sessions.Get(refresh.Family)
+	if _, live := m.families.Get(refresh.Family); !exists || !live || session.Username != refresh.Username {
+		return ErrNotFound
+	}
+	m.saveToken(refresh.AccessToken, refresh.Username, accessExpiresAt)
+	m.saveRefreshToken(token, refresh)
+	session.ExpiresAt = refresh.ExpiresAt
+	session.LastUsedAt = usedAt
+	m.sessions.Set(session.ID, session)
+	m.expireAt(session.ExpiresAt, expirySession, session.ID, session.Username)
+	return nil
+}
+
+func (m *MemoryStore) DeleteRefreshFamily(ctx context.Context, family string) error {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	m.deleteRefreshFamily(family)
+	return nil
+}
+
+func (m *MemoryStore) SaveSession(ctx context.Context, session Session) error {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	if _, exists := m.sessions.Get(session.ID); !exists {
+		ids, _ := m.userSessions.Get(session.Username)
+		m.userSessions.Set(session.Username, appendCopy(ids, session.ID))
+	}
+	m.sessions.Set(session.ID, session)
+	m.expireAt(session.ExpiresAt, expirySession, session.ID, session.Username)
+	return nil
+}
+
+func (m *MemoryStore) GetSession(ctx context.Context, id string) (Session, error) {
+	session, exists := m.sessions.Get(id)
+	if !exists {
+		return Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+func (m *MemoryStore) ListSessions(ctx context.Context, username string) ([]Session, error) {
+	ids, _ := m.userSessions.Get(username)
+	sessions := make([]Session, 0, len(ids))
+	for _, id := range ids {
+		if session, exists := m.sessions.Get(id); exists {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *MemoryStore) TouchSession(ctx context.Context, id string, lastUsedAt int64) error {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	session, exists := m.sessions.Get(id)
+	if exists && session.LastUsedAt < lastUsedAt {
+		session.LastUsedAt = lastUsedAt
+		m.sessions.Set(id, session)
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteExpired(ctx context.Context, now int64) (SweepResult, error) {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+	var result SweepResult
+	for m.expiry.Len() > 0 && m.expiry[0].at < now {
+		entry := heap.Pop(&m.expiry).(expiryEntry)
+		switch entry.kind {
+		case expiryAccess:
+			if _, exists := m.tokens.Get(entry.key); exists {
+				m.deleteAccessToken(entry.key)
+				result.AccessTokens++
+			} else if m.isIndexed(entry.owner, entry.key) {
+				// the map already dropped it at its exp; a revoked token
+				// would have left the index too
+				m.unindexToken(entry.owner, entry.key)
+				result.AccessTokens++
+			}
+		case expiryRefresh:
+			refresh, exists := m.refreshTokens.Get(entry.key)
+			if exists && refresh.ExpiresAt < now {
+				m.deleteRefreshToken(entry.key, refresh)
+				result.RefreshTokens++
+			}
+		case expirySession:
+			// a renewed session has a later entry of its own
+			session, exists := m.sessions.Get(entry.key)
+			if exists && session.ExpiresAt < now {
+				m.deleteSession(entry.key)
+				result.Sessions++
+			}
+		}
+	}
+	return result, nil
+}
+
+// reindexRoles moves username in roleUsers from the roles in before to those
+// in after. Callers hold roleMu.
+func (m *MemoryStore) reindexRoles(username string, before, after []Role) {
+	for _, role := range before {
+		holders, _ := m.roleUsers.Get(role.Name)
+		if kept := without(holders, username); len(kept) > 0 {
+			m.roleUsers.Set(role.Name, kept)
+		} else {
+			m.roleUsers.Delete(role.Name)
+		}
+	}
+	for _, role := range after {
+		holders, _ := m.roleUsers.Get(role.Name)
+		if !slices.Contains(holders, username) {
+			m.roleUsers.Set(role.Name, appendCopy(holders, username))
+		}
+	}
+}
+
+// The helpers below keep the per-user index in step with the token maps.
+// Callers must hold tokenMu.
+
+func (m *MemoryStore) indexToken(username, token string) {
+	tokens, _ := m.userTokens.Get(username)
+	m.userTokens.Set(username, appendCopy(tokens, token))
+}
+
+func (m *MemoryStore) isIndexed(username, token string) bool {
+	tokens, _ := m.userTokens.Get(username)
+	return slices.Contains(tokens, token)
+}
+
+func (m *MemoryStore) unindexToken(username, token string) {
+	tokens, exists := m.userTokens.Get(username)
+	if !exists {
+		return
+	}
+	if kept := without(tokens, token); len(kept) > 0 {
+		m.userTokens.Set(username, kept)
+		return
+	}
+	m.userTokens.Delete(username)
+}
+
+func (m *MemoryStore) expireAt(at int64, kind expiryKind, key, owner string) {
+	if at > 0 {
+		heap.Push(&m.expiry, expiryEntry{at: at, kind: kind, key: key, owner: owner})
+	}
+}
+
+func (m *MemoryStore) deleteRefreshToken(token string, refresh RefreshToken) {
+	m.refreshTokens.Delete(token)
+	m.unindexToken(refresh.Username, token)
+
+	family, _ := m.families.Get(refresh.Family)
+	if kept := without(family, token); len(kept) > 0 {
+		m.families.Set(refresh.Family, kept)
+		return
+	}
+	m.families.Delete(refresh.Family)
+}
+
+func (m *MemoryStore) deleteAccessToken(token string) {
+	username, exists := m.tokens.Get(token)
+	if !exists {
+		return
+	}
+	m.tokens.Delete(token)
+	m.unindexToken(username, token)
+}
+
+func (m *MemoryStore) deleteRefreshFamily(family string) {
+	tokens, _ := m.families.Get(family)
+	for _, token := range tokens {
+		if refresh, exists := m.refreshTokens.Get(token); exists {
+			m.deleteAccessToken(refresh.AccessToken)
+			m.unindexToken(refresh.Username, token)
+		}
+		m.refreshTokens.Delete(token)
+	}
+	m.families.Delete(family)
+	m.deleteSession(family)
+}
+
+func (m *MemoryStore) deleteSession(id string) {
+	session, exists := m.sessions.Get(id)
+	if !exists {
+		return
+	}
+	m.sessions.Delete(id)
+	ids, _ := m.userSessions.Get(session.Username)
+	if kept := without(ids, id); len(kept) > 0 {
+		m.userSessions.Set(session.Username, kept)
+		return
+	}
+	m.userSessions.Delete(session.Username)
+}
+
+func (m *MemoryStore) deleteUserTokens(username string) {
+	tokens, _ := m.userTokens.Get(username)
+	for _, token := range tokens {
+		m.tokens.Delete(token)
+		if refresh, exists := m.refreshTokens.Get(token); exists {
+			m.families.Delete(refresh.Family)
+			m.refreshTokens.Delete(token)
+		}
+	}
+	m.userTokens.Delete(username)
+
+	ids, _ := m.userSessions.Get(username)
+	for _, id := range ids {
+		m.sessions.Delete(id)
+	}
+	m.userSessions.Delete(username)
+}
+
+// appendCopy appends to a fresh slice, since slices stored in the maps are
+// shared with readers and must never be modified in place
+func appendCopy(list []string, item string) []string {
+	return append(append([]string(nil), list...), item)
+}
+
+// without returns a fresh slice of list minus item
+func without(list []string, item string) []string {
+	kept := make([]string, 0, len(list))
+	for _, other := range list {
+		if other != item {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
+
+// cloneUser copies the role slice so callers never share backing arrays with the store
+func cloneUser(user User) User {
+	if user.Roles != nil {
+		user.Roles = append([]Role(nil), user.Roles...)
+	}
+	return user
+}
+
+// withRole returns roles with roleName appended, unless it is already among
+// them. Only the name is kept; permissions are looked up on the role itself.
+func withRole(roles []Role, roleName string) []Role {
+	for _, role := range roles {
+		if role.Name == roleName {
+			return roles
+		}
+	}
+	return append(roles, Role{Name: roleName})
+}
+
+// cloneRole does the same for a role's permissions and children
+func cloneRole(role Role) Role {
+	if role.Ability != nil {
+		role.Ability = append([]string(nil), role.Ability...)
+	}
+	if role.Children != nil {
+		role.Children = append([]string(nil), role.Children...)
+	}
+	return role
+}
@@ -0,0 +1,282 @@
+// auth/memory_store_test.go
+
+package auth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStoreUsers(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	err := store.CreateUser(ctx, User{Username: "storeUser", Password: "hash"})
+	assert.Nil(t, err, "Error should be nil")
+
+	err = store.CreateUser(ctx, User{Username: "storeUser", Password: "other"})
+	assert.Equal(t, ErrAlreadyExists, err, "Creating a duplicate user should fail")
+
+	user, err := store.GetUser(ctx, "storeUser")
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, "hash", user.Password, "Password should match what was stored")
+
+	// Mutating the returned copy must not leak into the store
+	user.Roles = append(user.Roles, Role{Name: "leaked"})
+	stored, _ := store.GetUser(ctx, "storeUser")
+	assert.Len(t, stored.Roles, 0, "Stored user should be unaffected by caller mutations")
+
+	err = store.UpdateUser(ctx, user)
+	assert.Nil(t, err, "Error should be nil")
+	stored, _ = store.GetUser(ctx, "storeUser")
+	assert.Len(t, stored.Roles, 1, "Update should be persisted")
+
+	err = store.UpdateUser(ctx, User{Username: "missing"})
+	assert.Equal(t, ErrNotFound, err, "Updating a missing user should fail")
+
+	assert.Nil(t, store.DeleteUser(ctx, "storeUser"), "Error should be nil")
+	_, err = store.GetUser(ctx, "storeUser")
+	assert.Equal(t, ErrNotFound, err, "User should be gone after deletion")
+}
+
+func TestMemoryStoreRolesAndTokens(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "storeRole"}), "Error should be nil")
+	assert.Equal(t, ErrAlreadyExists, store.CreateRole(ctx, Role{Name: "storeRole"}), "Duplicate role should fail")
+
+	role, err := store.GetRole(ctx, "storeRole")
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, "storeRole", role.Name, "Role name should match")
+
+	assert.Nil(t, store.DeleteRole(ctx, "storeRole", true), "Error should be nil")
+	_, err = store.GetRole(ctx, "storeRole")
+	assert.Equal(t, ErrNotFound, err, "Role should be gone after deletion")
+
+	assert.Nil(t, store.SaveToken(ctx, "tok", "storeUser", 0), "Error should be nil")
+	username, err := store.GetToken(ctx, "tok")
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, "storeUser", username, "Token should map to its user")
+
+	assert.Nil(t, store.DeleteToken(ctx, "tok"), "Error should be nil")
+	_, err = store.GetToken(ctx, "tok")
+	assert.Equal(t, ErrNotFound, err, "Token should be gone after deletion")
+}
+
+func TestMemoryStoreRefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	assert.Nil(t, store.SaveToken(ctx, "access1", "storeUser", 0))
+	assert.Nil(t, store.SaveRefreshToken(ctx, "refresh1", RefreshToken{Username: "storeUser", Family: "fam", AccessToken: "access1"}))
+	assert.Nil(t, store.SaveToken(ctx, "access2", "storeUser", 0))
+	assert.Nil(t, store.SaveRefreshToken(ctx, "refresh2", RefreshToken{Username: "storeUser", Family: "fam", AccessToken: "access2"}))
+
+	refresh, err := store.UseRefreshToken(ctx, "refresh1")
+	assert.Nil(t, err)
+	assert.False(t, refresh.Used, "The first use should see the token unused")
+	refresh, err = store.UseRefreshToken(ctx, "refresh1")
+	assert.Nil(t, err)
+	assert.True(t, refresh.Used, "Later uses should see the token used")
+
+	assert.Nil(t, store.DeleteRefreshFamily(ctx, "fam"))
+	_, err = store.UseRefreshToken(ctx, "refresh2")
+	assert.Equal(t, ErrNotFound, err, "Family members should be gone")
+	_, err = store.GetToken(ctx, "access1")
+	assert.Equal(t, ErrNotFound, err, "Access tokens of the family should be gone")
+	_, err = store.GetToken(ctx, "access2")
+	assert.Equal(t, ErrNotFound, err, "Access tokens of the family should be gone")
+}
+
+func TestMemoryStoreSessions(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	assert.Nil(t, store.SaveRefreshToken(ctx, "refresh1", RefreshToken{Username: "storeUser", Family: "fam1"}))
+	assert.Nil(t, store.SaveSession(ctx, Session{ID: "fam1", Username: "storeUser", LastUsedAt: 10}))
+	assert.Nil(t, store.SaveRefreshToken(ctx, "refresh2", RefreshToken{Username: "storeUser", Family: "fam2"}))
+	assert.Nil(t, store.SaveSession(ctx, Session{ID: "fam2", Username: "storeUser", LastUsedAt: 10}))
+
+	assert.Nil(t, store.TouchSession(ctx, "fam1", 20))
+	session, err := store.GetSession(ctx, "fam1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(20), session.LastUsedAt, "Touching should move LastUsedAt forward")
+
+	assert.Nil(t, store.DeleteRefreshFamily(ctx, "fam1"))
+	_, err = store.GetSession(ctx, "fam1")
+	assert.Equal(t, ErrNotFound, err, "The session should go with its family")
+	assert.Nil(t, store.TouchSession(ctx, "fam1", 30))
+	_, err = store.GetSession(ctx, "fam1")
+	assert.Equal(t, ErrNotFound, err, "Touching must not resurrect a removed session")
+
+	sessions, err := store.ListSessions(ctx, "storeUser")
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 1)
+
+	assert.Nil(t, store.DeleteUserTokens(ctx, "storeUser"))
+	sessions, _ = store.ListSessions(ctx, "storeUser")
+	assert.Len(t, sessions, 0, "Sessions should go with the user's tokens")
+}
+
+func TestMemoryStoreDeleteExpiredSkipsRevokedTokens(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	now := time.Now().Unix()
+	assert.Nil(t, store.SaveToken(ctx, "revoked", "storeUser", now+3600))
+	assert.Nil(t, store.DeleteToken(ctx, "revoked"))
+	assert.Nil(t, store.SaveToken(ctx, "live", "storeUser", now+3600))
+
+	// past both exps for the sweep, but not for the map's real clock
+	result, err := store.DeleteExpired(ctx, now+7200)
+	assert.Nil(t, err)
+	assert.Equal(t, SweepResult{AccessTokens: 1}, result, "A revoked token should not be counted as expired")
+}
+
+func TestMemoryStoreModifyUser(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	err := store.ModifyUser(ctx, "missing", func(user *User) error { return nil })
+	assert.Equal(t, ErrNotFound, err, "Modifying a missing user should fail")
+
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "storeUser", Password: "hash"}))
+	err = store.ModifyUser(ctx, "storeUser", func(user *User) error {
+		user.Roles = append(user.Roles, Role{Name: "discarded"})
+		return ErrAlreadyExists
+	})
+	assert.Equal(t, ErrAlreadyExists, err, "The callback's error should be returned")
+	stored, _ := store.GetUser(ctx, "storeUser")
+	assert.Len(t, stored.Roles, 0, "A failed callback should leave the user unchanged")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.ModifyUser(ctx, "storeUser", func(user *User) error {
+				user.Roles = append(user.Roles, Role{Name: "r"})
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	stored, _ = store.GetUser(ctx, "storeUser")
+	assert.Len(t, stored.Roles, 50, "No concurrent modification should be lost")
+}
+
+func TestMemoryStoreModifyUserRevokingTokens(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "storeUser", Password: "hash"}))
+	assert.Nil(t, store.SaveToken(ctx, "tok", "storeUser", 0))
+
+	err := store.ModifyUserRevokingTokens(ctx, "storeUser", func(user *User) error {
+		user.Password = "discarded"
+		return ErrInvalidCredentials
+	})
+	assert.Equal(t, ErrInvalidCredentials, err, "The callback's error should be returned")
+	_, err = store.GetToken(ctx, "tok")
+	assert.Nil(t, err, "A failed callback should leave the tokens live")
+
+	assert.Nil(t, store.ModifyUserRevokingTokens(ctx, "storeUser", func(user *User) error {
+		user.Password = "newhash"
+		return nil
+	}))
+	stored, _ := store.GetUser(ctx, "storeUser")
+	assert.Equal(t, "newhash", stored.Password)
+	_, err = store.GetToken(ctx, "tok")
+	assert.Equal(t, ErrNotFound, err, "The tokens should go with the change")
+}
+
+func TestMemoryStoreModifyRole(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	err := store.ModifyRole(ctx, "missing", func(role *Role) error { return nil })
+	assert.Equal(t, ErrNotFound, err, "Modifying a missing role should fail")
+
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "storeRole"}))
+	assert.Nil(t, store.ModifyRole(ctx, "storeRole", func(role *Role) error {
+		role.Ability = append(role.Ability, "orders:read")
+		return nil
+	}))
+	role, _ := store.GetRole(ctx, "storeRole")
+	assert.Equal(t, []string{"orders:read"}, role.Ability)
+
+	role.Ability[0] = "changed"
+	stored, _ := store.GetRole(ctx, "storeRole")
+	assert.Equal(t, []string{"orders:read"}, stored.Ability, "Callers should not share the stored permissions")
+}
+
+func TestMemoryStoreRoleUsers(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "bob", Roles: []Role{{Name: "r"}}}))
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "alice"}))
+	assert.Nil(t, store.ModifyUser(ctx, "alice", func(user *User) error {
+		user.Roles = append(user.Roles, Role{Name: "r"})
+		return nil
+	}))
+
+	usernames, _ := store.ListRoleUsers(ctx, "r")
+	assert.Equal(t, []string{"alice", "bob"}, usernames)
+
+	assert.Nil(t, store.UpdateUser(ctx, User{Username: "bob"}))
+	assert.Nil(t, store.DeleteUser(ctx, "carol"), "Deleting a missing user should not touch the index")
+	usernames, _ = store.ListRoleUsers(ctx, "r")
+	assert.Equal(t, []string{"alice"}, usernames, "Updates should keep the index in step")
+
+	assert.Equal(t, ErrInUse, store.DeleteRole(ctx, "r", false), "A held role should not be deleted without cascade")
+	alice, _ := store.GetUser(ctx, "alice")
+	assert.Equal(t, []Role{{Name: "r"}}, alice.Roles, "A refused delete should leave the holders alone")
+	assert.Nil(t, store.DeleteRole(ctx, "r", true))
+	alice, _ = store.GetUser(ctx, "alice")
+	assert.Empty(t, alice.Roles, "Deleting a role should take it away from its holders")
+	usernames, _ = store.ListRoleUsers(ctx, "r")
+	assert.Empty(t, usernames)
+}
+
+func TestMemoryStoreAddUserRole(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "alice"}))
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "r"}))
+
+	assert.Nil(t, store.AddUserRole(ctx, "alice", "r"))
+	assert.Nil(t, store.AddUserRole(ctx, "alice", "r"), "Assigning a held role again should do nothing")
+	alice, _ := store.GetUser(ctx, "alice")
+	assert.Equal(t, []Role{{Name: "r"}}, alice.Roles)
+	usernames, _ := store.ListRoleUsers(ctx, "r")
+	assert.Equal(t, []string{"alice"}, usernames)
+
+	assert.Equal(t, ErrNotFound, store.AddUserRole(ctx, "alice", "missing"), "A missing role should not be assigned")
+	assert.Equal(t, ErrNotFound, store.AddUserRole(ctx, "bob", "r"))
+	alice, _ = store.GetUser(ctx, "alice")
+	assert.Equal(t, []Role{{Name: "r"}}, alice.Roles)
+}
+
+func TestMemoryStoreTokenExpiresAtExp(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	past := time.Now().Add(-time.Second).Unix()
+	assert.Nil(t, m.SaveToken(ctx, "expired", "alice", past))
+	assert.Nil(t, m.SaveToken(ctx, "live", "alice", time.Now().Add(time.Hour).Unix()))
+
+	_, err := m.GetToken(ctx, "expired")
+	assert.Equal(t, ErrNotFound, err, "A token should be gone once its exp has passed")
+	_, err = m.GetToken(ctx, "live")
+	assert.Nil(t, err)
+
+	// the sweep still clears the user's index for the token the map dropped,
+	// and counts it
+	result, err := m.DeleteExpired(ctx, time.Now().Unix())
+	assert.Nil(t, err)
+	assert.Equal(t, SweepResult{AccessTokens: 1}, result, "A token the map evicted should still be counted")
+	indexed, _ := m.userTokens.Get("alice")
+	assert.Equal(t, []string{"live"}, indexed)
+}
@@ -0,0 +1,164 @@
+// auth/middleware/middleware.go
+
+// Package middleware lets other Go services accept the access tokens issued
+// by the auth service. Wrap handlers with an Authenticator's RequireAuth,
+// RequireRole or RequirePermission; the handlers then find the caller with
+// PrincipalFromContext.
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gogorush/simple_auth/auth"
+)
+
+var (
+	errMissingToken      = errors.New("missing access token")
+	errInsufficientScope = errors.New("insufficient scope")
+	// errUnavailable wraps failures to reach the auth service or its key set
+	errUnavailable = errors.New("auth service unavailable")
+)
+
+// Principal is the caller a request was authenticated as
+type Principal struct {
+	Username  string
+	TokenID   string
+	ExpiresAt time.Time
+	// Roles and Permissions are the effective ones, inherited roles
+	// included. Tokens do not carry them, so they are only filled in by
+	// validators that ask the auth service, such as IntrospectionValidator.
+	Roles       []string
+	Permissions []string
+}
+
+// HasRole reports whether the principal holds roleName
+func (p *Principal) HasRole(roleName string) bool {
+	return slices.Contains(p.Roles, roleName)
+}
+
+// HasPermission reports whether one of the principal's roles grants permission
+func (p *Principal) HasPermission(permission string) bool {
+	return slices.Contains(p.Permissions, permission)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying principal, as RequireAuth
+// does; tests of downstream handlers can use it to fake a caller
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the caller authenticated by RequireAuth
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok && principal != nil
+}
+
+// Validator checks an access token and describes its holder. Invalid tokens
+// are reported with auth.ErrInvalidToken or auth.ErrTokenExpired.
+type Validator interface {
+	Validate(ctx context.Context, token string) (*Principal, error)
+}
+
+// Authenticator guards handlers with the tokens a Validator accepts
+type Authenticator struct {
+	validator Validator
+}
+
+// New returns an Authenticator validating tokens with validator
+func New(validator Validator) *Authenticator {
+	return &Authenticator{validator: validator}
+}
+
+// RequireAuth only lets requests with a valid access token through to next,
+// with their Principal in the request context. The token is read like the
+// auth service reads it: from the Authorization Bearer header, or else, for
+// GET and HEAD requests only, from the auth.TokenCookieName cookie.
+func (a *Authenticator) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// an outer wrapper has done the work already
+		if _, ok := PrincipalFromContext(r.Context()); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := auth.AccessToken(r)
+		if !ok {
+			fail(w, "", errMissingToken)
+			return
+		}
+		principal, err := a.validator.Validate(r.Context(), token)
+		if err != nil {
+			fail(w, "invalid_token", err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// RequireRole returns a wrapper like RequireAuth that also requires the
+// caller to hold roleName, directly or through the role hierarchy. It needs
+// a Validator that fills in roles; with any other every request is refused.
+func (a *Authenticator) RequireRole(roleName string) func(http.Handler) http.Handler {
+	return a.require(func(p *Principal) bool { return p.HasRole(roleName) }, "role "+roleName+" required")
+}
+
+// RequirePermission returns a wrapper like RequireAuth that also requires
+// one of the caller's roles to grant permission. Like RequireRole it needs a
+// Validator that fills in permissions.
+func (a *Authenticator) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return a.require(func(p *Principal) bool { return p.HasPermission(permission) }, "permission "+permission+" required")
+}
+
+func (a *Authenticator) require(allowed func(*Principal) bool, detail string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return a.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, _ := PrincipalFromContext(r.Context())
+			if !allowed(principal) {
+				fail(w, "insufficient_scope", fmt.Errorf("%w: %s", errInsufficientScope, detail))
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// fail answers like the auth service does: an RFC 7807 problem, with an
+// RFC 6750 challenge when the token is missing, invalid or not enough
+func fail(w http.ResponseWriter, errorCode string, err error) {
+	var problem auth.Problem
+	switch {
+	case errors.Is(err, errMissingToken):
+		problem = newProblem(http.StatusUnauthorized, "missing_token", err)
+	case errors.Is(err, errInsufficientScope):
+		problem = newProblem(http.StatusForbidden, "insufficient_scope", err)
+	case errors.Is(err, errUnavailable):
+		problem = newProblem(http.StatusServiceUnavailable, "auth_unavailable", errUnavailable)
+	default:
+		problem = auth.ProblemFor(err)
+	}
+
+	if problem.Status == http.StatusUnauthorized || problem.Status == http.StatusForbidden {
+		w.Header().Set("WWW-Authenticate", auth.BearerChallenge("", errorCode, problem.Detail))
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+func newProblem(status int, code string, err error) auth.Problem {
+	return auth.Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: err.Error(),
+		Code:   code,
+	}
+}
@@ -0,0 +1,270 @@
+// auth/middleware/middleware_test.go
+
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogorush/simple_auth/auth"
+	"github.com/gogorush/simple_auth/auth/authtest"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// setupServer runs the auth service behind a test server, with an RS256 key
+// so its key set can be published, and an introspection client
+func setupServer(t *testing.T) (*auth.InMemoryAuthService, *httptest.Server) {
+	key, err := auth.GenerateSigningKey("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := authtest.NewService(t, auth.WithKeyRing(auth.NewKeyRing(key)))
+	service.AddIntrospectionClient("orders", "orders-secret")
+	server := authtest.NewServer(t, service)
+
+	service.CreateUser("reader", "readerpass")
+	service.CreateUser("nobody", "nobodypass")
+	service.CreateRole("viewer")
+	service.CreateRole("editor")
+	service.GrantPermission("viewer", "orders:read")
+	service.AddChildRole("editor", "viewer")
+	service.AddRoleToUser("reader", "editor")
+	return service, server
+}
+
+// whoami answers with the authenticated username
+var whoami = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	principal, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		http.Error(w, "no principal", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(principal.Username))
+})
+
+func serve(handler http.Handler, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/orders", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func problemCode(t *testing.T, rr *httptest.ResponseRecorder) string {
+	var problem auth.Problem
+	if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+		t.Fatalf("decoding problem: %v", err)
+	}
+	return problem.Code
+}
+
+func TestRequireAuthLocal(t *testing.T) {
+	service, server := setupServer(t)
+	reader, _ := service.Authenticate("reader", "readerpass")
+
+	// a token past its exp, signed with the service's own key
+	expired, err := service.Keys().Sign(jwt.MapClaims{"user": "reader", "exp": time.Now().Add(-time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validators := map[string]Validator{
+		"key ring": NewKeyValidator(service.Keys()),
+		"jwks":     NewJWKSValidator(server.URL+"/.well-known/jwks.json", server.Client()),
+	}
+	for name, validator := range validators {
+		handler := New(validator).RequireAuth(whoami)
+
+		rr := serve(handler, reader.Token)
+		if rr.Code != http.StatusOK || rr.Body.String() != "reader" {
+			t.Errorf("%s: valid token got %v: %s", name, rr.Code, rr.Body.String())
+		}
+
+		rr = serve(handler, "")
+		if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: missing token got %v with challenge %q", name, rr.Code, rr.Header().Get("WWW-Authenticate"))
+		}
+		if code := problemCode(t, rr); code != "missing_token" {
+			t.Errorf("%s: missing token got code %q", name, code)
+		}
+
+		rr = serve(handler, "not-a-token")
+		if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Header().Get("WWW-Authenticate"), `error="invalid_token"`) {
+			t.Errorf("%s: invalid token got %v with challenge %q", name, rr.Code, rr.Header().Get("WWW-Authenticate"))
+		}
+
+		rr = serve(handler, expired)
+		if code := problemCode(t, rr); rr.Code != http.StatusUnauthorized || code != "token_expired" {
+			t.Errorf("%s: expired token got %v with code %q", name, rr.Code, code)
+		}
+
+		// local validation knows nothing of roles, so it must refuse rather than guess
+		rr = serve(New(validator).RequireRole("viewer")(whoami), reader.Token)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s: role check without roles got %v", name, rr.Code)
+		}
+	}
+}
+
+func TestJWKSValidatorFollowsRotation(t *testing.T) {
+	defer func(interval time.Duration) { jwksMinRefresh = interval }(jwksMinRefresh)
+	jwksMinRefresh = 0
+
+	service, server := setupServer(t)
+	handler := New(NewJWKSValidator(server.URL+"/.well-known/jwks.json", server.Client())).RequireAuth(whoami)
+
+	before, _ := service.Authenticate("reader", "readerpass")
+	if rr := serve(handler, before.Token); rr.Code != http.StatusOK {
+		t.Fatalf("token signed before rotation got %v", rr.Code)
+	}
+	if _, err := service.RotateSigningKey(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := service.Authenticate("reader", "readerpass")
+	if rr := serve(handler, after.Token); rr.Code != http.StatusOK {
+		t.Errorf("token signed with the new key got %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestJWKSValidatorSharesFetches(t *testing.T) {
+	defer func(interval time.Duration) { jwksMinRefresh = interval }(jwksMinRefresh)
+	jwksMinRefresh = 0
+
+	service, server := setupServer(t)
+	// serves the service's key set, holding each fetch until released
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		resp, err := server.Client().Get(server.URL + "/.well-known/jwks.json")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	}))
+	defer jwks.Close()
+	handler := New(NewJWKSValidator(jwks.URL, jwks.Client())).RequireAuth(whoami)
+	tokens, _ := service.Authenticate("reader", "readerpass")
+
+	var wg sync.WaitGroup
+	results := make([]int, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = serve(handler, tokens.Token).Code
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for i, code := range results {
+		if code != http.StatusOK {
+			t.Errorf("request %d got %v", i, code)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("expected concurrent requests to share one fetch but got %d", n)
+	}
+
+	// a token naming an unknown key starts a fetch, which must not hold up
+	// tokens the keys already verify
+	release = make(chan struct{})
+	defer close(release)
+	key, _ := auth.GenerateSigningKey("RS256")
+	unknown, _ := auth.NewKeyRing(key).Sign(jwt.MapClaims{"user": "reader", "exp": time.Now().Add(time.Minute).Unix()})
+	go serve(handler, unknown)
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan int)
+	go func() { done <- serve(handler, tokens.Token).Code }()
+	select {
+	case code := <-done:
+		if code != http.StatusOK {
+			t.Errorf("known key got %v during a fetch", code)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("known key waited for the fetch")
+	}
+}
+
+func TestJWKSValidatorUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	handler := New(NewJWKSValidator(server.URL, server.Client())).RequireAuth(whoami)
+	token, _ := auth.NewKeyRing(auth.NewHMACKey([]byte("secret"))).Sign(jwt.MapClaims{"user": "reader", "exp": time.Now().Add(time.Minute).Unix()})
+	rr := serve(handler, token)
+	if code := problemCode(t, rr); rr.Code != http.StatusServiceUnavailable || code != "auth_unavailable" {
+		t.Errorf("got %v with code %q", rr.Code, code)
+	}
+}
+
+func TestRequireRoleAndPermissionIntrospection(t *testing.T) {
+	service, server := setupServer(t)
+	reader, _ := service.Authenticate("reader", "readerpass")
+	nobody, _ := service.Authenticate("nobody", "nobodypass")
+
+	authenticator := New(NewIntrospectionValidator(server.URL+"/v1/introspect", "orders", "orders-secret", server.Client()))
+	cases := []struct {
+		name    string
+		handler http.Handler
+		token   string
+		want    int
+	}{
+		{"inherited role", authenticator.RequireRole("viewer")(whoami), reader.Token, http.StatusOK},
+		{"direct role", authenticator.RequireRole("editor")(whoami), reader.Token, http.StatusOK},
+		{"missing role", authenticator.RequireRole("editor")(whoami), nobody.Token, http.StatusForbidden},
+		{"inherited permission", authenticator.RequirePermission("orders:read")(whoami), reader.Token, http.StatusOK},
+		{"missing permission", authenticator.RequirePermission("orders:write")(whoami), reader.Token, http.StatusForbidden},
+		{"refresh token", authenticator.RequireAuth(whoami), reader.RefreshToken, http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		rr := serve(tc.handler, tc.token)
+		if rr.Code != tc.want {
+			t.Errorf("%s: got %v want %v: %s", tc.name, rr.Code, tc.want, rr.Body.String())
+		}
+		if rr.Code == http.StatusForbidden && !strings.Contains(rr.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`) {
+			t.Errorf("%s: got challenge %q", tc.name, rr.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// introspection sees revocation at once
+	service.InvalidateToken(reader.Token)
+	if rr := serve(authenticator.RequireAuth(whoami), reader.Token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token got %v", rr.Code)
+	}
+
+	bad := New(NewIntrospectionValidator(server.URL+"/v1/introspect", "orders", "wrong", server.Client()))
+	if rr := serve(bad.RequireAuth(whoami), nobody.Token); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("misconfigured client got %v", rr.Code)
+	}
+}
+
+func TestPrincipalFromContext(t *testing.T) {
+	req := httptest.NewRequest("GET", "/orders", nil)
+	if _, ok := PrincipalFromContext(req.Context()); ok {
+		t.Errorf("expected no principal in a fresh context")
+	}
+
+	// a principal put in place upstream is trusted without a token
+	ctx := WithPrincipal(req.Context(), &Principal{Username: "reader", Roles: []string{"viewer"}})
+	rr := httptest.NewRecorder()
+	New(NewSecretValidator([]byte("secret"))).RequireRole("viewer")(whoami).ServeHTTP(rr, req.WithContext(ctx))
+	if rr.Code != http.StatusOK || rr.Body.String() != "reader" {
+		t.Errorf("got %v: %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,275 @@
+// auth/middleware/validators.go
+
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogorush/simple_auth/auth"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// defaultClient is used by the validators given a nil *http.Client
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// KeyValidator validates tokens locally, by their signature and expiry
+// alone. It cannot see tokens revoked before they expire, nor the caller's
+// roles and permissions; use IntrospectionValidator where those matter.
+type KeyValidator struct {
+	keyfunc jwt.Keyfunc
+}
+
+// NewKeyValidator verifies tokens with the keys of keys
+func NewKeyValidator(keys *auth.KeyRing) *KeyValidator {
+	return &KeyValidator{keyfunc: keys.Keyfunc}
+}
+
+// NewSecretValidator verifies tokens signed with the auth service's shared
+// HS256 secret, SIMPLE_AUTH_JWT_SECRET
+func NewSecretValidator(secret []byte) *KeyValidator {
+	return NewKeyValidator(auth.NewKeyRing(auth.NewHMACKey(secret)))
+}
+
+// Validate implements Validator
+func (v *KeyValidator) Validate(ctx context.Context, token string) (*Principal, error) {
+	return parseToken(token, v.keyfunc)
+}
+
+// parseToken verifies a token with keyfunc and reads its principal
+func parseToken(tokenString string, keyfunc jwt.Keyfunc) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, keyfunc)
+	if errors.Is(err, errUnavailable) {
+		return nil, err
+	}
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, auth.ErrTokenExpired
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", auth.ErrInvalidToken, err)
+	}
+
+	username, _ := claims["user"].(string)
+	exp, ok := claims["exp"].(float64)
+	// the service always sets both; a token without them is not one of its own
+	if username == "" || !ok {
+		return nil, auth.ErrInvalidToken
+	}
+	tokenID, _ := claims["jti"].(string)
+	return &Principal{
+		Username:  username,
+		TokenID:   tokenID,
+		ExpiresAt: time.Unix(int64(exp), 0),
+	}, nil
+}
+
+// jwksRefreshInterval is how long fetched keys are trusted, matching the
+// max-age the auth service serves its key set with. A token naming an
+// unknown key triggers an earlier fetch; fetches are at least jwksMinRefresh
+// apart.
+var (
+	jwksRefreshInterval = 5 * time.Minute
+	jwksMinRefresh      = 10 * time.Second
+)
+
+// JWKSValidator validates tokens locally like KeyValidator, with the public
+// keys the auth service publishes at /.well-known/jwks.json. Keys are fetched
+// on first use and refreshed periodically, so rotations are picked up.
+type JWKSValidator struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      *auth.KeyRing
+	fetchedAt time.Time     // of keys
+	triedAt   time.Time     // of the last fetch, successful or not
+	fetchErr  error         // of the last fetch
+	fetching  chan struct{} // closed when the fetch in flight ends; nil without one
+}
+
+// NewJWKSValidator fetches keys from jwksURL, e.g.
+// https://auth.example.com/.well-known/jwks.json. A nil client uses one with
+// a ten second timeout.
+func NewJWKSValidator(jwksURL string, client *http.Client) *JWKSValidator {
+	if client == nil {
+		client = defaultClient
+	}
+	return &JWKSValidator{url: jwksURL, client: client}
+}
+
+// Validate implements Validator
+func (v *JWKSValidator) Validate(ctx context.Context, token string) (*Principal, error) {
+	return parseToken(token, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+		keys, err := v.keyRing(ctx, keyID)
+		if err != nil {
+			return nil, err
+		}
+		return keys.Keyfunc(token)
+	})
+}
+
+// keyRing returns the fetched keys, fetching them again when they are stale
+// or lack keyID. Concurrent callers share a single fetch, which runs without
+// v.mu held so that callers with usable keys are not held up by it.
+func (v *JWKSValidator) keyRing(ctx context.Context, keyID string) (*auth.KeyRing, error) {
+	v.mu.Lock()
+	stale := v.keys == nil || time.Since(v.fetchedAt) > jwksRefreshInterval
+	if !stale && keyID != "" {
+		_, known := v.keys.Lookup(keyID)
+		stale = !known
+	}
+	if !stale {
+		defer v.mu.Unlock()
+		return v.keys, nil
+	}
+	if v.fetching == nil {
+		// tried a moment ago: don't let tokens with made-up key ids, or a
+		// service that is down, cost a fetch each
+		if time.Since(v.triedAt) < jwksMinRefresh {
+			defer v.mu.Unlock()
+			return v.current()
+		}
+		v.triedAt = time.Now()
+		v.fetching = make(chan struct{})
+		// the fetch outlives a caller that gives up, as others may wait on it
+		go v.refresh(context.WithoutCancel(ctx), v.fetching, v.triedAt)
+	}
+	fetching := v.fetching
+	v.mu.Unlock()
+
+	select {
+	case <-fetching:
+	case <-ctx.Done():
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.current()
+}
+
+// refresh fetches the key set and swaps it in, then closes done
+func (v *JWKSValidator) refresh(ctx context.Context, done chan struct{}, triedAt time.Time) {
+	keys, err := v.fetch(ctx)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err == nil {
+		v.keys = keys
+		v.fetchedAt = triedAt
+	}
+	v.fetchErr = err
+	v.fetching = nil
+	close(done)
+}
+
+// current returns the keys we have, which keep verifying tokens while the
+// service is down. Callers hold v.mu.
+func (v *JWKSValidator) current() (*auth.KeyRing, error) {
+	if v.keys != nil {
+		return v.keys, nil
+	}
+	if v.fetchErr != nil {
+		return nil, fmt.Errorf("%w: %v", errUnavailable, v.fetchErr)
+	}
+	return nil, fmt.Errorf("%w: key set not fetched", errUnavailable)
+}
+
+func (v *JWKSValidator) fetch(ctx context.Context) (*auth.KeyRing, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching key set: %s", resp.Status)
+	}
+	var set auth.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	var keys *auth.KeyRing
+	for _, jwk := range set.Keys {
+		key, err := auth.ParseJSONWebKey(jwk)
+		if err != nil {
+			continue // a key of a kind we don't know can't have signed a token we accept
+		}
+		if keys == nil {
+			keys = auth.NewKeyRing(key)
+		} else if err := keys.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	if keys == nil {
+		return nil, errors.New("key set has no usable keys")
+	}
+	return keys, nil
+}
+
+// IntrospectionValidator asks the auth service about every token with RFC
+// 7662 introspection. Unlike local validation it sees revoked tokens at once,
+// and fills in the caller's roles and permissions.
+type IntrospectionValidator struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+}
+
+// NewIntrospectionValidator calls endpoint, e.g.
+// https://auth.example.com/v1/introspect, with credentials registered in the
+// auth service's SIMPLE_AUTH_INTROSPECTION_CLIENTS. A nil client uses one
+// with a ten second timeout.
+func NewIntrospectionValidator(endpoint, clientID, clientSecret string, client *http.Client) *IntrospectionValidator {
+	if client == nil {
+		client = defaultClient
+	}
+	return &IntrospectionValidator{endpoint: endpoint, clientID: clientID, clientSecret: clientSecret, client: client}
+}
+
+// Validate implements Validator
+func (v *IntrospectionValidator) Validate(ctx context.Context, token string) (*Principal, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(v.clientID, v.clientSecret)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: introspection answered %s", errUnavailable, resp.Status)
+	}
+	var result auth.TokenIntrospection
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnavailable, err)
+	}
+
+	// a refresh token is active too, but must never pass as an access token
+	if !result.Active || result.TokenType != "access_token" {
+		return nil, auth.ErrInvalidToken
+	}
+	return &Principal{
+		Username:    result.Username,
+		TokenID:     result.TokenID,
+		ExpiresAt:   time.Unix(result.ExpiresAt, 0),
+		Roles:       result.Roles,
+		Permissions: result.Permissions,
+	}, nil
+}
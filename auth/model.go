@@ -2,8 +2,6 @@
 
 package auth
 
-import "github.com/gogorush/simple_auth/utils"
-
 type User struct {
 	Username string
 	Password string
@@ -11,18 +9,59 @@ type User struct {
 }
 
 type Role struct {
-	Name    string
-	//Ability []string
+	Name     string
+	Ability  []string // permissions granted to holders of the role, e.g. "orders:read"
+	Children []string // names of the roles included in this one, e.g. editor in admin
 	//Status  bool
 }
 
 type TokenDetails struct {
-	Token     string
-	ExpiresAt int64
+	Token            string
+	ExpiresAt        int64
+	RefreshToken     string
+	RefreshExpiresAt int64
+}
+
+// Session is one login of a user. Its ID is the family shared by the refresh
+// tokens descending from that login, and by the sid claim of its access tokens.
+type Session struct {
+	ID         string
+	Username   string
+	ClientIP   string
+	UserAgent  string
+	IssuedAt   int64
+	ExpiresAt  int64 // when the current refresh token expires
+	LastUsedAt int64
+}
+
+// ClientInfo describes where a login came from
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+// TokenIntrospection describes a token in the shape of an RFC 7662
+// introspection response. Inactive tokens carry no other fields.
+type TokenIntrospection struct {
+	Active      bool     `json:"active"`
+	TokenType   string   `json:"token_type,omitempty"` // "access_token" or "refresh_token"
+	Subject     string   `json:"sub,omitempty"`
+	Username    string   `json:"username,omitempty"`
+	Scope       string   `json:"scope,omitempty"` // space-separated role names
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"` // granted by the roles, sorted
+	ExpiresAt   int64    `json:"exp,omitempty"`
+	IssuedAt    int64    `json:"iat,omitempty"`
+	TokenID     string   `json:"jti,omitempty"`
 }
 
-var (
-	Users  = utils.NewConcurrentMap()
-	Roles  = utils.NewConcurrentMap()
-	Tokens = utils.NewConcurrentMap()
-)
+// RefreshToken is the server-side record of an opaque refresh token. Every
+// refresh token descends from one login; together they form a family that is
+// revoked as a whole when a rotated-out token is presented again.
+type RefreshToken struct {
+	Username    string
+	Family      string
+	AccessToken string // access token issued alongside; stores may keep only a digest
+	ExpiresAt   int64
+	Used        bool // set once the token has been exchanged for a new pair
+}
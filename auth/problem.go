@@ -0,0 +1,126 @@
+// auth/problem.go
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// Errors only the HTTP layer produces
+var (
+	errMalformedBody    = errors.New("malformed request body")
+	errMissingParams    = errors.New("missing parameters")
+	errMissingToken     = errors.New("missing access token")
+	errNotAdmin         = errors.New("admin permission required")
+	errInvalidClient    = errors.New("invalid client")
+	errMethodNotAllowed = errors.New("method not allowed")
+	errNotSupported     = errors.New("not supported by this service")
+)
+
+// Problem is the RFC 7807 body of every error response. Code identifies the
+// error for programs and stays stable; Detail is meant for people.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+}
+
+// Error makes a Problem received from the API usable as an error
+func (p Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
+}
+
+// Unwrap returns the error Code stands for, so that errors.Is matches a
+// received Problem against the package's errors like the original error
+func (p Problem) Unwrap() error {
+	for _, entry := range errorStatuses {
+		if entry.code == p.Code {
+			return entry.err
+		}
+	}
+	return nil
+}
+
+// errorStatuses maps errors to their status and problem code. Entries are
+// matched with errors.Is in order, so wrapped errors map like their cause.
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{ErrUserExists, http.StatusConflict, "user_exists"},
+	{ErrUserNotFound, http.StatusNotFound, "user_not_found"},
+	{ErrInvalidCredentials, http.StatusUnauthorized, "invalid_credentials"},
+	{ErrRoleExists, http.StatusConflict, "role_exists"},
+	{ErrRoleNotFound, http.StatusNotFound, "role_not_found"},
+	{ErrRoleInUse, http.StatusConflict, "role_in_use"},
+	{ErrRoleCycle, http.StatusConflict, "role_cycle"},
+	{ErrInvalidPermission, http.StatusBadRequest, "invalid_permission"},
+	{ErrInvalidToken, http.StatusUnauthorized, "invalid_token"},
+	{ErrTokenExpired, http.StatusUnauthorized, "token_expired"},
+	{ErrInvalidRefreshToken, http.StatusUnauthorized, "invalid_refresh_token"},
+	{ErrRefreshTokenReused, http.StatusUnauthorized, "refresh_token_reused"},
+	{ErrRefreshTokenExpired, http.StatusUnauthorized, "refresh_token_expired"},
+	{ErrSessionNotFound, http.StatusNotFound, "session_not_found"},
+	{ErrKeyExists, http.StatusConflict, "key_exists"},
+	{ErrKeyNotFound, http.StatusNotFound, "key_not_found"},
+	{ErrKeyActive, http.StatusConflict, "key_active"},
+	{ErrNotFound, http.StatusNotFound, "not_found"},
+	{ErrAlreadyExists, http.StatusConflict, "already_exists"},
+	{ErrInUse, http.StatusConflict, "in_use"},
+	{errMalformedBody, http.StatusBadRequest, "malformed_request"},
+	{errMissingParams, http.StatusBadRequest, "missing_parameters"},
+	{errMissingToken, http.StatusUnauthorized, "missing_token"},
+	{errNotAdmin, http.StatusForbidden, "insufficient_scope"},
+	{errInvalidClient, http.StatusUnauthorized, "invalid_client"},
+	{errMethodNotAllowed, http.StatusMethodNotAllowed, "method_not_allowed"},
+	{errNotSupported, http.StatusNotImplemented, "not_supported"},
+}
+
+// ProblemFor describes err as a Problem. Errors the package does not know,
+// such as a failing store, become a 500 whose detail is not disclosed.
+func ProblemFor(err error) Problem {
+	for _, entry := range errorStatuses {
+		if errors.Is(err, entry.err) {
+			return Problem{
+				Type:   "about:blank",
+				Title:  http.StatusText(entry.status),
+				Status: entry.status,
+				Detail: err.Error(),
+				Code:   entry.code,
+			}
+		}
+	}
+	return Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(http.StatusInternalServerError),
+		Status: http.StatusInternalServerError,
+		Code:   "internal_error",
+	}
+}
+
+// writeError fails the request with the problem describing err
+func writeError(w http.ResponseWriter, err error) {
+	problem := ProblemFor(err)
+	if problem.Status == http.StatusInternalServerError {
+		log.Printf("auth: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// isTokenError reports whether err is about the access token the caller
+// presented, and so calls for a Bearer challenge
+func isTokenError(err error) bool {
+	return errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrTokenExpired)
+}
@@ -0,0 +1,89 @@
+// auth/routes.go
+
+package auth
+
+import "net/http"
+
+// RegisterRoutes registers the versioned /v1 API on mux, along with the
+// unversioned paths of the original API as compatibility aliases.
+//
+// /v1 routes are resource oriented and bound to a method; any other method
+// is answered with 405 and an Allow header. Parameters named in the path
+// take the place of the matching JSON body fields.
+func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /v1/users", h.RequireAdmin(h.HandleCreateUser))
+	mux.HandleFunc("DELETE /v1/users/{username}", h.RequireAdmin(h.HandleDeleteUser))
+	mux.HandleFunc("PUT /v1/users/{username}/password", h.HandleChangePassword)
+	mux.HandleFunc("DELETE /v1/users/{username}/tokens", h.RequireAdmin(h.HandleRevokeUserTokens))
+	mux.HandleFunc("GET /v1/users/{username}/sessions", h.RequireAdmin(h.HandleListSessions))
+	mux.HandleFunc("DELETE /v1/users/{username}/sessions/{sessionId}", h.RequireAdmin(h.HandleRevokeSession))
+	mux.HandleFunc("PUT /v1/users/{username}/roles/{roleName}", h.RequireAdmin(h.HandleAddRoleToUser))
+	mux.HandleFunc("DELETE /v1/users/{username}/roles/{roleName}", h.RequireAdmin(h.HandleRemoveRoleFromUser))
+
+	mux.HandleFunc("POST /v1/roles", h.RequireAdmin(h.HandleCreateRole))
+	mux.HandleFunc("DELETE /v1/roles/{roleName}", h.RequireAdmin(h.HandleDeleteRole))
+	mux.HandleFunc("GET /v1/roles/{roleName}/users", h.RequireAdmin(h.HandleGetRoleUsers))
+	mux.HandleFunc("PUT /v1/roles/{roleName}/children/{childRoleName}", h.RequireAdmin(h.HandleAddChildRole))
+	mux.HandleFunc("DELETE /v1/roles/{roleName}/children/{childRoleName}", h.RequireAdmin(h.HandleRemoveChildRole))
+	mux.HandleFunc("PUT /v1/roles/{roleName}/permissions/{permission}", h.RequireAdmin(h.HandleGrantPermission))
+	mux.HandleFunc("DELETE /v1/roles/{roleName}/permissions/{permission}", h.RequireAdmin(h.HandleRevokePermission))
+
+	mux.HandleFunc("POST /v1/tokens", h.HandleAuthenticate)
+	mux.HandleFunc("POST /v1/tokens/refresh", h.HandleRefreshToken)
+	mux.HandleFunc("DELETE /v1/tokens/current", h.HandleInvalidateToken)
+
+	// the caller, as identified by the bearer token
+	mux.HandleFunc("GET /v1/me", h.HandleGetMe)
+	mux.HandleFunc("GET /v1/me/roles", h.HandleGetAllRoles)
+	mux.HandleFunc("GET /v1/me/roles/{roleName}", h.HandleCheckRole)
+	mux.HandleFunc("GET /v1/me/direct-roles", h.HandleGetDirectRoles)
+	mux.HandleFunc("GET /v1/me/permissions/{permission}", h.HandleCheckPermission)
+
+	mux.HandleFunc("POST /v1/signing-keys", h.RequireAdmin(h.HandleRotateSigningKey))
+	mux.HandleFunc("DELETE /v1/signing-keys/{keyId}", h.RequireAdmin(h.HandleRetireSigningKey))
+	mux.HandleFunc("POST /v1/introspect", h.HandleIntrospect)
+
+	// well-known locations are not versioned
+	mux.HandleFunc("GET /.well-known/jwks.json", h.HandleJWKS)
+
+	mux.HandleFunc("/create-user", legacy(h.RequireAdmin(h.HandleCreateUser)))
+	mux.HandleFunc("/delete-user", legacy(h.RequireAdmin(h.HandleDeleteUser)))
+	mux.HandleFunc("/change-password", legacy(h.HandleChangePassword))
+	mux.HandleFunc("/revoke-user-tokens", legacy(h.RequireAdmin(h.HandleRevokeUserTokens)))
+	mux.HandleFunc("/list-sessions", legacy(h.RequireAdmin(h.HandleListSessions)))
+	mux.HandleFunc("/revoke-session", legacy(h.RequireAdmin(h.HandleRevokeSession)))
+	mux.HandleFunc("/create-role", legacy(h.RequireAdmin(h.HandleCreateRole)))
+	mux.HandleFunc("/delete-role", legacy(h.RequireAdmin(h.HandleDeleteRole)))
+	mux.HandleFunc("/get-role-users", legacy(h.RequireAdmin(h.HandleGetRoleUsers)))
+	mux.HandleFunc("/add-role-to-user", legacy(h.RequireAdmin(h.HandleAddRoleToUser)))
+	mux.HandleFunc("/remove-role-from-user", legacy(h.RequireAdmin(h.HandleRemoveRoleFromUser)))
+	mux.HandleFunc("/add-child-role", legacy(h.RequireAdmin(h.HandleAddChildRole)))
+	mux.HandleFunc("/remove-child-role", legacy(h.RequireAdmin(h.HandleRemoveChildRole)))
+	mux.HandleFunc("/grant-permission", legacy(h.RequireAdmin(h.HandleGrantPermission)))
+	mux.HandleFunc("/revoke-permission", legacy(h.RequireAdmin(h.HandleRevokePermission)))
+	mux.HandleFunc("/authenticate", legacy(h.HandleAuthenticate))
+	mux.HandleFunc("/refresh-token", legacy(h.HandleRefreshToken))
+	mux.HandleFunc("/invalidate-token", legacy(h.HandleInvalidateToken))
+	mux.HandleFunc("/check-role", legacy(h.HandleCheckRole))
+	mux.HandleFunc("/check-permission", legacy(h.HandleCheckPermission))
+	mux.HandleFunc("/get-all-roles", legacy(h.HandleGetAllRoles))
+	mux.HandleFunc("/get-direct-roles", legacy(h.HandleGetDirectRoles))
+	mux.HandleFunc("/rotate-signing-key", legacy(h.RequireAdmin(h.HandleRotateSigningKey)))
+	mux.HandleFunc("/retire-signing-key", legacy(h.RequireAdmin(h.HandleRetireSigningKey)))
+	mux.HandleFunc("/introspect", h.HandleIntrospect) // RFC 7662 clients are configured with this path
+}
+
+// legacy marks a response to one of the unversioned paths as deprecated.
+// Those paths keep accepting any method, as existing clients send GET
+// requests with a body to endpoints that change state. Since their method
+// says nothing about their effect, the token cookie is not honoured there.
+func legacy(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		if r.Header.Get("Cookie") != "" {
+			r = r.Clone(r.Context())
+			r.Header.Del("Cookie")
+		}
+		next(w, r)
+	}
+}
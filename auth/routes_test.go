@@ -0,0 +1,159 @@
+// auth/routes_test.go
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegisterRoutes(t *testing.T) {
+	setupService()
+	admin := service.(*InMemoryAuthService)
+	admin.EnsureAdmin("root", "rootpass")
+	adminToken, _ := admin.Authenticate("root", "rootpass")
+
+	mux := http.NewServeMux()
+	api.RegisterRoutes(mux)
+
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		want       int
+		deprecated bool
+	}{
+		{"create user", "POST", "/v1/users", `{"username":"testuser","password":"testpass"}`, http.StatusCreated, false},
+		{"create role", "POST", "/v1/roles", `{"roleName":"editor"}`, http.StatusCreated, false},
+		{"create child role", "POST", "/v1/roles", `{"roleName":"viewer"}`, http.StatusCreated, false},
+		{"grant permission", "PUT", "/v1/roles/viewer/permissions/orders:read", "", http.StatusCreated, false},
+		{"add child role", "PUT", "/v1/roles/editor/children/viewer", "", http.StatusCreated, false},
+		{"assign role", "PUT", "/v1/users/testuser/roles/editor", "", http.StatusCreated, false},
+		{"list role users", "GET", "/v1/roles/editor/users", "", http.StatusOK, false},
+		{"wrong method", "GET", "/v1/users", "", http.StatusMethodNotAllowed, false},
+		{"refuse assigned role", "DELETE", "/v1/roles/editor", "", http.StatusConflict, false},
+		{"cascade role", "DELETE", "/v1/roles/editor?cascade=true", "", http.StatusOK, false},
+		{"legacy alias", "GET", "/create-role", `{"roleName":"legacy"}`, http.StatusCreated, true},
+		{"delete user", "DELETE", "/v1/users/testuser", "", http.StatusOK, false},
+		{"jwks", "GET", "/.well-known/jwks.json", "", http.StatusOK, false},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken.Token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if status := rr.Code; status != tc.want {
+			t.Errorf("%s: %s %s returned wrong status code: got %v want %v: %s", tc.name, tc.method, tc.path, status, tc.want, rr.Body.String())
+		}
+		if deprecated := rr.Header().Get("Deprecation") != ""; deprecated != tc.deprecated {
+			t.Errorf("%s: got deprecation %v want %v", tc.name, deprecated, tc.deprecated)
+		}
+		if tc.want == http.StatusMethodNotAllowed && rr.Header().Get("Allow") == "" {
+			t.Errorf("%s: expected an Allow header", tc.name)
+		}
+	}
+
+	if _, err := service.Authenticate("testuser", "testpass"); err == nil {
+		t.Errorf("expected testuser to be deleted")
+	}
+	if roles, _ := service.GetRoleUsers("viewer"); len(roles) != 0 {
+		t.Errorf("expected viewer to have no holders but got %v", roles)
+	}
+}
+
+func TestRegisterRoutesCaller(t *testing.T) {
+	setupService()
+	service.CreateUser("testuser", "testpass")
+	service.CreateRole("editor")
+	service.GrantPermission("editor", "orders:read")
+	service.AddRoleToUser("testuser", "editor")
+
+	mux := http.NewServeMux()
+	api.RegisterRoutes(mux)
+
+	serve := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("POST", "/v1/tokens", `{"username":"testuser","password":"testpass"}`, "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"Token"`) {
+		t.Fatalf("login returned %v: %s", rr.Code, rr.Body.String())
+	}
+	tokenDetails, _ := service.Authenticate("testuser", "testpass")
+
+	if rr := serve("GET", "/v1/me", "", tokenDetails.Token); !strings.Contains(rr.Body.String(), `"username":"testuser"`) {
+		t.Errorf("expected the token's user but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve("GET", "/v1/me/roles/editor", "", tokenDetails.Token); !strings.Contains(rr.Body.String(), `"hasRole":true`) {
+		t.Errorf("expected the role to be found but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve("GET", "/v1/me/permissions/orders:read", "", tokenDetails.Token); !strings.Contains(rr.Body.String(), `"hasPermission":true`) {
+		t.Errorf("expected the permission to be granted but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve("GET", "/v1/me/roles", "", tokenDetails.Token); !strings.Contains(rr.Body.String(), "editor") {
+		t.Errorf("expected editor among the roles but got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve("PUT", "/v1/users/testuser/password", `{"password":"testpass","newPassword":"newpass"}`, ""); rr.Code != http.StatusOK {
+		t.Errorf("change password returned %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve("POST", "/v1/roles", `{"roleName":"other"}`, tokenDetails.Token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the revoked token to be refused but got %v", rr.Code)
+	}
+}
+
+func TestRegisterRoutesCookie(t *testing.T) {
+	setupService()
+	admin := service.(*InMemoryAuthService)
+	admin.EnsureAdmin("root", "rootpass")
+	admin.CreateRole("editor")
+	adminToken, _ := admin.Authenticate("root", "rootpass")
+
+	mux := http.NewServeMux()
+	api.RegisterRoutes(mux)
+
+	// what a page on another site can make a browser send with the cookie
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"read own roles", "GET", "/v1/me/roles", "", http.StatusOK},
+		{"form post to a legacy path", "POST", "/add-role-to-user", `{"username":"root","roleName":"editor"}`, http.StatusUnauthorized},
+		{"legacy path read", "GET", "/get-all-roles", "", http.StatusUnauthorized},
+		{"admin read", "GET", "/v1/roles/editor/users", "", http.StatusUnauthorized},
+		{"log out", "DELETE", "/v1/tokens/current", "", http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		req.AddCookie(&http.Cookie{Name: TokenCookieName, Value: adminToken.Token})
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if status := rr.Code; status != tc.want {
+			t.Errorf("%s: %s %s returned wrong status code: got %v want %v: %s", tc.name, tc.method, tc.path, status, tc.want, rr.Body.String())
+		}
+	}
+	if users, _ := service.GetRoleUsers("editor"); len(users) != 0 {
+		t.Errorf("expected the cookie not to assign the role but got %v", users)
+	}
+}
@@ -3,8 +3,14 @@
 package auth
 
 import (
+	"context"
+	"crypto/sha256"
 	"errors"
-	//"fmt"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
 
 	"github.com/gogorush/simple_auth/utils"
 )
@@ -12,20 +18,82 @@ import (
 type AuthService interface {
 	CreateUser(username, password string) error
 	DeleteUser(username string) error
+	ChangePassword(username, oldPassword, newPassword string) error
+	RevokeUserTokens(username string) error
+	ListSessions(username string) ([]Session, error)
+	RevokeSession(username, sessionID string) error
 	CreateRole(roleName string) error
 	DeleteRole(roleName string) error
+	DeleteRoleCascade(roleName string) error
+	GetRoleUsers(roleName string) ([]string, error)
 	AddRoleToUser(username, roleName string) error
+	RemoveRoleFromUser(username, roleName string) error
+	GrantPermission(roleName, permission string) error
+	RevokePermission(roleName, permission string) error
+	AddChildRole(parentRoleName, childRoleName string) error
+	RemoveChildRole(parentRoleName, childRoleName string) error
 	Authenticate(username, password string) (TokenDetails, error)
+	RefreshToken(refreshToken string) (TokenDetails, error)
+	InvalidateToken(tokenString string) error
+	ValidateToken(tokenString string) (string, error)
 	CheckUserRole(tokenString, roleName string) (bool, error)
 	GetAllRoles(tokenString string) ([]Role, error)
+	GetDirectRoles(tokenString string) ([]Role, error)
+	CheckPermission(tokenString, permission string) (bool, error)
 }
 
-type InMemoryAuthService struct{}
+// InMemoryAuthService implements AuthService on top of a Store. The business
+// logic itself keeps no state, so any number of instances can share a process.
+type InMemoryAuthService struct {
+	store Store
+	keys  *KeyRing
+
+	// hierarchyMu serializes AddChildRole, so that the cycle check and the
+	// new link cannot interleave with another link closing a cycle
+	hierarchyMu sync.Mutex
+
+	// introspectionClients maps client id to the SHA-256 of its secret.
+	// Client secrets are machine-generated, so a fast hash is enough and
+	// keeps introspection cheap for gateways calling it on every request.
+	introspectionClients *utils.ConcurrentMap[string, [sha256.Size]byte]
+}
+
+// ServiceOption configures an InMemoryAuthService
+type ServiceOption func(*InMemoryAuthService)
+
+// WithKeyRing makes the service sign and verify tokens with keys. Without it
+// the service signs with a random key that only lives as long as the process.
+func WithKeyRing(keys *KeyRing) ServiceOption {
+	return func(s *InMemoryAuthService) {
+		s.keys = keys
+	}
+}
+
+// NewInMemoryAuthService returns a service that keeps its data in store
+func NewInMemoryAuthService(store Store, opts ...ServiceOption) *InMemoryAuthService {
+	s := &InMemoryAuthService{
+		store:                store,
+		introspectionClients: utils.NewConcurrentMap[string, [sha256.Size]byte](),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.keys == nil {
+		key, err := GenerateHMACKey()
+		if err != nil {
+			panic(fmt.Sprintf("auth: generating signing key: %v", err))
+		}
+		s.keys = NewKeyRing(key)
+	}
+	return s
+}
 
 func (s *InMemoryAuthService) CreateUser(username, password string) error {
+	ctx := context.Background()
 
-	if _, exists := Users.Get(username); exists {
-		return errors.New("user already exists")
+	// cheap check first so duplicates don't pay for bcrypt; the store still has the final word
+	if _, err := s.store.GetUser(ctx, username); err == nil {
+		return ErrUserExists
 	}
 	hashedPassword, err := utils.HashPassword(password)
 	if err != nil {
@@ -35,105 +103,261 @@ func (s *InMemoryAuthService) CreateUser(username, password string) error {
 		Username: username,
 		Password: hashedPassword,
 	}
-	Users.Set(username, newUser)
-	return nil
+	err = s.store.CreateUser(ctx, newUser)
+	if errors.Is(err, ErrAlreadyExists) {
+		return ErrUserExists
+	}
+	return err
 }
 
-// DeleteUser deletes an existing user
+// DeleteUser deletes an existing user along with every token issued to them
 func (s *InMemoryAuthService) DeleteUser(username string) error {
-	if _, exists := Users.Get(username); !exists {
-		return errors.New("user does not exist")
+	ctx := context.Background()
+
+	if _, err := s.getUser(ctx, username); err != nil {
+		return err
 	}
-	Users.Delete(username)
-	return nil
+	return s.store.DeleteUser(ctx, username)
+}
+
+// ChangePassword replaces the user's password and logs them out everywhere
+func (s *InMemoryAuthService) ChangePassword(username, oldPassword, newPassword string) error {
+	ctx := context.Background()
+
+	user, err := s.store.GetUser(ctx, username)
+	if errors.Is(err, ErrNotFound) {
+		return ErrInvalidCredentials
+	}
+	if err != nil {
+		return err
+	}
+	if !utils.CheckPasswordHash(oldPassword, user.Password) {
+		return ErrInvalidCredentials
+	}
+
+	hashedPassword, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	// the old tokens go in the same step, so a password change never takes
+	// effect while leaving them live
+	err = s.store.ModifyUserRevokingTokens(ctx, username, func(current *User) error {
+		// the password checked above must still be the current one
+		if current.Password != user.Password {
+			return ErrInvalidCredentials
+		}
+		current.Password = hashedPassword
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
+// RevokeUserTokens logs a user out everywhere by revoking all their access and refresh tokens
+func (s *InMemoryAuthService) RevokeUserTokens(username string) error {
+	ctx := context.Background()
+
+	if _, err := s.getUser(ctx, username); err != nil {
+		return err
+	}
+	return s.store.DeleteUserTokens(ctx, username)
 }
 
 // CreateRole creates a new role
 func (s *InMemoryAuthService) CreateRole(roleName string) error {
+	ctx := context.Background()
 
-	if _, exists := Roles.Get(roleName); exists {
-		return errors.New("role already exists")
-	}
 	newRole := Role{Name: roleName}
-	Roles.Set(roleName, newRole)
-	return nil
+	err := s.store.CreateRole(ctx, newRole)
+	if errors.Is(err, ErrAlreadyExists) {
+		return ErrRoleExists
+	}
+	return err
 }
 
-// DeleteRole deletes an existing role
+// DeleteRole deletes an existing role, refusing while it is still assigned to
+// any user. Roles including it just lose it.
 func (s *InMemoryAuthService) DeleteRole(roleName string) error {
-	if _, exists := Roles.Get(roleName); !exists {
-		return errors.New("role does not exist")
+	ctx := context.Background()
+
+	if _, err := s.getRole(ctx, roleName); err != nil {
+		return err
 	}
-	Roles.Delete(roleName)
-	return nil
+	err := s.store.DeleteRole(ctx, roleName, false)
+	if errors.Is(err, ErrInUse) {
+		return ErrRoleInUse
+	}
+	return err
+}
+
+// DeleteRoleCascade deletes an existing role and takes it away from every
+// user holding it
+func (s *InMemoryAuthService) DeleteRoleCascade(roleName string) error {
+	ctx := context.Background()
+
+	if _, err := s.getRole(ctx, roleName); err != nil {
+		return err
+	}
+	return s.store.DeleteRole(ctx, roleName, true)
+}
+
+// GetRoleUsers lists the users the role is assigned to directly
+func (s *InMemoryAuthService) GetRoleUsers(roleName string) ([]string, error) {
+	ctx := context.Background()
+
+	if _, err := s.getRole(ctx, roleName); err != nil {
+		return nil, err
+	}
+	return s.store.ListRoleUsers(ctx, roleName)
 }
 
 // AddRoleToUser associates a role with a user
 func (s *InMemoryAuthService) AddRoleToUser(username string, roleName string) error {
+	ctx := context.Background()
 
-	userInterface, userExists := Users.Get(username)
-	if !userExists {
-		return errors.New("user does not exist")
+	err := s.store.AddUserRole(ctx, username, roleName)
+	if !errors.Is(err, ErrNotFound) {
+		return err
 	}
-	user := userInterface.(User) // type assertion
-
-	// check if role exits
-	roleInterface, roleExists := Roles.Get(roleName)
-	if !roleExists {
-		return errors.New("role does not exist")
+	// the store checked both in one step; tell which one was missing
+	if _, err := s.getUser(ctx, username); err != nil {
+		return err
 	}
-	role, ok := roleInterface.(Role) // type assertion
-	if !ok {
-		return errors.New("type assertion failed: not a Role")
+	return ErrRoleNotFound
+}
+
+// RemoveRoleFromUser takes a role away from a user. Tokens carry no roles and
+// every check resolves them from the store, so the user's live tokens lose
+// the role, and whatever it included, at once.
+func (s *InMemoryAuthService) RemoveRoleFromUser(username string, roleName string) error {
+	ctx := context.Background()
+
+	// the role itself may already be deleted, so only the user has to exist
+	err := s.store.ModifyUser(ctx, username, func(user *User) error {
+		user.Roles = slices.DeleteFunc(user.Roles, func(r Role) bool { return r.Name == roleName })
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return ErrUserNotFound
 	}
+	return err
+}
 
-	for _, r := range user.Roles {
-		if r.Name == roleName {
-			return nil // If the role is already associated with the user, nothing happens
+// GrantPermission adds a permission to a role
+func (s *InMemoryAuthService) GrantPermission(roleName, permission string) error {
+	if err := validatePermission(permission); err != nil {
+		return err
+	}
+	return s.modifyRole(context.Background(), roleName, func(role *Role) error {
+		// keep the permissions sorted so every store lists them alike
+		i, granted := slices.BinarySearch(role.Ability, permission)
+		if !granted {
+			role.Ability = slices.Insert(role.Ability, i, permission)
 		}
+		return nil
+	})
+}
+
+// RevokePermission removes a permission from a role
+func (s *InMemoryAuthService) RevokePermission(roleName, permission string) error {
+	if err := validatePermission(permission); err != nil {
+		return err
 	}
-	user.Roles = append(user.Roles, role)
-	Users.Set(username, user)
-	return nil
+	return s.modifyRole(context.Background(), roleName, func(role *Role) error {
+		role.Ability = slices.DeleteFunc(role.Ability, func(p string) bool { return p == permission })
+		return nil
+	})
+}
+
+// AddChildRole makes the parent role include the child role, so holders of
+// the parent also hold the child and everything it includes
+func (s *InMemoryAuthService) AddChildRole(parentRoleName, childRoleName string) error {
+	ctx := context.Background()
+
+	if _, err := s.getRole(ctx, parentRoleName); err != nil {
+		return err
+	}
+	if _, err := s.getRole(ctx, childRoleName); err != nil {
+		return err
+	}
+
+	// the parent must not already be included in the child
+	s.hierarchyMu.Lock()
+	defer s.hierarchyMu.Unlock()
+	cycle, err := s.includes(ctx, childRoleName, parentRoleName)
+	if err != nil {
+		return err
+	}
+	if cycle {
+		return ErrRoleCycle
+	}
+
+	return s.modifyRole(ctx, parentRoleName, func(role *Role) error {
+		if !slices.Contains(role.Children, childRoleName) {
+			role.Children = append(role.Children, childRoleName)
+		}
+		return nil
+	})
+}
+
+// RemoveChildRole undoes AddChildRole
+func (s *InMemoryAuthService) RemoveChildRole(parentRoleName, childRoleName string) error {
+	return s.modifyRole(context.Background(), parentRoleName, func(role *Role) error {
+		role.Children = slices.DeleteFunc(role.Children, func(child string) bool { return child == childRoleName })
+		return nil
+	})
 }
 
 // Authenticate validates user credentials
 func (s *InMemoryAuthService) Authenticate(username, password string) (TokenDetails, error) {
+	return s.AuthenticateClient(username, password, ClientInfo{})
+}
 
-	userInterface, userExists := Users.Get(username)
-	if !userExists {
-		return TokenDetails{}, errors.New("invalid credentials")
+// AuthenticateClient validates user credentials and records where the login
+// came from on the new session
+func (s *InMemoryAuthService) AuthenticateClient(username, password string, client ClientInfo) (TokenDetails, error) {
+	ctx := context.Background()
+
+	user, err := s.store.GetUser(ctx, username)
+	if errors.Is(err, ErrNotFound) {
+		return TokenDetails{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return TokenDetails{}, err
 	}
-	user := userInterface.(User) // type assertion
 
 	if !utils.CheckPasswordHash(password, user.Password) {
-		return TokenDetails{}, errors.New("invalid credentials")
+		return TokenDetails{}, ErrInvalidCredentials
 	}
-	return GenerateToken(username)
+	return s.startSession(ctx, username, client)
 }
 
 // CheckUserRole checks if a user has a specific role
 func (s *InMemoryAuthService) CheckUserRole(tokenString, roleName string) (bool, error) {
+	ctx := context.Background()
 
-	username, err := ValidateToken(tokenString)
+	username, err := s.ValidateToken(tokenString)
 	if err != nil {
 		return false, err
 	}
 
-	userInterface, exists := Users.Get(username)
-	if !exists {
-		return false, errors.New("user does not exist")
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return false, err
 	}
 
-	_, exists = Roles.Get(roleName)
 	// check if role exists
-	if !exists {
-		return false, errors.New("role does not exist")
+	if _, err := s.getRole(ctx, roleName); err != nil {
+		return false, err
 	}
 
-	user := userInterface.(User) // type assertion
-
-	for _, role := range user.Roles {
+	roles, err := s.effectiveRoles(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
 		if role.Name == roleName {
 			return true, nil
 		}
@@ -141,27 +365,174 @@ func (s *InMemoryAuthService) CheckUserRole(tokenString, roleName string) (bool,
 	return false, nil
 }
 
-// GetAllRoles retrieves all roles for a user
+// GetAllRoles retrieves the user's effective roles: those assigned directly,
+// followed by every role they include
 func (s *InMemoryAuthService) GetAllRoles(tokenString string) ([]Role, error) {
+	ctx := context.Background()
 
-	username, err := ValidateToken(tokenString)
+	username, err := s.ValidateToken(tokenString)
 	if err != nil {
 		return nil, err
 	}
 
-	userInterface, exists := Users.Get(username)
-	if !exists {
-		return nil, errors.New("user does not exist")
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return s.effectiveRoles(ctx, user)
+}
+
+// GetDirectRoles retrieves only the roles assigned to the user
+func (s *InMemoryAuthService) GetDirectRoles(tokenString string) ([]Role, error) {
+	ctx := context.Background()
+
+	username, err := s.ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return s.existingRoles(ctx, user)
+}
+
+// CheckPermission checks if any of the user's roles grants a permission
+func (s *InMemoryAuthService) CheckPermission(tokenString, permission string) (bool, error) {
+	ctx := context.Background()
+
+	username, err := s.ValidateToken(tokenString)
+	if err != nil {
+		return false, err
+	}
+
+	user, err := s.getUser(ctx, username)
+	if err != nil {
+		return false, err
+	}
+
+	roles, err := s.effectiveRoles(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		if slices.Contains(role.Ability, permission) {
+			return true, nil
+		}
 	}
-	user := userInterface.(User) // type assertion
+	return false, nil
+}
 
+// existingRoles returns the current state of the user's roles, skipping those
+// deleted since they were assigned
+func (s *InMemoryAuthService) existingRoles(ctx context.Context, user User) ([]Role, error) {
 	// check if role exists
 	var roles []Role
-	for _, role := range user.Roles {
-		_, exists := Roles.Get(role.Name)
-		if exists {
+	for _, assigned := range user.Roles {
+		role, err := s.store.GetRole(ctx, assigned.Name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// effectiveRoles returns the user's existing roles followed by the roles they
+// include, breadth first and each once. Tracking visited roles also keeps the
+// walk finite should services sharing a store ever close a cycle between them.
+func (s *InMemoryAuthService) effectiveRoles(ctx context.Context, user User) ([]Role, error) {
+	roles, err := s.existingRoles(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	visited := make(map[string]bool)
+	for _, role := range roles {
+		visited[role.Name] = true
+	}
+	for i := 0; i < len(roles); i++ {
+		for _, child := range roles[i].Children {
+			if visited[child] {
+				continue
+			}
+			visited[child] = true
+			role, err := s.store.GetRole(ctx, child)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
 			roles = append(roles, role)
 		}
 	}
 	return roles, nil
 }
+
+// includes reports whether the role named from is, or includes, the role named to
+func (s *InMemoryAuthService) includes(ctx context.Context, from, to string) (bool, error) {
+	visited := map[string]bool{from: true}
+	pending := []string{from}
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		if name == to {
+			return true, nil
+		}
+		role, err := s.store.GetRole(ctx, name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, child := range role.Children {
+			if !visited[child] {
+				visited[child] = true
+				pending = append(pending, child)
+			}
+		}
+	}
+	return false, nil
+}
+
+// getUser loads a user, translating a missing record into ErrUserNotFound
+func (s *InMemoryAuthService) getUser(ctx context.Context, username string) (User, error) {
+	user, err := s.store.GetUser(ctx, username)
+	if errors.Is(err, ErrNotFound) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+// modifyRole applies fn to a stored role, translating a missing record into
+// ErrRoleNotFound
+func (s *InMemoryAuthService) modifyRole(ctx context.Context, roleName string, fn func(role *Role) error) error {
+	err := s.store.ModifyRole(ctx, roleName, fn)
+	if errors.Is(err, ErrNotFound) {
+		return ErrRoleNotFound
+	}
+	return err
+}
+
+// validatePermission rejects permissions that could not be told apart in a
+// space-separated list
+func validatePermission(permission string) error {
+	if permission == "" || strings.ContainsFunc(permission, unicode.IsSpace) {
+		return ErrInvalidPermission
+	}
+	return nil
+}
+
+// getRole loads a role, translating a missing record into ErrRoleNotFound
+func (s *InMemoryAuthService) getRole(ctx context.Context, roleName string) (Role, error) {
+	role, err := s.store.GetRole(ctx, roleName)
+	if errors.Is(err, ErrNotFound) {
+		return Role{}, ErrRoleNotFound
+	}
+	return role, err
+}
@@ -3,131 +3,703 @@
 package auth
 
 import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
-	"github.com/gogorush/simple_auth/utils"
 )
 
-var authService AuthService = &InMemoryAuthService{}
-
-func setup() {
+// testStores are the backends the service tests run against, each opening a
+// fresh store for the test
+var testStores = map[string]func(t *testing.T) Store{
+	"memory": func(t *testing.T) Store { return NewMemoryStore() },
+	"file": func(t *testing.T) Store {
+		store := openTestFileStore(t, t.TempDir(), FileStoreOptions{Sync: SyncNever})
+		t.Cleanup(func() { store.Close() })
+		return store
+	},
+	"sql": func(t *testing.T) Store { return openTestSQLStore(t) },
+}
 
-	// Reset the global maps to ensure a fresh state for each test
-	Users = utils.NewConcurrentMap()
-	Roles = utils.NewConcurrentMap()
-	Tokens = utils.NewConcurrentMap()
-	authService = &InMemoryAuthService{} // Reset to mock service for each test
+// forEachStore runs test as a subtest per backend. newStore opens a fresh
+// store of that backend each time it is called.
+func forEachStore(t *testing.T, test func(t *testing.T, newStore func() Store)) {
+	for name, open := range testStores {
+		t.Run(name, func(t *testing.T) {
+			test(t, func() Store { return open(t) })
+		})
+	}
 }
 
 func TestCreateUser(t *testing.T) {
-    setup()
-	err := authService.CreateUser("testuser1", "password123")
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		err := authService.CreateUser("testuser1", "password123")
 
-	assert.Nil(t, err, "Error should be nil")
+		assert.Nil(t, err, "Error should be nil")
 
-	// Attempting to create the same user should return an error
-	err = authService.CreateUser("testuser1", "password123")
-	assert.NotNil(t, err, "Error should not be nil")
+		// Attempting to create the same user should return an error
+		err = authService.CreateUser("testuser1", "password123")
+		assert.NotNil(t, err, "Error should not be nil")
+	})
 }
 
 func TestDeleteUser(t *testing.T) {
-    setup()
-	authService.CreateUser("userToDelete", "password123")
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userToDelete", "password123")
 
-	err := authService.DeleteUser("userToDelete")
-	assert.Nil(t, err, "Error should be nil")
+		err := authService.DeleteUser("userToDelete")
+		assert.Nil(t, err, "Error should be nil")
 
-	// Attempting to delete the user again should return an error
-	err = authService.DeleteUser("userToDelete")
-	assert.NotNil(t, err, "Error should not be nil")
+		// Attempting to delete the user again should return an error
+		err = authService.DeleteUser("userToDelete")
+		assert.NotNil(t, err, "Error should not be nil")
+	})
 }
 
 func TestCreateRole(t *testing.T) {
-    setup()
-	err := authService.CreateRole("testRole")
-	assert.Nil(t, err, "Error should be nil")
-
-	// Attempting to create the same role should return an error
-	err = authService.CreateRole("testRole")
-	assert.NotNil(t, err, "Error should not be nil")
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		err := authService.CreateRole("testRole")
+		assert.Nil(t, err, "Error should be nil")
+
+		// Attempting to create the same role should return an error
+		err = authService.CreateRole("testRole")
+		assert.NotNil(t, err, "Error should not be nil")
+	})
 }
 
 func TestDeleteRole(t *testing.T) {
-    setup()
-	authService.CreateRole("roleToDelete")
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateRole("roleToDelete")
 
-	err := authService.DeleteRole("roleToDelete")
-	assert.Nil(t, err, "Error should be nil")
+		err := authService.DeleteRole("roleToDelete")
+		assert.Nil(t, err, "Error should be nil")
 
-	// Attempting to delete the role again should return an error
-	err = authService.DeleteRole("roleToDelete")
-	assert.NotNil(t, err, "Error should not be nil")
+		// Attempting to delete the role again should return an error
+		err = authService.DeleteRole("roleToDelete")
+		assert.NotNil(t, err, "Error should not be nil")
+	})
+}
+
+func TestDeleteAssignedRole(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("holder1", "password123")
+		authService.CreateUser("holder2", "password123")
+		authService.CreateRole("admin")
+		authService.CreateRole("editor")
+		authService.AddChildRole("admin", "editor")
+		authService.AddRoleToUser("holder1", "editor")
+		authService.AddRoleToUser("holder2", "editor")
+		authService.AddRoleToUser("holder2", "admin")
+
+		usernames, err := authService.GetRoleUsers("editor")
+		assert.Nil(t, err, "Error should be nil")
+		assert.Equal(t, []string{"holder1", "holder2"}, usernames)
+		_, err = authService.GetRoleUsers("missing")
+		assert.NotNil(t, err, "Listing the holders of a missing role should fail")
+
+		err = authService.DeleteRole("editor")
+		assert.Equal(t, "role is still assigned to users", err.Error())
+		_, err = authService.GetRoleUsers("editor")
+		assert.Nil(t, err, "A refused deletion should keep the role")
+
+		assert.Nil(t, authService.DeleteRoleCascade("editor"), "Error should be nil")
+		tokenDetails, _ := authService.Authenticate("holder2", "password123")
+		direct, err := authService.GetDirectRoles(tokenDetails.Token)
+		assert.Nil(t, err, "Error should be nil")
+		assert.Equal(t, []Role{{Name: "admin"}}, direct, "The deleted role should be gone from its holders and parents")
+
+		assert.Nil(t, authService.CreateRole("editor"), "The name should be free again")
+		usernames, _ = authService.GetRoleUsers("editor")
+		assert.Empty(t, usernames, "A recreated role should not inherit old assignments")
+		hasRole, err := authService.CheckUserRole(tokenDetails.Token, "editor")
+		assert.Nil(t, err, "Error should be nil")
+		assert.False(t, hasRole, "A recreated role should not be included by the old parent")
+	})
 }
 
 func TestAddRoleToUser(t *testing.T) {
-    setup()
-	authService.CreateUser("userForRole", "password123")
-	authService.CreateRole("roleToAdd")
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userForRole", "password123")
+		authService.CreateRole("roleToAdd")
+
+		err := authService.AddRoleToUser("userForRole", "roleToAdd")
+		assert.Nil(t, err, "Error should be nil")
 
-	err := authService.AddRoleToUser("userForRole", "roleToAdd")
-	assert.Nil(t, err, "Error should be nil")
+		// Attempting to add the role again should not return an error (idempotent operation)
+		err = authService.AddRoleToUser("userForRole", "roleToAdd")
+		assert.Nil(t, err, "Error should be nil")
 
-	// Attempting to add the role again should not return an error (idempotent operation)
-	err = authService.AddRoleToUser("userForRole", "roleToAdd")
-	assert.Nil(t, err, "Error should be nil")
+		err = authService.AddRoleToUser("userForRole", "notExistRole")
+		assert.NotNil(t, err, "Error should not be nil")
+	})
+}
 
-	err = authService.AddRoleToUser("userForRole", "notExistRole")
-	assert.NotNil(t, err, "Error should not be nil")
+func TestRemoveRoleFromUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userForRemoveRole", "password123")
+		authService.CreateRole("admin")
+		authService.CreateRole("viewer")
+		authService.AddChildRole("admin", "viewer")
+		authService.GrantPermission("viewer", "docs:read")
+		authService.AddRoleToUser("userForRemoveRole", "admin")
+		tokenDetails, _ := authService.Authenticate("userForRemoveRole", "password123")
+
+		allowed, _ := authService.CheckPermission(tokenDetails.Token, "docs:read")
+		assert.True(t, allowed, "The user should start with the inherited permission")
+
+		assert.Nil(t, authService.RemoveRoleFromUser("userForRemoveRole", "admin"), "Error should be nil")
+		hasRole, err := authService.CheckUserRole(tokenDetails.Token, "admin")
+		assert.Nil(t, err, "The token itself should stay valid")
+		assert.False(t, hasRole, "An existing token should lose the removed role")
+		hasRole, _ = authService.CheckUserRole(tokenDetails.Token, "viewer")
+		assert.False(t, hasRole, "Roles inherited through the removed role should go too")
+		allowed, _ = authService.CheckPermission(tokenDetails.Token, "docs:read")
+		assert.False(t, allowed, "Permissions through the removed role should go too")
+
+		assert.Nil(t, authService.RemoveRoleFromUser("userForRemoveRole", "admin"), "Removing an unassigned role should be harmless")
+		assert.NotNil(t, authService.RemoveRoleFromUser("nonExistentUser", "admin"), "Error should not be nil")
+	})
 }
 
 func TestAuthenticate(t *testing.T) {
-    setup()
-	authService.CreateUser("userToAuth", "password123")
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userToAuth", "password123")
 
-	_, err := authService.Authenticate("userToAuth", "password123")
-	assert.Nil(t, err, "Error should be nil")
+		_, err := authService.Authenticate("userToAuth", "password123")
+		assert.Nil(t, err, "Error should be nil")
 
-	_, err = authService.Authenticate("userToAuth", "wrongpassword")
-	assert.NotNil(t, err, "Error should not be nil")
+		_, err = authService.Authenticate("userToAuth", "wrongpassword")
+		assert.NotNil(t, err, "Error should not be nil")
+	})
 }
 
 func TestCheckUserRole(t *testing.T) {
-    setup()
-	authService.CreateUser("userForRoleCheck", "password123")
-	authService.CreateRole("roleToCheck")
-    //authService.AddRoleToUser("userForRoleCheck", "roleToCheck")
-	tokenDetails, _ := authService.Authenticate("userForRoleCheck", "password123")
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userForRoleCheck", "password123")
+		authService.CreateRole("roleToCheck")
+		//authService.AddRoleToUser("userForRoleCheck", "roleToCheck")
+		tokenDetails, _ := authService.Authenticate("userForRoleCheck", "password123")
+
+		hasRole, err := authService.CheckUserRole(tokenDetails.Token, "roleToCheck")
+		assert.Nil(t, err, "Error should be nil")
+		assert.False(t, hasRole, "User should not have the role")
+
+		authService.AddRoleToUser("userForRoleCheck", "roleToCheck")
+		hasRole, err = authService.CheckUserRole(tokenDetails.Token, "roleToCheck")
+		assert.Nil(t, err, "Error should be nil")
+		assert.True(t, hasRole, "User should have the role")
+
+		hasRole, err = authService.CheckUserRole(tokenDetails.Token, "notExistRole")
+		assert.NotNil(t, err, "Error should be nil")
+		assert.False(t, hasRole, "User should not have the role")
+	})
+}
 
-	hasRole, err := authService.CheckUserRole(tokenDetails.Token, "roleToCheck")
-	assert.Nil(t, err, "Error should be nil")
-	assert.False(t, hasRole, "User should not have the role")
+func TestGetAllRoles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userForGetAllRoles", "password123")
+		authService.CreateRole("role1")
+		authService.CreateRole("role2")
+		tokenDetails, _ := authService.Authenticate("userForGetAllRoles", "password123")
+
+		roles, err := authService.GetAllRoles(tokenDetails.Token)
+		assert.Nil(t, err, "Error should be nil")
+		assert.Len(t, roles, 0, "User should have no roles")
+
+		authService.AddRoleToUser("userForGetAllRoles", "role1")
+		authService.AddRoleToUser("userForGetAllRoles", "role2")
+
+		roles, err = authService.GetAllRoles(tokenDetails.Token)
+		assert.Nil(t, err, "Error should be nil")
+		assert.Len(t, roles, 2, "User should have 2 roles")
+	})
+}
 
-	authService.AddRoleToUser("userForRoleCheck", "roleToCheck")
-	hasRole, err = authService.CheckUserRole(tokenDetails.Token, "roleToCheck")
-	assert.Nil(t, err, "Error should be nil")
-	assert.True(t, hasRole, "User should have the role")
+func TestPermissions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userForPermissions", "password123")
+		authService.CreateRole("clerk")
+		authService.CreateRole("auditor")
+		authService.AddRoleToUser("userForPermissions", "clerk")
+		tokenDetails, _ := authService.Authenticate("userForPermissions", "password123")
+
+		allowed, err := authService.CheckPermission(tokenDetails.Token, "orders:write")
+		assert.Nil(t, err, "Error should be nil")
+		assert.False(t, allowed, "No role grants the permission yet")
+
+		assert.Nil(t, authService.GrantPermission("clerk", "orders:write"))
+		assert.Nil(t, authService.GrantPermission("clerk", "orders:read"))
+		assert.Nil(t, authService.GrantPermission("clerk", "orders:read"), "Granting twice should be harmless")
+		assert.Nil(t, authService.GrantPermission("auditor", "ledger:read"))
+		allowed, err = authService.CheckPermission(tokenDetails.Token, "orders:write")
+		assert.Nil(t, err, "Error should be nil")
+		assert.True(t, allowed, "Permissions granted to a role should reach its holders")
+		allowed, _ = authService.CheckPermission(tokenDetails.Token, "ledger:read")
+		assert.False(t, allowed, "Permissions of roles the user lacks should not count")
+
+		roles, err := authService.GetAllRoles(tokenDetails.Token)
+		assert.Nil(t, err, "Error should be nil")
+		assert.Equal(t, []Role{{Name: "clerk", Ability: []string{"orders:read", "orders:write"}}}, roles,
+			"Roles should list their current permissions")
+
+		assert.Nil(t, authService.RevokePermission("clerk", "orders:write"))
+		allowed, _ = authService.CheckPermission(tokenDetails.Token, "orders:write")
+		assert.False(t, allowed, "A revoked permission should no longer be granted")
+
+		assert.Equal(t, "role does not exist", authService.GrantPermission("missing", "orders:read").Error())
+		assert.Equal(t, "invalid permission", authService.GrantPermission("clerk", "orders read").Error())
+		_, err = authService.CheckPermission("not a token", "orders:read")
+		assert.NotNil(t, err, "An invalid token should be rejected")
+	})
+}
 
-	hasRole, err = authService.CheckUserRole(tokenDetails.Token, "notExistRole")
-	assert.NotNil(t, err, "Error should be nil")
-	assert.False(t, hasRole, "User should not have the role")
+func TestRoleHierarchy(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userForHierarchy", "password123")
+		for _, roleName := range []string{"admin", "editor", "viewer", "auditor"} {
+			authService.CreateRole(roleName)
+		}
+		assert.Nil(t, authService.AddChildRole("admin", "editor"))
+		assert.Nil(t, authService.AddChildRole("editor", "viewer"))
+		assert.Nil(t, authService.AddChildRole("admin", "viewer"), "A role may be reachable along several paths")
+		assert.Nil(t, authService.GrantPermission("viewer", "docs:read"))
+		authService.AddRoleToUser("userForHierarchy", "admin")
+		tokenDetails, _ := authService.Authenticate("userForHierarchy", "password123")
+
+		hasRole, err := authService.CheckUserRole(tokenDetails.Token, "viewer")
+		assert.Nil(t, err, "Error should be nil")
+		assert.True(t, hasRole, "Roles should be inherited transitively")
+		hasRole, _ = authService.CheckUserRole(tokenDetails.Token, "auditor")
+		assert.False(t, hasRole, "Unrelated roles should not be inherited")
+		allowed, _ := authService.CheckPermission(tokenDetails.Token, "docs:read")
+		assert.True(t, allowed, "Permissions of inherited roles should count")
+
+		roles, err := authService.GetAllRoles(tokenDetails.Token)
+		assert.Nil(t, err, "Error should be nil")
+		var names []string
+		for _, role := range roles {
+			names = append(names, role.Name)
+		}
+		assert.Equal(t, []string{"admin", "editor", "viewer"}, names, "Effective roles should list each role once")
+		direct, err := authService.GetDirectRoles(tokenDetails.Token)
+		assert.Nil(t, err, "Error should be nil")
+		assert.Len(t, direct, 1, "Only admin is assigned directly")
+
+		assert.NotNil(t, authService.AddChildRole("viewer", "admin"), "A cycle should be refused")
+		assert.NotNil(t, authService.AddChildRole("editor", "editor"), "A role should not include itself")
+		assert.Equal(t, "role does not exist", authService.AddChildRole("admin", "missing").Error())
+
+		assert.Nil(t, authService.RemoveChildRole("admin", "editor"))
+		hasRole, _ = authService.CheckUserRole(tokenDetails.Token, "editor")
+		assert.False(t, hasRole, "Removing the link should drop the inherited role")
+		hasRole, _ = authService.CheckUserRole(tokenDetails.Token, "viewer")
+		assert.True(t, hasRole, "Roles still reachable along another path should remain")
+	})
 }
 
-func TestGetAllRoles(t *testing.T) {
-    setup()
-	authService.CreateUser("userForGetAllRoles", "password123")
-	authService.CreateRole("role1")
-	authService.CreateRole("role2")
-	tokenDetails, _ := authService.Authenticate("userForGetAllRoles", "password123")
-
-	roles, err := authService.GetAllRoles(tokenDetails.Token)
-	assert.Nil(t, err, "Error should be nil")
-	assert.Len(t, roles, 0, "User should have no roles")
-
-	authService.AddRoleToUser("userForGetAllRoles", "role1")
-	authService.AddRoleToUser("userForGetAllRoles", "role2")
-
-	roles, err = authService.GetAllRoles(tokenDetails.Token)
-	assert.Nil(t, err, "Error should be nil")
-	assert.Len(t, roles, 2, "User should have 2 roles")
+func TestEnsureAdmin(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		s := NewInMemoryAuthService(newStore())
+		assert.NotNil(t, s.EnsureAdmin("root", ""), "A new admin needs a password")
+		assert.Nil(t, s.EnsureAdmin("root", "password123"), "Error should be nil")
+		assert.Nil(t, s.EnsureAdmin("root", "ignored"), "Bootstrapping again should be harmless")
+
+		tokenDetails, err := s.Authenticate("root", "password123")
+		assert.Nil(t, err, "An existing admin should keep their password")
+		allowed, err := s.CheckPermission(tokenDetails.Token, AdminPermission)
+		assert.Nil(t, err, "Error should be nil")
+		assert.True(t, allowed, "The bootstrap admin should hold the admin permission")
+
+		assert.Nil(t, s.CreateUser("promoted", "password123"))
+		assert.Nil(t, s.EnsureAdmin("promoted", ""), "Existing users can be promoted without a password")
+		usernames, _ := s.GetRoleUsers(AdminRole)
+		assert.Equal(t, []string{"promoted", "root"}, usernames)
+	})
+}
+
+func TestIsolatedServices(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		first := NewInMemoryAuthService(newStore())
+		second := NewInMemoryAuthService(newStore())
+
+		err := first.CreateUser("isolatedUser", "password123")
+		assert.Nil(t, err, "Error should be nil")
+
+		// The same username is free in a service backed by a different store
+		err = second.CreateUser("isolatedUser", "password123")
+		assert.Nil(t, err, "Error should be nil")
+
+		tokenDetails, err := first.Authenticate("isolatedUser", "password123")
+		assert.Nil(t, err, "Error should be nil")
+
+		// Tokens issued by one service are unknown to the other
+		_, err = second.GetAllRoles(tokenDetails.Token)
+		assert.NotNil(t, err, "Error should not be nil")
+	})
+}
+
+func TestRefreshToken(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userToRefresh", "password123")
+		tokenDetails, err := authService.Authenticate("userToRefresh", "password123")
+		assert.Nil(t, err, "Error should be nil")
+		assert.NotEmpty(t, tokenDetails.RefreshToken, "Authenticate should return a refresh token")
+
+		refreshed, err := authService.RefreshToken(tokenDetails.RefreshToken)
+		assert.Nil(t, err, "Error should be nil")
+		assert.NotEqual(t, tokenDetails.Token, refreshed.Token, "A new access token should be issued")
+		assert.NotEqual(t, tokenDetails.RefreshToken, refreshed.RefreshToken, "The refresh token should rotate")
+
+		_, err = authService.GetAllRoles(refreshed.Token)
+		assert.Nil(t, err, "The refreshed access token should be valid")
+
+		_, err = authService.RefreshToken("notARefreshToken")
+		assert.NotNil(t, err, "Error should not be nil for an unknown refresh token")
+	})
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userWithStolenToken", "password123")
+		original, _ := authService.Authenticate("userWithStolenToken", "password123")
+		otherSession, _ := authService.Authenticate("userWithStolenToken", "password123")
+
+		rotated, err := authService.RefreshToken(original.RefreshToken)
+		assert.Nil(t, err, "Error should be nil")
+
+		// Replaying the rotated-out token revokes everything descended from it
+		_, err = authService.RefreshToken(original.RefreshToken)
+		assert.NotNil(t, err, "Reusing a refresh token should fail")
+
+		_, err = authService.RefreshToken(rotated.RefreshToken)
+		assert.NotNil(t, err, "The latest refresh token of the family should be revoked")
+		_, err = authService.GetAllRoles(rotated.Token)
+		assert.NotNil(t, err, "Access tokens of the family should be revoked")
+		_, err = authService.GetAllRoles(original.Token)
+		assert.NotNil(t, err, "Access tokens of the family should be revoked")
+
+		// Other logins of the same user are separate families
+		_, err = authService.RefreshToken(otherSession.RefreshToken)
+		assert.Nil(t, err, "Unrelated families should be unaffected")
+	})
+}
+
+func TestRenewSessionAfterRevocation(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		ctx := context.Background()
+		store := newStore()
+		expiresAt := time.Now().Add(time.Hour).Unix()
+		assert.Nil(t, store.SaveRefreshToken(ctx, "refresh1", RefreshToken{Username: "renewUser", Family: "fam1", ExpiresAt: expiresAt}))
+		assert.Nil(t, store.SaveSession(ctx, Session{ID: "fam1", Username: "renewUser", ExpiresAt: expiresAt}))
+
+		next := RefreshToken{Username: "renewUser", Family: "fam1", AccessToken: "access2", ExpiresAt: expiresAt + 60}
+		assert.Nil(t, store.RenewSession(ctx, "refresh2", next, expiresAt, 5))
+		session, err := store.GetSession(ctx, "fam1")
+		assert.Nil(t, err)
+		assert.Equal(t, expiresAt+60, session.ExpiresAt, "Renewing should extend the session")
+		assert.Equal(t, int64(5), session.LastUsedAt, "Renewing should mark the session used")
+		_, err = store.GetToken(ctx, "access2")
+		assert.Nil(t, err, "Renewing should store the new access token")
+
+		// a refresh racing a logout used its token before the family went
+		assert.Nil(t, store.DeleteRefreshFamily(ctx, "fam1"))
+		next = RefreshToken{Username: "renewUser", Family: "fam1", AccessToken: "access3", ExpiresAt: expiresAt + 120}
+		assert.Equal(t, ErrNotFound, store.RenewSession(ctx, "refresh3", next, expiresAt, 10))
+		_, err = store.GetSession(ctx, "fam1")
+		assert.Equal(t, ErrNotFound, err, "Renewing must not bring back a revoked session")
+		_, err = store.GetToken(ctx, "access3")
+		assert.Equal(t, ErrNotFound, err, "Nothing should be stored for a revoked session")
+		_, err = store.GetRefreshToken(ctx, "refresh3")
+		assert.Equal(t, ErrNotFound, err, "Nothing should be stored for a revoked session")
+	})
+}
+
+func TestDeleteUserRevokesTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userToPurge", "password123")
+		first, _ := authService.Authenticate("userToPurge", "password123")
+		second, _ := authService.Authenticate("userToPurge", "password123")
+
+		err := authService.DeleteUser("userToPurge")
+		assert.Nil(t, err, "Error should be nil")
+
+		// Recreating the name must not resurrect the old sessions
+		authService.CreateUser("userToPurge", "password123")
+		for _, tokenDetails := range []TokenDetails{first, second} {
+			_, err = authService.GetAllRoles(tokenDetails.Token)
+			assert.NotNil(t, err, "Access tokens of a deleted user should be revoked")
+			_, err = authService.RefreshToken(tokenDetails.RefreshToken)
+			assert.NotNil(t, err, "Refresh tokens of a deleted user should be revoked")
+		}
+	})
+}
+
+func TestChangePassword(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userChangingPassword", "password123")
+		authService.CreateUser("bystander", "password123")
+		oldSession, _ := authService.Authenticate("userChangingPassword", "password123")
+		bystanderSession, _ := authService.Authenticate("bystander", "password123")
+
+		err := authService.ChangePassword("userChangingPassword", "wrongpassword", "newpassword")
+		assert.NotNil(t, err, "The old password must be verified")
+
+		err = authService.ChangePassword("userChangingPassword", "password123", "newpassword")
+		assert.Nil(t, err, "Error should be nil")
+
+		_, err = authService.Authenticate("userChangingPassword", "password123")
+		assert.NotNil(t, err, "The old password should no longer work")
+		_, err = authService.Authenticate("userChangingPassword", "newpassword")
+		assert.Nil(t, err, "The new password should work")
+
+		_, err = authService.GetAllRoles(oldSession.Token)
+		assert.NotNil(t, err, "Sessions from before the change should be revoked")
+		_, err = authService.RefreshToken(oldSession.RefreshToken)
+		assert.NotNil(t, err, "Sessions from before the change should be revoked")
+		_, err = authService.GetAllRoles(bystanderSession.Token)
+		assert.Nil(t, err, "Other users should be unaffected")
+	})
+}
+
+func TestRevokeUserTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userLoggingOut", "password123")
+		sessions := make([]TokenDetails, 3)
+		for i := range sessions {
+			sessions[i], _ = authService.Authenticate("userLoggingOut", "password123")
+		}
+		rotated, _ := authService.RefreshToken(sessions[0].RefreshToken)
+		sessions = append(sessions, rotated)
+
+		err := authService.RevokeUserTokens("userLoggingOut")
+		assert.Nil(t, err, "Error should be nil")
+		for _, session := range sessions {
+			_, err = authService.GetAllRoles(session.Token)
+			assert.NotNil(t, err, "Every access token should be revoked")
+		}
+		_, err = authService.RefreshToken(rotated.RefreshToken)
+		assert.NotNil(t, err, "Every refresh token should be revoked")
+
+		_, err = authService.Authenticate("userLoggingOut", "password123")
+		assert.Nil(t, err, "The user can still log in again")
+
+		err = authService.RevokeUserTokens("notExistUser")
+		assert.NotNil(t, err, "Error should not be nil for an unknown user")
+	})
+}
+
+func TestSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("userWithSessions", "password123")
+		authService.CreateUser("otherUser", "password123")
+		laptop, _ := authService.AuthenticateClient("userWithSessions", "password123",
+			ClientInfo{IP: "192.0.2.1", UserAgent: "laptop"})
+		phone, _ := authService.Authenticate("userWithSessions", "password123")
+		other, _ := authService.Authenticate("otherUser", "password123")
+
+		sessions, err := authService.ListSessions("userWithSessions")
+		assert.Nil(t, err, "Error should be nil")
+		assert.Len(t, sessions, 2, "Each login should be its own session")
+		var laptopSession Session
+		for _, session := range sessions {
+			if session.UserAgent == "laptop" {
+				laptopSession = session
+			}
+		}
+		assert.Equal(t, "192.0.2.1", laptopSession.ClientIP, "The client address should be recorded")
+		assert.Equal(t, laptop.RefreshExpiresAt, laptopSession.ExpiresAt, "A session lasts as long as its refresh token")
+
+		// refreshing continues the session rather than starting a new one
+		laptop, err = authService.RefreshToken(laptop.RefreshToken)
+		assert.Nil(t, err, "Error should be nil")
+		sessions, _ = authService.ListSessions("userWithSessions")
+		assert.Len(t, sessions, 2, "Refreshing should not add a session")
+
+		otherSessions, _ := authService.ListSessions("otherUser")
+		err = authService.RevokeSession("userWithSessions", otherSessions[0].ID)
+		assert.NotNil(t, err, "Sessions of other users cannot be revoked")
+		_, err = authService.GetAllRoles(other.Token)
+		assert.Nil(t, err, "The other user's session should be unaffected")
+
+		err = authService.RevokeSession("userWithSessions", laptopSession.ID)
+		assert.Nil(t, err, "Error should be nil")
+		_, err = authService.GetAllRoles(laptop.Token)
+		assert.NotNil(t, err, "Access tokens of the revoked session should be invalid")
+		_, err = authService.RefreshToken(laptop.RefreshToken)
+		assert.NotNil(t, err, "Refresh tokens of the revoked session should be invalid")
+		_, err = authService.GetAllRoles(phone.Token)
+		assert.Nil(t, err, "Other sessions should be unaffected")
+
+		sessions, _ = authService.ListSessions("userWithSessions")
+		assert.Len(t, sessions, 1, "The revoked session should no longer be listed")
+
+		authService.RevokeUserTokens("userWithSessions")
+		sessions, _ = authService.ListSessions("userWithSessions")
+		assert.Len(t, sessions, 0, "Logging out everywhere should end every session")
+
+		_, err = authService.ListSessions("notExistUser")
+		assert.NotNil(t, err, "Error should not be nil for an unknown user")
+	})
+}
+
+func TestSessionLastUsed(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		defer func(interval time.Duration) { sessionTouchInterval = interval }(sessionTouchInterval)
+		sessionTouchInterval = 0
+
+		authService.CreateUser("busyUser", "password123")
+		tokenDetails, _ := authService.Authenticate("busyUser", "password123")
+		sessions, _ := authService.ListSessions("busyUser")
+		sessionID := sessions[0].ID
+
+		// pretend the session has been idle for an hour
+		s := authService
+		session, _ := s.store.GetSession(context.Background(), sessionID)
+		session.LastUsedAt -= 3600
+		s.store.SaveSession(context.Background(), session)
+
+		_, err := authService.GetAllRoles(tokenDetails.Token)
+		assert.Nil(t, err, "Error should be nil")
+		sessions, _ = authService.ListSessions("busyUser")
+		assert.Greater(t, sessions[0].LastUsedAt, session.LastUsedAt, "Using a token should update the session")
+	})
+}
+
+// yieldingStore lets other goroutines run on every role read, widening the
+// window for races between reading the hierarchy and changing it
+type yieldingStore struct {
+	Store
+}
+
+func (s yieldingStore) GetRole(ctx context.Context, roleName string) (Role, error) {
+	role, err := s.Store.GetRole(ctx, roleName)
+	runtime.Gosched()
+	return role, err
+}
+
+func TestConcurrentAddChildRole(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		service := NewInMemoryAuthService(yieldingStore{newStore()})
+		for i := 0; i < 20; i++ {
+			a, b := fmt.Sprintf("a%d", i), fmt.Sprintf("b%d", i)
+			service.CreateRole(a)
+			service.CreateRole(b)
+
+			// linking both ways at once must leave exactly one link
+			errs := make(chan error, 2)
+			go func() { errs <- service.AddChildRole(a, b) }()
+			go func() { errs <- service.AddChildRole(b, a) }()
+			first, second := <-errs, <-errs
+			if first == nil {
+				assert.ErrorIs(t, second, ErrRoleCycle)
+			} else {
+				assert.ErrorIs(t, first, ErrRoleCycle)
+				assert.Nil(t, second, "Error should be nil")
+			}
+		}
+	})
+}
+
+func TestAddRoleToUserRacingDeleteRole(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		ctx := context.Background()
+		service := NewInMemoryAuthService(yieldingStore{newStore()})
+		service.CreateUser("alice", "password123")
+		for i := 0; i < 20; i++ {
+			roleName := fmt.Sprintf("role%d", i)
+			service.CreateRole(roleName)
+
+			errs := make(chan error, 2)
+			go func() { errs <- service.AddRoleToUser("alice", roleName) }()
+			go func() { errs <- service.DeleteRole(roleName) }()
+			<-errs
+			<-errs
+
+			// either the role survived, or alice must not hold it
+			if _, err := service.store.GetRole(ctx, roleName); err == nil {
+				continue
+			}
+			user, _ := service.store.GetUser(ctx, "alice")
+			assert.NotContains(t, user.Roles, Role{Name: roleName}, "A deleted role should not be left assigned")
+			holders, _ := service.store.ListRoleUsers(ctx, roleName)
+			assert.Empty(t, holders, "A deleted role should have no holders")
+		}
+	})
+}
+
+func TestConcurrentAddRoleToUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		authService.CreateUser("busyUser", "password123")
+		roleNames := make([]string, 20)
+		for i := range roleNames {
+			roleNames[i] = fmt.Sprintf("role%d", i)
+			authService.CreateRole(roleNames[i])
+		}
+
+		var wg sync.WaitGroup
+		for _, roleName := range roleNames {
+			// adding each role twice also races the duplicate check
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func(roleName string) {
+					defer wg.Done()
+					assert.Nil(t, authService.AddRoleToUser("busyUser", roleName), "Error should be nil")
+				}(roleName)
+			}
+		}
+		wg.Wait()
+
+		tokenDetails, _ := authService.Authenticate("busyUser", "password123")
+		roles, err := authService.GetAllRoles(tokenDetails.Token)
+		assert.Nil(t, err, "Error should be nil")
+		var got []string
+		for _, role := range roles {
+			got = append(got, role.Name)
+		}
+		assert.ElementsMatch(t, roleNames, got, "Every role should be added exactly once")
+	})
+}
+
+func TestConcurrentCreateUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		authService := NewInMemoryAuthService(newStore())
+		var wg sync.WaitGroup
+		var created atomic.Int32
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if authService.CreateUser("contestedUser", fmt.Sprintf("password%d", i)) == nil {
+					created.Add(1)
+				}
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), created.Load(), "Exactly one creation should succeed")
+	})
 }
@@ -0,0 +1,102 @@
+// auth/sessions.go
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// sessionTouchInterval bounds how often validating a token writes the
+// session's LastUsedAt, so busy sessions don't turn every request into a write
+var sessionTouchInterval = time.Minute
+
+// startSession issues the first token pair of a new session
+func (s *InMemoryAuthService) startSession(ctx context.Context, username string, client ClientInfo) (TokenDetails, error) {
+	family, err := randomToken(16)
+	if err != nil {
+		return TokenDetails{}, err
+	}
+	tokenDetails, err := s.generateTokenPair(ctx, username, family)
+	if err != nil {
+		return TokenDetails{}, err
+	}
+
+	now := time.Now().Unix()
+	err = s.store.SaveSession(ctx, Session{
+		ID:         family,
+		Username:   username,
+		ClientIP:   client.IP,
+		UserAgent:  client.UserAgent,
+		IssuedAt:   now,
+		ExpiresAt:  tokenDetails.RefreshExpiresAt,
+		LastUsedAt: now,
+	})
+	if err != nil {
+		return TokenDetails{}, err
+	}
+	return tokenDetails, nil
+}
+
+// touchSession records that a token of the session was just used. It is best
+// effort: a failure is logged rather than failing the request it came with.
+func (s *InMemoryAuthService) touchSession(sessionID string) {
+	ctx := context.Background()
+	session, err := s.store.GetSession(ctx, sessionID)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(time.Unix(session.LastUsedAt, 0)) < sessionTouchInterval {
+		return
+	}
+	if err := s.store.TouchSession(ctx, sessionID, now.Unix()); err != nil {
+		log.Printf("auth: recording use of session %s: %v", sessionID, err)
+	}
+}
+
+// ListSessions returns the user's sessions that can still be refreshed, oldest first
+func (s *InMemoryAuthService) ListSessions(username string) ([]Session, error) {
+	ctx := context.Background()
+
+	if _, err := s.getUser(ctx, username); err != nil {
+		return nil, err
+	}
+	sessions, err := s.store.ListSessions(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	active := []Session{}
+	for _, session := range sessions {
+		if session.ExpiresAt >= now {
+			active = append(active, session)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if active[i].IssuedAt == active[j].IssuedAt {
+			return active[i].ID < active[j].ID
+		}
+		return active[i].IssuedAt < active[j].IssuedAt
+	})
+	return active, nil
+}
+
+// RevokeSession logs one session of the user out, revoking its access and refresh tokens
+func (s *InMemoryAuthService) RevokeSession(username, sessionID string) error {
+	ctx := context.Background()
+
+	session, err := s.store.GetSession(ctx, sessionID)
+	// someone else's session is reported as missing so ids can't be probed
+	if errors.Is(err, ErrNotFound) || (err == nil && session.Username != username) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return s.store.DeleteRefreshFamily(ctx, sessionID)
+}
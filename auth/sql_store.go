@@ -0,0 +1,762 @@
+// auth/sql_store.go
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SQLDialect selects the placeholder syntax used when talking to the database
+type SQLDialect int
+
+const (
+	// DialectQuestion uses ? placeholders (SQLite, MySQL)
+	DialectQuestion SQLDialect = iota
+	// DialectDollar uses $1, $2, ... placeholders (PostgreSQL)
+	DialectDollar
+)
+
+// sqlMigrations are applied in order and recorded in schema_migrations, so
+// new steps must only ever be appended. The statements stick to types every
+// mainstream database understands.
+var sqlMigrations = [][]string{
+	{
+		`CREATE TABLE users (
+			username VARCHAR(255) NOT NULL PRIMARY KEY,
+			password_hash VARCHAR(255) NOT NULL
+		)`,
+		`CREATE TABLE roles (
+			name VARCHAR(255) NOT NULL PRIMARY KEY
+		)`,
+		// role_name has no foreign key; DeleteRole checks or removes the assignments itself
+		`CREATE TABLE user_roles (
+			username VARCHAR(255) NOT NULL REFERENCES users(username),
+			role_name VARCHAR(255) NOT NULL,
+			position INTEGER NOT NULL,
+			PRIMARY KEY (username, role_name)
+		)`,
+		// tokens are keyed by their SHA-256 so a leaked table holds no usable tokens
+		`CREATE TABLE tokens (
+			token_hash CHAR(64) NOT NULL PRIMARY KEY,
+			username VARCHAR(255) NOT NULL
+		)`,
+	},
+	{
+		`CREATE TABLE refresh_tokens (
+			token_hash CHAR(64) NOT NULL PRIMARY KEY,
+			username VARCHAR(255) NOT NULL,
+			family VARCHAR(64) NOT NULL,
+			access_token_hash CHAR(64) NOT NULL,
+			expires_at BIGINT NOT NULL,
+			used INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX refresh_tokens_family ON refresh_tokens (family)`,
+	},
+	{
+		`CREATE INDEX tokens_username ON tokens (username)`,
+		`CREATE INDEX refresh_tokens_username ON refresh_tokens (username)`,
+	},
+	{
+		`CREATE TABLE sessions (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			username VARCHAR(255) NOT NULL,
+			client_ip VARCHAR(64) NOT NULL,
+			user_agent VARCHAR(512) NOT NULL,
+			issued_at BIGINT NOT NULL,
+			expires_at BIGINT NOT NULL,
+			last_used_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX sessions_username ON sessions (username)`,
+	},
+	{
+		// zero marks tokens saved before expiry was tracked; they are never swept
+		`ALTER TABLE tokens ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0`,
+		`CREATE INDEX tokens_expires_at ON tokens (expires_at)`,
+		`CREATE INDEX refresh_tokens_expires_at ON refresh_tokens (expires_at)`,
+		`CREATE INDEX sessions_expires_at ON sessions (expires_at)`,
+	},
+	{
+		`CREATE TABLE role_permissions (
+			role_name VARCHAR(255) NOT NULL REFERENCES roles(name),
+			permission VARCHAR(255) NOT NULL,
+			position INTEGER NOT NULL,
+			PRIMARY KEY (role_name, permission)
+		)`,
+	},
+	{
+		// child_name has no foreign key, like user_roles.role_name
+		`CREATE TABLE role_children (
+			parent_name VARCHAR(255) NOT NULL REFERENCES roles(name),
+			child_name VARCHAR(255) NOT NULL,
+			position INTEGER NOT NULL,
+			PRIMARY KEY (parent_name, child_name)
+		)`,
+	},
+	{
+		`CREATE INDEX user_roles_role_name ON user_roles (role_name)`,
+		`CREATE INDEX role_children_child_name ON role_children (child_name)`,
+	},
+}
+
+var _ Store = (*SQLStore)(nil)
+
+// SQLStore is a Store on top of database/sql. It works with any driver; call
+// Migrate once before use to create or upgrade the schema.
+type SQLStore struct {
+	db      *sql.DB
+	dialect SQLDialect
+}
+
+// NewSQLStore wraps an open database handle
+func NewSQLStore(db *sql.DB, dialect SQLDialect) *SQLStore {
+	return &SQLStore{db: db, dialect: dialect}
+}
+
+// Migrate brings the schema up to date, applying each pending step in its own transaction
+func (s *SQLStore) Migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	var current int
+	row := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`)
+	if err := row.Scan(&current); err != nil {
+		return err
+	}
+
+	for version := current + 1; version <= len(sqlMigrations); version++ {
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			for _, statement := range sqlMigrations[version-1] {
+				if _, err := tx.ExecContext(ctx, statement); err != nil {
+					return fmt.Errorf("migration %d: %w", version, err)
+				}
+			}
+			_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebind rewrites ? placeholders for the store's dialect
+func (s *SQLStore) rebind(query string) string {
+	if s.dialect != DialectDollar {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *SQLStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) userExists(ctx context.Context, tx *sql.Tx, username string) (bool, error) {
+	var found int
+	err := tx.QueryRowContext(ctx, s.rebind(`SELECT 1 FROM users WHERE username = ?`), username).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *SQLStore) insertUserRoles(ctx context.Context, tx *sql.Tx, user User) error {
+	for i, role := range user.Roles {
+		_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO user_roles (username, role_name, position) VALUES (?, ?, ?)`),
+			user.Username, role.Name, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) CreateUser(ctx context.Context, user User) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		exists, err := s.userExists(ctx, tx, user.Username)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrAlreadyExists
+		}
+		_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO users (username, password_hash) VALUES (?, ?)`),
+			user.Username, user.Password)
+		if err != nil {
+			return err
+		}
+		return s.insertUserRoles(ctx, tx, user)
+	})
+}
+
+func (s *SQLStore) GetUser(ctx context.Context, username string) (User, error) {
+	return s.loadUser(ctx, s.db, username)
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *SQLStore) loadUser(ctx context.Context, q queryer, username string) (User, error) {
+	user := User{Username: username}
+	err := q.QueryRowContext(ctx, s.rebind(`SELECT password_hash FROM users WHERE username = ?`), username).Scan(&user.Password)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	rows, err := q.QueryContext(ctx, s.rebind(`SELECT role_name FROM user_roles WHERE username = ? ORDER BY position`), username)
+	if err != nil {
+		return User{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.Name); err != nil {
+			return User{}, err
+		}
+		user.Roles = append(user.Roles, role)
+	}
+	return user, rows.Err()
+}
+
+func (s *SQLStore) UpdateUser(ctx context.Context, user User) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		exists, err := s.userExists(ctx, tx, user.Username)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+		return s.writeUser(ctx, tx, user)
+	})
+}
+
+func (s *SQLStore) ModifyUser(ctx context.Context, username string, fn func(user *User) error) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.modifyUser(ctx, tx, username, fn)
+	})
+}
+
+func (s *SQLStore) ModifyUserRevokingTokens(ctx context.Context, username string, fn func(user *User) error) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.modifyUser(ctx, tx, username, fn); err != nil {
+			return err
+		}
+		return s.deleteUserTokens(ctx, tx, username)
+	})
+}
+
+func (s *SQLStore) modifyUser(ctx context.Context, tx *sql.Tx, username string, fn func(user *User) error) error {
+	// a no-op write takes the row lock up front, so concurrent
+	// modifications queue here instead of overwriting each other
+	result, err := tx.ExecContext(ctx, s.rebind(`UPDATE users SET password_hash = password_hash WHERE username = ?`), username)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+
+	user, err := s.loadUser(ctx, tx, username)
+	if err != nil {
+		return err
+	}
+	if err := fn(&user); err != nil {
+		return err
+	}
+	user.Username = username
+	return s.writeUser(ctx, tx, user)
+}
+
+func (s *SQLStore) writeUser(ctx context.Context, tx *sql.Tx, user User) error {
+	_, err := tx.ExecContext(ctx, s.rebind(`UPDATE users SET password_hash = ? WHERE username = ?`),
+		user.Password, user.Username)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM user_roles WHERE username = ?`), user.Username); err != nil {
+		return err
+	}
+	return s.insertUserRoles(ctx, tx, user)
+}
+
+func (s *SQLStore) AddUserRole(ctx context.Context, username, roleName string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		locked, err := s.lockRole(ctx, tx, roleName)
+		if err != nil {
+			return err
+		}
+		if !locked {
+			return ErrNotFound
+		}
+		return s.modifyUser(ctx, tx, username, func(user *User) error {
+			user.Roles = withRole(user.Roles, roleName)
+			return nil
+		})
+	})
+}
+
+func (s *SQLStore) DeleteUser(ctx context.Context, username string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.deleteUserTokens(ctx, tx, username); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM user_roles WHERE username = ?`), username); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM users WHERE username = ?`), username)
+		return err
+	})
+}
+
+func (s *SQLStore) CreateRole(ctx context.Context, role Role) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var found int
+		err := tx.QueryRowContext(ctx, s.rebind(`SELECT 1 FROM roles WHERE name = ?`), role.Name).Scan(&found)
+		if err == nil {
+			return ErrAlreadyExists
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO roles (name) VALUES (?)`), role.Name); err != nil {
+			return err
+		}
+		return s.insertRoleDetails(ctx, tx, role)
+	})
+}
+
+func (s *SQLStore) GetRole(ctx context.Context, roleName string) (Role, error) {
+	return s.loadRole(ctx, s.db, roleName)
+}
+
+func (s *SQLStore) loadRole(ctx context.Context, q queryer, roleName string) (Role, error) {
+	var role Role
+	err := q.QueryRowContext(ctx, s.rebind(`SELECT name FROM roles WHERE name = ?`), roleName).Scan(&role.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Role{}, ErrNotFound
+	}
+	if err != nil {
+		return Role{}, err
+	}
+
+	rows, err := q.QueryContext(ctx, s.rebind(`SELECT permission FROM role_permissions WHERE role_name = ? ORDER BY position`), roleName)
+	if err != nil {
+		return Role{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return Role{}, err
+		}
+		role.Ability = append(role.Ability, permission)
+	}
+	if err := rows.Err(); err != nil {
+		return Role{}, err
+	}
+
+	children, err := q.QueryContext(ctx, s.rebind(`SELECT child_name FROM role_children WHERE parent_name = ? ORDER BY position`), roleName)
+	if err != nil {
+		return Role{}, err
+	}
+	defer children.Close()
+	for children.Next() {
+		var child string
+		if err := children.Scan(&child); err != nil {
+			return Role{}, err
+		}
+		role.Children = append(role.Children, child)
+	}
+	return role, children.Err()
+}
+
+func (s *SQLStore) ModifyRole(ctx context.Context, roleName string, fn func(role *Role) error) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		// lock the row first, as ModifyUser does
+		result, err := tx.ExecContext(ctx, s.rebind(`UPDATE roles SET name = name WHERE name = ?`), roleName)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return ErrNotFound
+		}
+
+		role, err := s.loadRole(ctx, tx, roleName)
+		if err != nil {
+			return err
+		}
+		if err := fn(&role); err != nil {
+			return err
+		}
+		role.Name = roleName
+		if err := s.deleteRoleDetails(ctx, tx, roleName); err != nil {
+			return err
+		}
+		return s.insertRoleDetails(ctx, tx, role)
+	})
+}
+
+// insertRoleDetails writes the role's permissions and children
+func (s *SQLStore) insertRoleDetails(ctx context.Context, tx *sql.Tx, role Role) error {
+	for i, permission := range role.Ability {
+		_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO role_permissions (role_name, permission, position) VALUES (?, ?, ?)`),
+			role.Name, permission, i)
+		if err != nil {
+			return err
+		}
+	}
+	for i, child := range role.Children {
+		_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO role_children (parent_name, child_name, position) VALUES (?, ?, ?)`),
+			role.Name, child, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRoleDetails removes the rows insertRoleDetails writes
+func (s *SQLStore) deleteRoleDetails(ctx context.Context, tx *sql.Tx, roleName string) error {
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM role_permissions WHERE role_name = ?`), roleName); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM role_children WHERE parent_name = ?`), roleName)
+	return err
+}
+
+// lockRole takes the role's row lock with a no-op write, so that assigning
+// the role and deleting it queue behind each other. It reports whether the
+// role exists.
+func (s *SQLStore) lockRole(ctx context.Context, tx *sql.Tx, roleName string) (bool, error) {
+	result, err := tx.ExecContext(ctx, s.rebind(`UPDATE roles SET name = name WHERE name = ?`), roleName)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *SQLStore) DeleteRole(ctx context.Context, roleName string, cascade bool) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := s.lockRole(ctx, tx, roleName); err != nil {
+			return err
+		}
+		if cascade {
+			if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM user_roles WHERE role_name = ?`), roleName); err != nil {
+				return err
+			}
+		} else {
+			var held int
+			err := tx.QueryRowContext(ctx, s.rebind(`SELECT 1 FROM user_roles WHERE role_name = ? LIMIT 1`), roleName).Scan(&held)
+			if err == nil {
+				return ErrInUse
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+		if err := s.deleteRoleDetails(ctx, tx, roleName); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM role_children WHERE child_name = ?`), roleName); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM roles WHERE name = ?`), roleName)
+		return err
+	})
+}
+
+func (s *SQLStore) ListRoleUsers(ctx context.Context, roleName string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT username FROM user_roles WHERE role_name = ? ORDER BY username`), roleName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usernames := []string{}
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+func (s *SQLStore) SaveToken(ctx context.Context, token, username string, expiresAt int64) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.saveToken(ctx, tx, token, username, expiresAt)
+	})
+}
+
+func (s *SQLStore) saveToken(ctx context.Context, tx *sql.Tx, token, username string, expiresAt int64) error {
+	hash := hashToken(token)
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM tokens WHERE token_hash = ?`), hash); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO tokens (token_hash, username, expires_at) VALUES (?, ?, ?)`), hash, username, expiresAt)
+	return err
+}
+
+func (s *SQLStore) GetToken(ctx context.Context, token string) (string, error) {
+	var username string
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT username FROM tokens WHERE token_hash = ?`), hashToken(token)).Scan(&username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return username, err
+}
+
+func (s *SQLStore) DeleteToken(ctx context.Context, token string) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM tokens WHERE token_hash = ?`), hashToken(token))
+	return err
+}
+
+func (s *SQLStore) DeleteUserTokens(ctx context.Context, username string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.deleteUserTokens(ctx, tx, username)
+	})
+}
+
+func (s *SQLStore) deleteUserTokens(ctx context.Context, tx *sql.Tx, username string) error {
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM tokens WHERE username = ?`), username); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM refresh_tokens WHERE username = ?`), username); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM sessions WHERE username = ?`), username)
+	return err
+}
+
+func (s *SQLStore) SaveRefreshToken(ctx context.Context, token string, refresh RefreshToken) error {
+	return s.saveRefreshToken(ctx, s.db, token, refresh)
+}
+
+func (s *SQLStore) saveRefreshToken(ctx context.Context, e execer, token string, refresh RefreshToken) error {
+	_, err := e.ExecContext(ctx, s.rebind(`INSERT INTO refresh_tokens (token_hash, username, family, access_token_hash, expires_at, used) VALUES (?, ?, ?, ?, ?, ?)`),
+		hashToken(token), refresh.Username, refresh.Family, hashToken(refresh.AccessToken), refresh.ExpiresAt, boolToInt(refresh.Used))
+	return err
+}
+
+// GetRefreshToken returns the record without AccessToken, since only its digest is stored
+func (s *SQLStore) GetRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	var refresh RefreshToken
+	var used int
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT username, family, expires_at, used FROM refresh_tokens WHERE token_hash = ?`), hashToken(token)).
+		Scan(&refresh.Username, &refresh.Family, &refresh.ExpiresAt, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrNotFound
+	}
+	refresh.Used = used != 0
+	return refresh, err
+}
+
+// UseRefreshToken returns the record without AccessToken, since only its digest is stored
+func (s *SQLStore) UseRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	var refresh RefreshToken
+	hash := hashToken(token)
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var used int
+		err := tx.QueryRowContext(ctx, s.rebind(`SELECT username, family, expires_at, used FROM refresh_tokens WHERE token_hash = ?`), hash).
+			Scan(&refresh.Username, &refresh.Family, &refresh.ExpiresAt, &used)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		refresh.Used = used != 0
+		if refresh.Used {
+			return nil
+		}
+		// the used = 0 guard makes the flip a compare-and-swap even under
+		// isolation levels that let two transactions read the same row
+		result, err := tx.ExecContext(ctx, s.rebind(`UPDATE refresh_tokens SET used = 1 WHERE token_hash = ? AND used = 0`), hash)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		refresh.Used = affected == 0
+		return nil
+	})
+	return refresh, err
+}
+
+func (s *SQLStore) RenewSession(ctx context.Context, token string, refresh RefreshToken, accessExpiresAt, usedAt int64) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		// updating the session first takes its row lock, so a concurrent
+		// revocation either finds the new tokens or has removed the session
+		result, err := tx.ExecContext(ctx, s.rebind(`UPDATE sessions SET expires_at = ?, last_used_at = ? WHERE id = ? AND username = ?`),
+			refresh.ExpiresAt, usedAt, refresh.Family, refresh.Username)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return ErrNotFound
+		}
+		var found int
+		err = tx.QueryRowContext(ctx, s.rebind(`SELECT 1 FROM refresh_tokens WHERE family = ? LIMIT 1`), refresh.Family).Scan(&found)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.saveToken(ctx, tx, refresh.AccessToken, refresh.Username, accessExpiresAt); err != nil {
+			return err
+		}
+		return s.saveRefreshToken(ctx, tx, token, refresh)
+	})
+}
+
+func (s *SQLStore) DeleteRefreshFamily(ctx context.Context, family string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM tokens WHERE token_hash IN (SELECT access_token_hash FROM refresh_tokens WHERE family = ?)`), family)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.rebind(`DELETE FROM refresh_tokens WHERE family = ?`), family)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.rebind(`DELETE FROM sessions WHERE id = ?`), family)
+		return err
+	})
+}
+
+const sessionColumns = `id, username, client_ip, user_agent, issued_at, expires_at, last_used_at`
+
+func (s *SQLStore) SaveSession(ctx context.Context, session Session) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM sessions WHERE id = ?`), session.ID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO sessions (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+			session.ID, session.Username, session.ClientIP, session.UserAgent, session.IssuedAt, session.ExpiresAt, session.LastUsedAt)
+		return err
+	})
+}
+
+func (s *SQLStore) GetSession(ctx context.Context, id string) (Session, error) {
+	var session Session
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`), id).
+		Scan(&session.ID, &session.Username, &session.ClientIP, &session.UserAgent, &session.IssuedAt, &session.ExpiresAt, &session.LastUsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrNotFound
+	}
+	return session, err
+}
+
+func (s *SQLStore) ListSessions(ctx context.Context, username string) ([]Session, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT `+sessionColumns+` FROM sessions WHERE username = ?`), username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.ID, &session.Username, &session.ClientIP, &session.UserAgent, &session.IssuedAt, &session.ExpiresAt, &session.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLStore) TouchSession(ctx context.Context, id string, lastUsedAt int64) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`UPDATE sessions SET last_used_at = ? WHERE id = ? AND last_used_at < ?`),
+		lastUsedAt, id, lastUsedAt)
+	return err
+}
+
+func (s *SQLStore) DeleteExpired(ctx context.Context, now int64) (SweepResult, error) {
+	var result SweepResult
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, sweep := range []struct {
+			query string
+			count *int
+		}{
+			{`DELETE FROM tokens WHERE expires_at > 0 AND expires_at < ?`, &result.AccessTokens},
+			{`DELETE FROM refresh_tokens WHERE expires_at > 0 AND expires_at < ?`, &result.RefreshTokens},
+			{`DELETE FROM sessions WHERE expires_at > 0 AND expires_at < ?`, &result.Sessions},
+		} {
+			res, err := tx.ExecContext(ctx, s.rebind(sweep.query), now)
+			if err != nil {
+				return err
+			}
+			affected, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			*sweep.count = int(affected)
+		}
+		return nil
+	})
+	if err != nil {
+		return SweepResult{}, err
+	}
+	return result, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// hashToken is the digest SQLStore and FileStore keep in place of a token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
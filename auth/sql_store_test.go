@@ -0,0 +1,125 @@
+// auth/sql_store_test.go
+
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	_ "modernc.org/sqlite"
+)
+
+func openTestSQLStore(t *testing.T) *SQLStore {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	// every connection to :memory: is a separate database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	store := NewSQLStore(db, DialectQuestion)
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	return store
+}
+
+func TestSQLStoreMigrateIsIdempotent(t *testing.T) {
+	store := openTestSQLStore(t)
+	assert.Nil(t, store.Migrate(context.Background()), "Running migrations twice should be a no-op")
+
+	var version int
+	err := store.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	assert.Nil(t, err)
+	assert.Equal(t, len(sqlMigrations), version)
+}
+
+func TestSQLStoreUserRoles(t *testing.T) {
+	ctx := context.Background()
+	store := openTestSQLStore(t)
+
+	assert.Nil(t, store.CreateUser(ctx, User{Username: "sqlUser", Password: "hash"}))
+	assert.Equal(t, ErrAlreadyExists, store.CreateUser(ctx, User{Username: "sqlUser"}))
+
+	roles := []Role{{Name: "b"}, {Name: "a"}, {Name: "c"}}
+	assert.Nil(t, store.UpdateUser(ctx, User{Username: "sqlUser", Password: "hash", Roles: roles}))
+	user, err := store.GetUser(ctx, "sqlUser")
+	assert.Nil(t, err)
+	assert.Equal(t, roles, user.Roles, "Roles should come back in assignment order")
+
+	assert.Equal(t, ErrNotFound, store.UpdateUser(ctx, User{Username: "missing"}))
+
+	usernames, err := store.ListRoleUsers(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sqlUser"}, usernames)
+
+	assert.Equal(t, ErrNotFound, store.AddUserRole(ctx, "sqlUser", "d"), "A missing role should not be assigned")
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "d"}))
+	assert.Nil(t, store.AddUserRole(ctx, "sqlUser", "d"))
+	assert.Nil(t, store.AddUserRole(ctx, "sqlUser", "d"), "Assigning a held role again should do nothing")
+	assert.Nil(t, store.DeleteRole(ctx, "d", true))
+
+	assert.Equal(t, ErrInUse, store.DeleteRole(ctx, "b", false), "A held role should not be deleted without cascade")
+	assert.Nil(t, store.DeleteRole(ctx, "b", true))
+	user, _ = store.GetUser(ctx, "sqlUser")
+	assert.Equal(t, []Role{{Name: "a"}, {Name: "c"}}, user.Roles, "Deleting a role should take it away from its holders")
+
+	assert.Nil(t, store.DeleteUser(ctx, "sqlUser"))
+	_, err = store.GetUser(ctx, "sqlUser")
+	assert.Equal(t, ErrNotFound, err)
+	var leftover int
+	assert.Nil(t, store.db.QueryRow(`SELECT COUNT(*) FROM user_roles`).Scan(&leftover))
+	assert.Equal(t, 0, leftover, "Deleting a user should drop their role assignments")
+}
+
+func TestSQLStoreRolePermissions(t *testing.T) {
+	ctx := context.Background()
+	store := openTestSQLStore(t)
+
+	assert.Nil(t, store.CreateRole(ctx, Role{Name: "clerk", Ability: []string{"orders:write", "orders:read"}, Children: []string{"viewer"}}))
+	role, err := store.GetRole(ctx, "clerk")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"orders:write", "orders:read"}, role.Ability, "Permissions should come back in order")
+	assert.Equal(t, []string{"viewer"}, role.Children, "Children should be stored with the role")
+
+	assert.Nil(t, store.ModifyRole(ctx, "clerk", func(role *Role) error {
+		role.Ability = role.Ability[1:]
+		return nil
+	}))
+	role, _ = store.GetRole(ctx, "clerk")
+	assert.Equal(t, []string{"orders:read"}, role.Ability)
+	assert.Equal(t, ErrNotFound, store.ModifyRole(ctx, "missing", func(role *Role) error { return nil }))
+
+	assert.Nil(t, store.DeleteRole(ctx, "clerk", true))
+	var leftover int
+	assert.Nil(t, store.db.QueryRow(`SELECT COUNT(*) FROM role_permissions`).Scan(&leftover))
+	assert.Equal(t, 0, leftover, "Deleting a role should drop its permissions")
+	assert.Nil(t, store.db.QueryRow(`SELECT COUNT(*) FROM role_children`).Scan(&leftover))
+	assert.Equal(t, 0, leftover, "Deleting a role should drop its links to its children")
+}
+
+func TestSQLStoreTokensAreHashed(t *testing.T) {
+	ctx := context.Background()
+	store := openTestSQLStore(t)
+
+	assert.Nil(t, store.SaveToken(ctx, "raw-token", "sqlUser", 0))
+	username, err := store.GetToken(ctx, "raw-token")
+	assert.Nil(t, err)
+	assert.Equal(t, "sqlUser", username)
+
+	var stored string
+	assert.Nil(t, store.db.QueryRow(`SELECT token_hash FROM tokens`).Scan(&stored))
+	assert.NotEqual(t, "raw-token", stored, "Raw tokens should never be written to the database")
+
+	assert.Nil(t, store.DeleteToken(ctx, "raw-token"))
+	_, err = store.GetToken(ctx, "raw-token")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSQLRebind(t *testing.T) {
+	store := &SQLStore{dialect: DialectDollar}
+	assert.Equal(t, "SELECT a FROM t WHERE b = $1 AND c = $2", store.rebind("SELECT a FROM t WHERE b = ? AND c = ?"))
+}
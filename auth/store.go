@@ -0,0 +1,139 @@
+// auth/store.go
+
+package auth
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrNotFound is returned by a Store when the requested record does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists is returned by a Store when a record with the same key is already stored
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrInUse is returned by a Store refusing to delete a record others still refer to
+	ErrInUse = errors.New("still in use")
+)
+
+// Store is the persistence layer behind an AuthService. Implementations must be
+// safe for concurrent use.
+type Store interface {
+	UserStore
+	RoleStore
+	TokenStore
+	RefreshTokenStore
+	SessionStore
+	ExpiringStore
+}
+
+// UserStore keeps users keyed by username
+type UserStore interface {
+	// CreateUser stores a new user, returning ErrAlreadyExists if the username is taken
+	CreateUser(ctx context.Context, user User) error
+	// GetUser returns the user, or ErrNotFound
+	GetUser(ctx context.Context, username string) (User, error)
+	// UpdateUser replaces an existing user, returning ErrNotFound if it is missing
+	UpdateUser(ctx context.Context, user User) error
+	// ModifyUser atomically applies fn to the stored user, returning
+	// ErrNotFound if it is missing. An error from fn leaves the user
+	// unchanged and is returned as is. fn must not call back into the store.
+	ModifyUser(ctx context.Context, username string, fn func(user *User) error) error
+	// ModifyUserRevokingTokens is ModifyUser that also forgets every access
+	// and refresh token and every session of the user in the same step, so
+	// that a change such as a new password cannot leave old tokens live
+	ModifyUserRevokingTokens(ctx context.Context, username string, fn func(user *User) error) error
+	// AddUserRole assigns the role to the user unless they already hold it,
+	// returning ErrNotFound if the user or the role is missing. The role is
+	// looked up in the same step, so a concurrent DeleteRole cannot leave
+	// the user holding a deleted role.
+	AddUserRole(ctx context.Context, username, roleName string) error
+	// DeleteUser removes the user together with every access and refresh
+	// token issued to them; deleting a missing user is not an error
+	DeleteUser(ctx context.Context, username string) error
+}
+
+// RoleStore keeps roles keyed by name
+type RoleStore interface {
+	// CreateRole stores a new role, returning ErrAlreadyExists if the name is taken
+	CreateRole(ctx context.Context, role Role) error
+	// GetRole returns the role, or ErrNotFound
+	GetRole(ctx context.Context, roleName string) (Role, error)
+	// ModifyRole atomically applies fn to the stored role, returning
+	// ErrNotFound if it is missing. An error from fn leaves the role
+	// unchanged and is returned as is. fn must not call back into the store.
+	ModifyRole(ctx context.Context, roleName string, fn func(role *Role) error) error
+	// DeleteRole removes the role and takes it out of every role including
+	// it. With cascade it is also taken away from every user holding it;
+	// without, ErrInUse is returned while any user holds it, checked in the
+	// same step as the delete. Deleting a missing role is not an error.
+	DeleteRole(ctx context.Context, roleName string, cascade bool) error
+	// ListRoleUsers returns the usernames the role is assigned to, sorted
+	ListRoleUsers(ctx context.Context, roleName string) ([]string, error)
+}
+
+// TokenStore keeps the issued tokens that are still considered live
+type TokenStore interface {
+	// SaveToken records a token issued to username that expires at the given
+	// Unix time; zero means the store never expires it on its own
+	SaveToken(ctx context.Context, token, username string, expiresAt int64) error
+	// GetToken returns the username the token was issued to, or ErrNotFound
+	GetToken(ctx context.Context, token string) (string, error)
+	// DeleteToken forgets the token; deleting a missing token is not an error
+	DeleteToken(ctx context.Context, token string) error
+	// DeleteUserTokens forgets every access and refresh token and every session of username
+	DeleteUserTokens(ctx context.Context, username string) error
+}
+
+// RefreshTokenStore keeps refresh tokens grouped by family
+type RefreshTokenStore interface {
+	// SaveRefreshToken records a newly issued refresh token
+	SaveRefreshToken(ctx context.Context, token string, refresh RefreshToken) error
+	// GetRefreshToken returns the record without marking it used, or ErrNotFound
+	GetRefreshToken(ctx context.Context, token string) (RefreshToken, error)
+	// UseRefreshToken atomically marks the token as used and returns the record
+	// as it was before, so exactly one caller ever sees Used == false.
+	// Returns ErrNotFound for unknown tokens.
+	UseRefreshToken(ctx context.Context, token string) (RefreshToken, error)
+	// RenewSession stores the refresh token issued in exchange for an earlier
+	// one of the same family, together with the access token it carries,
+	// which expires at accessExpiresAt. The family's session moves to the
+	// refresh token's expiry and is marked used at usedAt. All of it happens
+	// in one step, and only while the family and its session are still
+	// there: ErrNotFound is returned, and nothing stored, once they were
+	// revoked or the user was deleted or had their tokens revoked.
+	RenewSession(ctx context.Context, token string, refresh RefreshToken, accessExpiresAt, usedAt int64) error
+	// DeleteRefreshFamily removes every refresh token of the family together
+	// with the access tokens that were issued with them and the session
+	// sharing the family's ID
+	DeleteRefreshFamily(ctx context.Context, family string) error
+}
+
+// SessionStore keeps session metadata. Sessions are removed along with their
+// refresh token family or their user's tokens.
+type SessionStore interface {
+	// SaveSession creates or replaces a session
+	SaveSession(ctx context.Context, session Session) error
+	// GetSession returns the session, or ErrNotFound
+	GetSession(ctx context.Context, id string) (Session, error)
+	// ListSessions returns every stored session of username, in no particular order
+	ListSessions(ctx context.Context, username string) ([]Session, error)
+	// TouchSession moves the session's LastUsedAt forward to lastUsedAt. It
+	// never recreates a session that was removed in the meantime.
+	TouchSession(ctx context.Context, id string, lastUsedAt int64) error
+}
+
+// SweepResult counts the records removed by one DeleteExpired call
+type SweepResult struct {
+	AccessTokens  int
+	RefreshTokens int
+	Sessions      int
+}
+
+// ExpiringStore drops records that have outlived their expiry. Stores do not
+// hide expired records by themselves; something has to call DeleteExpired.
+type ExpiringStore interface {
+	// DeleteExpired removes the access tokens, refresh tokens and sessions
+	// that expired before the Unix time now
+	DeleteExpired(ctx context.Context, now int64) (SweepResult, error)
+}
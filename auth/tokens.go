@@ -3,70 +3,287 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var tokenDuration = 2 * time.Hour
+var tokenDuration = 15 * time.Minute
 
-var jwtKey = []byte("your-secret-key") // This should ideally be more secure and not hardcoded
+var refreshTokenDuration = 7 * 24 * time.Hour
 
-// GenerateToken generates a JWT for the given user
-func GenerateToken(username string) (TokenDetails, error) {
-	expirationTime := time.Now().Add(tokenDuration).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// GenerateToken generates a JWT for the given user, together with a refresh
+// token that starts a new family and session
+func (s *InMemoryAuthService) GenerateToken(username string) (TokenDetails, error) {
+	return s.startSession(context.Background(), username, ClientInfo{})
+}
+
+func (s *InMemoryAuthService) generateTokenPair(ctx context.Context, username, family string) (TokenDetails, error) {
+	tokenDetails, refresh, err := s.signTokenPair(username, family)
+	if err != nil {
+		return TokenDetails{}, err
+	}
+	if err := s.store.SaveToken(ctx, tokenDetails.Token, username, tokenDetails.ExpiresAt); err != nil {
+		return TokenDetails{}, err
+	}
+	if err := s.store.SaveRefreshToken(ctx, tokenDetails.RefreshToken, refresh); err != nil {
+		return TokenDetails{}, err
+	}
+	return tokenDetails, nil
+}
+
+// signTokenPair issues a token pair of the family without storing it
+func (s *InMemoryAuthService) signTokenPair(username, family string) (TokenDetails, RefreshToken, error) {
+	tokenID, err := randomToken(16)
+	if err != nil {
+		return TokenDetails{}, RefreshToken{}, err
+	}
+	now := time.Now()
+	expirationTime := now.Add(tokenDuration).Unix()
+	tokenString, err := s.keys.Sign(jwt.MapClaims{
 		"user": username,
+		"iat":  now.Unix(),
 		"exp":  expirationTime,
+		"jti":  tokenID, // keeps two tokens issued in the same second distinct
+		"sid":  family,
 	})
-	tokenString, err := token.SignedString(jwtKey)
+	if err != nil {
+		return TokenDetails{}, RefreshToken{}, err
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return TokenDetails{}, RefreshToken{}, err
+	}
+	refreshExpirationTime := time.Now().Add(refreshTokenDuration).Unix()
+
+	return TokenDetails{
+		Token:            tokenString,
+		ExpiresAt:        expirationTime,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpirationTime,
+	}, RefreshToken{
+		Username:    username,
+		Family:      family,
+		AccessToken: tokenString,
+		ExpiresAt:   refreshExpirationTime,
+	}, nil
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token.
+// Each refresh token works once; presenting one that was already exchanged
+// means it leaked, so the whole family it belongs to is revoked.
+func (s *InMemoryAuthService) RefreshToken(refreshToken string) (TokenDetails, error) {
+	ctx := context.Background()
+
+	refresh, err := s.store.UseRefreshToken(ctx, refreshToken)
+	if errors.Is(err, ErrNotFound) {
+		return TokenDetails{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return TokenDetails{}, err
+	}
+	if refresh.Used {
+		if err := s.store.DeleteRefreshFamily(ctx, refresh.Family); err != nil {
+			return TokenDetails{}, err
+		}
+		return TokenDetails{}, ErrRefreshTokenReused
+	}
+	if refresh.ExpiresAt < time.Now().Unix() {
+		return TokenDetails{}, ErrRefreshTokenExpired
+	}
+	tokenDetails, next, err := s.signTokenPair(refresh.Username, refresh.Family)
+	if err != nil {
+		return TokenDetails{}, err
+	}
+	// the session may have been revoked since the token was used, and the
+	// new pair must not bring it back
+	err = s.store.RenewSession(ctx, tokenDetails.RefreshToken, next, tokenDetails.ExpiresAt, time.Now().Unix())
+	if errors.Is(err, ErrNotFound) {
+		return TokenDetails{}, ErrInvalidRefreshToken
+	}
 	if err != nil {
 		return TokenDetails{}, err
 	}
-	Tokens.Set(tokenString, username)
-	return TokenDetails{Token: tokenString, ExpiresAt: expirationTime}, nil
+	return tokenDetails, nil
 }
 
 // ValidateToken checks the given token's validity
-func ValidateToken(tokenString string) (string, error) {
-	_, ok := Tokens.Get(tokenString)
+func (s *InMemoryAuthService) ValidateToken(tokenString string) (string, error) {
+	claims, err := s.validateClaims(tokenString)
+	if err != nil {
+		return "", err
+	}
+
+	username, ok := claims["user"].(string)
 	if !ok {
-		return "", errors.New("invalid token")
+		return "", fmt.Errorf("%w: no user claim", ErrInvalidToken)
 	}
-	claims := jwt.MapClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
-	//fmt.Println(token, " hello ", err)
 
+	return username, nil
+}
+
+// validateClaims checks the token is live in the store and correctly signed,
+// returning its claims
+func (s *InMemoryAuthService) validateClaims(tokenString string) (jwt.MapClaims, error) {
+	_, err := s.store.GetToken(context.Background(), tokenString)
+	if errors.Is(err, ErrNotFound) {
+		// stores may drop tokens right at their expiry, so tell an expired
+		// token apart from a revoked or unknown one
+		if _, err := jwt.Parse(tokenString, s.keys.Keyfunc); errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, ErrTokenExpired
+		}
+		return nil, ErrInvalidToken
+	}
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, s.keys.Keyfunc)
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, ErrTokenExpired
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
 	}
 
 	if !token.Valid {
-		return "", errors.New("invalid token")
+		return nil, ErrInvalidToken
 	}
 	exp, ok := claims["exp"].(float64)
 	if !ok {
-		return "", errors.New("invalid token claims exp")
+		return nil, fmt.Errorf("%w: no exp claim", ErrInvalidToken)
 	}
 	if int64(exp) < time.Now().Unix() {
-		InvalidateToken(tokenString)
-		return "", errors.New("token expired here")
+		s.InvalidateToken(tokenString)
+		return nil, ErrTokenExpired
 	}
 
-	username, ok := claims["user"].(string)
-	if !ok {
-		return "", errors.New("invalid token claims username")
+	if sessionID, ok := claims["sid"].(string); ok {
+		s.touchSession(sessionID)
+	}
+	return claims, nil
+}
+
+// AddIntrospectionClient allows clientID to introspect tokens, authenticating
+// with secret
+func (s *InMemoryAuthService) AddIntrospectionClient(clientID, secret string) {
+	s.introspectionClients.Set(clientID, sha256.Sum256([]byte(secret)))
+}
+
+// AuthenticateIntrospectionClient reports whether secret is the secret of
+// the introspection client clientID
+func (s *InMemoryAuthService) AuthenticateIntrospectionClient(clientID, secret string) bool {
+	want, exists := s.introspectionClients.Get(clientID)
+	got := sha256.Sum256([]byte(secret))
+	// compare even for unknown clients so timing does not reveal valid ids
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1 && exists
+}
+
+// IntrospectToken reports whether an access or refresh token is currently
+// active, consulting the store so revoked tokens show as inactive. Only
+// failures to reach the store are returned as errors.
+func (s *InMemoryAuthService) IntrospectToken(tokenString string) (TokenIntrospection, error) {
+	ctx := context.Background()
+	inactive := TokenIntrospection{Active: false}
+
+	var result TokenIntrospection
+	var username string
+	if claims, err := s.validateClaims(tokenString); err == nil {
+		username, _ = claims["user"].(string)
+		result = TokenIntrospection{TokenType: "access_token"}
+		if exp, ok := claims["exp"].(float64); ok {
+			result.ExpiresAt = int64(exp)
+		}
+		if iat, ok := claims["iat"].(float64); ok {
+			result.IssuedAt = int64(iat)
+		}
+		result.TokenID, _ = claims["jti"].(string)
+	} else {
+		refresh, err := s.store.GetRefreshToken(ctx, tokenString)
+		if errors.Is(err, ErrNotFound) {
+			return inactive, nil
+		}
+		if err != nil {
+			return TokenIntrospection{}, err
+		}
+		if refresh.Used || refresh.ExpiresAt < time.Now().Unix() {
+			return inactive, nil
+		}
+		username = refresh.Username
+		result = TokenIntrospection{TokenType: "refresh_token", ExpiresAt: refresh.ExpiresAt}
 	}
 
-	return username, nil
+	user, err := s.store.GetUser(ctx, username)
+	if errors.Is(err, ErrNotFound) {
+		return inactive, nil
+	}
+	if err != nil {
+		return TokenIntrospection{}, err
+	}
+	roles, err := s.effectiveRoles(ctx, user)
+	if err != nil {
+		return TokenIntrospection{}, err
+	}
+
+	result.Active = true
+	result.Subject = username
+	result.Username = username
+	for _, role := range roles {
+		result.Roles = append(result.Roles, role.Name)
+		result.Permissions = append(result.Permissions, role.Ability...)
+	}
+	result.Scope = strings.Join(result.Roles, " ")
+	slices.Sort(result.Permissions)
+	result.Permissions = slices.Compact(result.Permissions)
+	return result, nil
 }
 
 // InvalidateToken removes a token, making it invalid
-func InvalidateToken(tokenString string) {
-	Tokens.Delete(tokenString)
+func (s *InMemoryAuthService) InvalidateToken(tokenString string) error {
+	return s.store.DeleteToken(context.Background(), tokenString)
+}
+
+// Keys returns the key ring the service signs and verifies tokens with
+func (s *InMemoryAuthService) Keys() *KeyRing {
+	return s.keys
+}
+
+// RotateSigningKey generates a new signing key of the same algorithm as the
+// active one and makes it active, returning its ID. Tokens signed with earlier
+// keys keep validating until those keys are retired.
+func (s *InMemoryAuthService) RotateSigningKey() (string, error) {
+	key, err := GenerateSigningKey(s.keys.Active().Method.Alg())
+	if err != nil {
+		return "", err
+	}
+	if err := s.keys.Rotate(key); err != nil {
+		return "", err
+	}
+	return key.ID, nil
+}
+
+// RetireSigningKey drops a key, invalidating every token signed with it
+func (s *InMemoryAuthService) RetireSigningKey(keyID string) error {
+	return s.keys.Retire(keyID)
+}
+
+// randomToken returns n random bytes encoded for use in URLs and JSON
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 // SetTokenDuration allows changing the token duration for testing purposes
@@ -3,6 +3,7 @@
 package auth
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -10,43 +11,49 @@ import (
 )
 
 func TestGenerateToken(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewInMemoryAuthService(store)
 	username := "testuser"
-	tokenDetails, err := GenerateToken(username)
+	tokenDetails, err := s.GenerateToken(username)
 
 	assert.Nil(t, err, "Error should be nil")
 	assert.NotEmpty(t, tokenDetails.Token, "Token should not be empty")
 	assert.True(t, tokenDetails.ExpiresAt > time.Now().Unix(), "Token expiration should be in the future")
 
 	// Check if token exists in the in-memory store
-	_, exists := Tokens.Get(tokenDetails.Token)
-	assert.True(t, exists, "Token should exist in the store")
+	_, err = store.GetToken(context.Background(), tokenDetails.Token)
+	assert.Nil(t, err, "Token should exist in the store")
 }
 
 func TestValidateToken(t *testing.T) {
+	s := NewInMemoryAuthService(NewMemoryStore())
 	username := "testuser2"
-	tokenDetails, _ := GenerateToken(username)
+	tokenDetails, _ := s.GenerateToken(username)
 
-	retrievedUsername, err := ValidateToken(tokenDetails.Token)
+	retrievedUsername, err := s.ValidateToken(tokenDetails.Token)
 
 	assert.Nil(t, err, "Error should be nil")
 	assert.Equal(t, username, retrievedUsername, "Usernames should match")
 
 	// Check for invalid token
-	_, err = ValidateToken("invalidtoken")
+	_, err = s.ValidateToken("invalidtoken")
 	assert.NotNil(t, err, "Error should not be nil for an invalid token")
 }
 
 func TestInvalidateToken(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewInMemoryAuthService(store)
 	username := "testuser3"
-	tokenDetails, _ := GenerateToken(username)
+	tokenDetails, _ := s.GenerateToken(username)
 
 	// Invalidate the token
-	InvalidateToken(tokenDetails.Token)
+	err := s.InvalidateToken(tokenDetails.Token)
+	assert.Nil(t, err, "Error should be nil")
 
-	_, exists := Tokens.Get(tokenDetails.Token)
-	assert.False(t, exists, "Token should not exist in the store after invalidation")
+	_, err = store.GetToken(context.Background(), tokenDetails.Token)
+	assert.Equal(t, ErrNotFound, err, "Token should not exist in the store after invalidation")
 
-	a, err := ValidateToken(tokenDetails.Token)
+	a, err := s.ValidateToken(tokenDetails.Token)
 	assert.Equal(t, a, "", "should be empty")
 	assert.NotNil(t, err, "Error should not be nil for a deleted token")
 }
@@ -55,14 +62,89 @@ func TestTokenExpiry(t *testing.T) {
 	// Set token duration to 2 seconds for this test
 	setTokenDuration(2 * time.Second)
 
+	s := NewInMemoryAuthService(NewMemoryStore())
 	username := "testuserExpiry"
-	tokenDetails, _ := GenerateToken(username)
+	tokenDetails, _ := s.GenerateToken(username)
 
 	// Wait for 3 seconds to ensure the token expires
 	time.Sleep(3 * time.Second)
 
-	_, err := ValidateToken(tokenDetails.Token)
+	_, err := s.ValidateToken(tokenDetails.Token)
 
 	assert.NotNil(t, err, "Error should not be nil for an expired token")
-	assert.Equal(t, "token has invalid claims: token is expired", err.Error(), "Expected token expired error")
+	assert.ErrorIs(t, err, ErrTokenExpired, "Expected token expired error")
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	s := NewInMemoryAuthService(NewMemoryStore())
+	oldKeyID := s.Keys().Active().ID
+	before, _ := s.GenerateToken("rotatingUser")
+
+	newKeyID, err := s.RotateSigningKey()
+	assert.Nil(t, err, "Error should be nil")
+	assert.NotEqual(t, oldKeyID, newKeyID, "Rotation should activate a new key")
+	after, _ := s.GenerateToken("rotatingUser")
+
+	_, err = s.ValidateToken(before.Token)
+	assert.Nil(t, err, "Tokens signed before the rotation should stay valid")
+	_, err = s.ValidateToken(after.Token)
+	assert.Nil(t, err, "Tokens signed with the new key should be valid")
+
+	assert.Nil(t, s.RetireSigningKey(oldKeyID), "Error should be nil")
+	_, err = s.ValidateToken(before.Token)
+	assert.NotNil(t, err, "Tokens signed with a retired key should be rejected")
+	_, err = s.ValidateToken(after.Token)
+	assert.Nil(t, err, "Tokens signed with the active key should be unaffected")
+}
+
+func TestSharedKeyRing(t *testing.T) {
+	ring := NewKeyRing(NewHMACKey([]byte("shared-secret")))
+	store := NewMemoryStore()
+	issuer := NewInMemoryAuthService(store, WithKeyRing(ring))
+	verifier := NewInMemoryAuthService(store, WithKeyRing(ring))
+
+	tokenDetails, _ := issuer.GenerateToken("sharedUser")
+	username, err := verifier.ValidateToken(tokenDetails.Token)
+	assert.Nil(t, err, "Services sharing a key ring should accept each other's tokens")
+	assert.Equal(t, "sharedUser", username)
+}
+
+func TestIntrospectToken(t *testing.T) {
+	s := NewInMemoryAuthService(NewMemoryStore())
+	s.CreateUser("introspectedUser", "password123")
+	s.CreateRole("reader")
+	s.CreateRole("writer")
+	s.AddRoleToUser("introspectedUser", "reader")
+	s.AddRoleToUser("introspectedUser", "writer")
+	s.GrantPermission("reader", "orders:read")
+	s.GrantPermission("writer", "orders:write")
+	s.GrantPermission("writer", "orders:read")
+	tokenDetails, _ := s.Authenticate("introspectedUser", "password123")
+
+	result, err := s.IntrospectToken(tokenDetails.Token)
+	assert.Nil(t, err, "Error should be nil")
+	assert.True(t, result.Active, "A fresh access token should be active")
+	assert.Equal(t, "access_token", result.TokenType)
+	assert.Equal(t, "introspectedUser", result.Subject)
+	assert.Equal(t, "reader writer", result.Scope)
+	assert.Equal(t, []string{"orders:read", "orders:write"}, result.Permissions)
+	assert.Equal(t, tokenDetails.ExpiresAt, result.ExpiresAt)
+	assert.NotZero(t, result.IssuedAt, "The issue time should be reported")
+
+	result, err = s.IntrospectToken(tokenDetails.RefreshToken)
+	assert.Nil(t, err, "Error should be nil")
+	assert.True(t, result.Active, "An unused refresh token should be active")
+	assert.Equal(t, "refresh_token", result.TokenType)
+
+	s.RefreshToken(tokenDetails.RefreshToken)
+	result, _ = s.IntrospectToken(tokenDetails.RefreshToken)
+	assert.Equal(t, TokenIntrospection{Active: false}, result, "A rotated-out refresh token should be inactive")
+
+	s.InvalidateToken(tokenDetails.Token)
+	result, _ = s.IntrospectToken(tokenDetails.Token)
+	assert.Equal(t, TokenIntrospection{Active: false}, result, "A revoked access token should be inactive")
+
+	result, err = s.IntrospectToken("garbage")
+	assert.Nil(t, err, "Unknown tokens are inactive, not errors")
+	assert.False(t, result.Active)
 }
@@ -3,23 +3,204 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	//"crypto/tls"
+	"expvar"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gogorush/simple_auth/auth"
+	"github.com/gogorush/simple_auth/auth/authgrpc"
+	"google.golang.org/grpc"
+	_ "modernc.org/sqlite"
 )
 
+// sqlDialects lists the -sql-driver values the binary is built with
+var sqlDialects = map[string]auth.SQLDialect{
+	"sqlite": auth.DialectQuestion,
+}
+
 func main() {
-	http.HandleFunc("/create-user", auth.HandleCreateUser)
-	http.HandleFunc("/delete-user", auth.HandleDeleteUser)
-	http.HandleFunc("/create-role", auth.HandleCreateRole)
-	http.HandleFunc("/delete-role", auth.HandleDeleteRole)
-	http.HandleFunc("/add-role-to-user", auth.HandleAddRoleToUser)
-	http.HandleFunc("/authenticate", auth.HandleAuthenticate)
-	http.HandleFunc("/invalidate-token", auth.HandleInvalidateToken)
-	http.HandleFunc("/check-role", auth.HandleCheckRole)
-	http.HandleFunc("/get-all-roles", auth.HandleGetAllRoles)
+	dataDir := flag.String("data-dir", "", "directory for the durable store; empty keeps everything in memory")
+	syncPolicy := flag.String("fsync", "always", "when to fsync the write-ahead log: always, interval or never")
+	syncInterval := flag.Duration("fsync-interval", time.Second, "fsync period when -fsync=interval")
+	sqlDriver := flag.String("sql-driver", "sqlite", "database/sql driver for -sql-dsn")
+	sqlDSN := flag.String("sql-dsn", "", "data source name of a database to keep everything in, such as file:auth.db; empty disables it")
+	snapshotEvery := flag.Int("snapshot-every", 1000, "compact the write-ahead log after this many records")
+	signingKey := flag.String("signing-key", "", "PEM private key to sign tokens with; generated on first boot if missing")
+	signingAlg := flag.String("signing-alg", "RS256", "algorithm of a generated signing key: RS256, ES256 or EdDSA")
+	keyDir := flag.String("key-dir", "", "directory keeping the signing key ring, so that rotated and retired keys survive restarts; the first key is generated on first boot. Defaults to keys under -data-dir")
+	sweepInterval := flag.Duration("sweep-interval", time.Minute, "how often expired tokens and sessions are removed from the store")
+	bootstrapAdmin := flag.String("bootstrap-admin", os.Getenv("SIMPLE_AUTH_ADMIN_USER"), "user to create or promote to admin at startup; the password of a new user comes from SIMPLE_AUTH_ADMIN_PASSWORD")
+	debugAddr := flag.String("debug-addr", "localhost:6060", "address to serve the expvars at /debug/vars on, kept off the public listener; empty disables it")
+	grpcAddr := flag.String("grpc-addr", "", "address to serve the gRPC API on, such as :9090; empty disables it")
+	flag.Parse()
+
+	if *dataDir != "" && *sqlDSN != "" {
+		log.Fatal("-data-dir and -sql-dsn select different stores; set only one")
+	}
+	var store auth.Store = auth.NewMemoryStore()
+	var fileStore *auth.FileStore
+	var db *sql.DB
+	if *sqlDSN != "" {
+		dialect, ok := sqlDialects[*sqlDriver]
+		if !ok {
+			log.Fatalf("Unknown SQL driver %q", *sqlDriver)
+		}
+		var err error
+		db, err = sql.Open(*sqlDriver, *sqlDSN)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		if *sqlDriver == "sqlite" {
+			// SQLite takes one writer at a time; queue on the pool rather
+			// than fail with SQLITE_BUSY
+			db.SetMaxOpenConns(1)
+		}
+		sqlStore := auth.NewSQLStore(db, dialect)
+		if err := sqlStore.Migrate(context.Background()); err != nil {
+			log.Fatalf("Failed to migrate database: %v", err)
+		}
+		store = sqlStore
+	}
+	if *dataDir != "" {
+		opts := auth.FileStoreOptions{
+			SyncInterval:  *syncInterval,
+			SnapshotEvery: *snapshotEvery,
+		}
+		switch *syncPolicy {
+		case "always":
+			opts.Sync = auth.SyncAlways
+		case "interval":
+			opts.Sync = auth.SyncInterval
+		case "never":
+			opts.Sync = auth.SyncNever
+		default:
+			log.Fatalf("Unknown fsync policy %q", *syncPolicy)
+		}
+		var err error
+		fileStore, err = auth.OpenFileStore(*dataDir, opts)
+		if err != nil {
+			log.Fatalf("Failed to open store: %v", err)
+		}
+		store = fileStore
+	}
+
+	// A key directory, key file or fixed secret keeps tokens valid across
+	// restarts. Only a key directory also keeps the keys rotated through the
+	// API, so a durable store gets one unless a key is configured.
+	secret := os.Getenv("SIMPLE_AUTH_JWT_SECRET")
+	if *keyDir != "" && *signingKey != "" {
+		log.Fatal("-key-dir and -signing-key both hold the signing key; set only one")
+	}
+	if *keyDir == "" && *signingKey == "" && secret == "" {
+		switch {
+		case *dataDir != "":
+			*keyDir = filepath.Join(*dataDir, "keys")
+		case *sqlDSN != "":
+			log.Fatal("Tokens kept in a database must outlive the signing key; set -key-dir, -signing-key or SIMPLE_AUTH_JWT_SECRET")
+		}
+	}
+	var serviceOpts []auth.ServiceOption
+	if *keyDir != "" {
+		keys, err := auth.OpenKeyDir(*keyDir, *signingAlg)
+		if err != nil {
+			log.Fatalf("Failed to load signing keys: %v", err)
+		}
+		serviceOpts = append(serviceOpts, auth.WithKeyRing(keys))
+	} else if *signingKey != "" {
+		key, err := auth.LoadOrGenerateKeyFile(*signingKey, *signingAlg)
+		if err != nil {
+			log.Fatalf("Failed to load signing key: %v", err)
+		}
+		serviceOpts = append(serviceOpts, auth.WithKeyRing(auth.NewKeyRing(key)))
+	} else if secret != "" {
+		serviceOpts = append(serviceOpts, auth.WithKeyRing(auth.NewKeyRing(auth.NewHMACKey([]byte(secret)))))
+	} else {
+		// everything is in memory and goes with the process, so a fresh key
+		// loses nothing, and being asymmetric it is still published in the JWKS
+		key, err := auth.GenerateSigningKey(*signingAlg)
+		if err != nil {
+			log.Fatalf("Failed to generate signing key: %v", err)
+		}
+		serviceOpts = append(serviceOpts, auth.WithKeyRing(auth.NewKeyRing(key)))
+	}
+	service := auth.NewInMemoryAuthService(store, serviceOpts...)
+
+	// the management endpoints need an admin's token, so the first admin
+	// has to come from outside the API
+	if *bootstrapAdmin != "" {
+		if err := service.EnsureAdmin(*bootstrapAdmin, os.Getenv("SIMPLE_AUTH_ADMIN_PASSWORD")); err != nil {
+			log.Fatalf("Failed to bootstrap admin %q: %v", *bootstrapAdmin, err)
+		}
+	}
+
+	// sweep counters are served with the other expvars, on -debug-addr
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	janitor := auth.NewJanitor(store, *sweepInterval)
+	expvar.Publish("token_janitor", expvar.Func(func() interface{} { return janitor.Stats() }))
+	janitorDone := make(chan struct{})
+	go func() {
+		defer close(janitorDone)
+		janitor.Run(ctx)
+	}()
+
+	// id:secret pairs, comma separated, allowed to call /introspect
+	for _, client := range strings.Split(os.Getenv("SIMPLE_AUTH_INTROSPECTION_CLIENTS"), ",") {
+		clientID, secret, ok := strings.Cut(client, ":")
+		if !ok || clientID == "" || secret == "" {
+			continue
+		}
+		service.AddIntrospectionClient(clientID, secret)
+	}
+
+	// a mux of its own, as expvar registers /debug/vars on the default one,
+	// where it would disclose the command line and memory stats to anyone
+	mux := http.NewServeMux()
+	auth.NewHandler(service).RegisterRoutes(mux)
+
+	var debugServer *http.Server
+	if *debugAddr != "" {
+		debugMux := http.NewServeMux()
+		debugMux.Handle("GET /debug/vars", expvar.Handler())
+		debugServer = &http.Server{Addr: *debugAddr, Handler: debugMux}
+		go func() {
+			log.Printf("Starting debug server on http://%v/debug/vars", debugServer.Addr)
+			if err := debugServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Debug server failed: %v", err)
+			}
+		}()
+	}
+
+	// either server failing stops both
+	serveErr := make(chan error, 2)
+
+	// the gRPC API shares the service, so both see the same users and tokens
+	var grpcServer *grpc.Server
+	if *grpcAddr != "" {
+		listener, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen for gRPC: %v", err)
+		}
+		grpcServer = authgrpc.NewServer(service)
+		go func() {
+			log.Printf("Starting gRPC server on %v", listener.Addr())
+			if err := grpcServer.Serve(listener); err != nil {
+				serveErr <- fmt.Errorf("gRPC: %w", err)
+			}
+		}()
+	}
 
 	// Load the HTTPS certificate and key
 	//cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
@@ -32,11 +213,66 @@ func main() {
 	//}
 
 	server := &http.Server{
-		Addr: ":8443",
+		Addr:    ":8443",
+		Handler: mux,
 		//TLSConfig: tlsConfig,
 	}
 
-	log.Printf("Starting server on https://localhost%v", server.Addr)
-	//log.Fatal(server.ListenAndServeTLS("", ""))
-	log.Fatal(server.ListenAndServe())
+	go func() {
+		log.Printf("Starting server on https://localhost%v", server.Addr)
+		//serveErr <- server.ListenAndServeTLS("", "")
+		serveErr <- server.ListenAndServe()
+	}()
+
+	// on SIGINT or SIGTERM, let the calls in flight on both servers finish,
+	// then close the store so that its log is flushed before exiting
+	signals, stopSignals := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	failed := false
+	select {
+	case err := <-serveErr:
+		log.Printf("Server failed: %v", err)
+		failed = true
+	case <-signals.Done():
+		log.Print("Shutting down")
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down the server: %v", err)
+	}
+	if debugServer != nil {
+		debugServer.Shutdown(shutdownCtx)
+	}
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			log.Print("Failed to shut down the gRPC server in time, closing its connections")
+			grpcServer.Stop()
+		}
+	}
+	cancel()
+	<-janitorDone
+	if fileStore != nil {
+		if err := fileStore.Close(); err != nil {
+			log.Printf("Failed to close store: %v", err)
+			failed = true
+		}
+	}
+	if db != nil {
+		if err := db.Close(); err != nil {
+			log.Printf("Failed to close database: %v", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
 }
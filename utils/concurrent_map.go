@@ -2,35 +2,367 @@
 
 package utils
 
-import "sync"
+import (
+	"container/list"
+	"sync"
+	"time"
+)
 
-type ConcurrentMap struct {
-	sync.RWMutex
-	internal map[string]interface{}
+// EvictionReason tells an OnEvict callback why an entry went away
+type EvictionReason int
+
+const (
+	// EvictedExpired means the entry outlived its expiry
+	EvictedExpired EvictionReason = iota
+	// EvictedCapacity means the entry was the least recently used one when
+	// the map grew past MaxSize
+	EvictedCapacity
+)
+
+// MapOptions turn a ConcurrentMap into a cache. The zero value is a plain map.
+type MapOptions[K comparable, V any] struct {
+	// DefaultTTL is the lifetime of entries stored without an explicit
+	// expiry; zero keeps them until deleted
+	DefaultTTL time.Duration
+	// MaxSize evicts the least recently used entry whenever the map would
+	// grow past this many entries; zero means unbounded
+	MaxSize int
+	// OnEvict is called for every entry removed by expiry or eviction, but
+	// not for Delete. It runs after the map's lock is released.
+	OnEvict func(key K, value V, reason EvictionReason)
+	// Now is the clock expiry is measured against, time.Now by default
+	Now func() time.Time
+}
+
+type mapEntry[V any] struct {
+	value     V
+	expiresAt int64         // UnixNano; zero never expires
+	element   *list.Element // position in the recency list, with MaxSize only
+}
+
+type eviction[K comparable, V any] struct {
+	key    K
+	value  V
+	reason EvictionReason
+}
+
+// ConcurrentMap is a map guarded by a read-write mutex, safe for concurrent
+// use. Expired entries behave as absent everywhere and are dropped as they
+// are found, or in bulk by DeleteExpired.
+type ConcurrentMap[K comparable, V any] struct {
+	mu       sync.RWMutex
+	internal map[K]mapEntry[V]
+	opts     MapOptions[K, V]
+	recency  *list.List // keys, most recently used at the front; nil without MaxSize
+	expiring int        // entries with an expiry, so plain maps keep O(1) Len
+}
+
+func NewConcurrentMap[K comparable, V any]() *ConcurrentMap[K, V] {
+	return NewConcurrentMapWithOptions[K, V](MapOptions[K, V]{})
+}
+
+// NewConcurrentMapWithOptions returns an empty map configured by opts
+func NewConcurrentMapWithOptions[K comparable, V any](opts MapOptions[K, V]) *ConcurrentMap[K, V] {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	cm := &ConcurrentMap[K, V]{
+		internal: make(map[K]mapEntry[V]),
+		opts:     opts,
+	}
+	if opts.MaxSize > 0 {
+		cm.recency = list.New()
+	}
+	return cm
+}
+
+func (cm *ConcurrentMap[K, V]) Set(key K, value V) {
+	var evicted []eviction[K, V]
+	defer cm.notify(&evicted)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.store(key, value, cm.defaultExpiry(), &evicted)
+}
+
+// SetWithTTL stores value so that it expires after ttl
+func (cm *ConcurrentMap[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	cm.SetWithExpiry(key, value, cm.opts.Now().Add(ttl))
+}
+
+// SetWithExpiry stores value so that it expires at the given time
+func (cm *ConcurrentMap[K, V]) SetWithExpiry(key K, value V, expiresAt time.Time) {
+	var evicted []eviction[K, V]
+	defer cm.notify(&evicted)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.store(key, value, expiresAt.UnixNano(), &evicted)
+}
+
+func (cm *ConcurrentMap[K, V]) Get(key K) (V, bool) {
+	// without recency tracking a live hit only needs the read lock
+	if cm.recency == nil {
+		cm.mu.RLock()
+		entry, exists := cm.internal[key]
+		cm.mu.RUnlock()
+		if !exists {
+			var zero V
+			return zero, false
+		}
+		if !cm.expired(entry, cm.opts.Now().UnixNano()) {
+			return entry.value, true
+		}
+	}
+
+	var evicted []eviction[K, V]
+	defer cm.notify(&evicted)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	entry, exists := cm.lookup(key, &evicted)
+	return entry.value, exists
+}
+
+func (cm *ConcurrentMap[K, V]) Delete(key K) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.remove(key)
+}
+
+// DeleteExpired drops every expired entry, returning how many it dropped
+func (cm *ConcurrentMap[K, V]) DeleteExpired() int {
+	var evicted []eviction[K, V]
+	defer cm.notify(&evicted)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.expiring == 0 {
+		return 0
+	}
+	now := cm.opts.Now().UnixNano()
+	for key, entry := range cm.internal {
+		if cm.expired(entry, now) {
+			cm.remove(key)
+			evicted = append(evicted, eviction[K, V]{key, entry.value, EvictedExpired})
+		}
+	}
+	return len(evicted)
+}
+
+// Len returns the number of live entries
+func (cm *ConcurrentMap[K, V]) Len() int {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	if cm.expiring == 0 {
+		return len(cm.internal)
+	}
+	n := 0
+	now := cm.opts.Now().UnixNano()
+	for _, entry := range cm.internal {
+		if !cm.expired(entry, now) {
+			n++
+		}
+	}
+	return n
+}
+
+// Keys returns the keys present at the time of the call, in no particular order
+func (cm *ConcurrentMap[K, V]) Keys() []K {
+	keys := make([]K, 0)
+	cm.Range(func(key K, value V) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Range calls fn for each entry until fn returns false. The read lock is held
+// throughout, so fn must not write to the map; iterate over Snapshot for that.
+func (cm *ConcurrentMap[K, V]) Range(fn func(key K, value V) bool) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	now := cm.opts.Now().UnixNano()
+	for key, entry := range cm.internal {
+		if cm.expired(entry, now) {
+			continue
+		}
+		if !fn(key, entry.value) {
+			return
+		}
+	}
+}
+
+// Snapshot returns a copy of the entries, unaffected by later writes
+func (cm *ConcurrentMap[K, V]) Snapshot() map[K]V {
+	snapshot := make(map[K]V)
+	cm.Range(func(key K, value V) bool {
+		snapshot[key] = value
+		return true
+	})
+	return snapshot
+}
+
+// Update atomically replaces the entry for key with what fn returns. fn sees
+// the current value and whether it exists; returning keep=false deletes the
+// key instead. Update returns the resulting value and whether it is present.
+// A live entry keeps its expiry. fn runs under the write lock and must not
+// call back into the map.
+func (cm *ConcurrentMap[K, V]) Update(key K, fn func(value V, exists bool) (newValue V, keep bool)) (V, bool) {
+	var evicted []eviction[K, V]
+	defer cm.notify(&evicted)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	entry, exists := cm.lookup(key, &evicted)
+	value, keep := fn(entry.value, exists)
+	if !keep {
+		cm.remove(key)
+		var zero V
+		return zero, false
+	}
+	expiresAt := entry.expiresAt
+	if !exists {
+		expiresAt = cm.defaultExpiry()
+	}
+	cm.store(key, value, expiresAt, &evicted)
+	return value, true
+}
+
+// SetIfAbsent stores value unless key is already present, reporting whether it stored
+func (cm *ConcurrentMap[K, V]) SetIfAbsent(key K, value V) bool {
+	var evicted []eviction[K, V]
+	defer cm.notify(&evicted)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if _, exists := cm.lookup(key, &evicted); exists {
+		return false
+	}
+	cm.store(key, value, cm.defaultExpiry(), &evicted)
+	return true
+}
+
+// CompareAndSwapFunc stores new if key currently maps to a value equal to
+// old, reporting whether it swapped. The entry keeps its expiry. equal runs
+// under the write lock and must not call back into the map.
+func (cm *ConcurrentMap[K, V]) CompareAndSwapFunc(key K, old, new V, equal func(a, b V) bool) bool {
+	var evicted []eviction[K, V]
+	defer cm.notify(&evicted)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	entry, exists := cm.lookup(key, &evicted)
+	if !exists || !equal(entry.value, old) {
+		return false
+	}
+	cm.store(key, new, entry.expiresAt, &evicted)
+	return true
+}
+
+// swapper is implemented by ConcurrentMap and ShardedConcurrentMap
+type swapper[K comparable, V any] interface {
+	CompareAndSwapFunc(key K, old, new V, equal func(a, b V) bool) bool
+}
+
+// CompareAndSwap stores new in m if key currently maps to old, reporting
+// whether it swapped. It is a function rather than a method so that it can
+// require comparable values; other maps use CompareAndSwapFunc.
+func CompareAndSwap[K, V comparable](m swapper[K, V], key K, old, new V) bool {
+	return m.CompareAndSwapFunc(key, old, new, func(a, b V) bool { return a == b })
+}
+
+// GetOrCompute returns the value for key, computing and storing it with fn
+// if absent. loaded reports whether the value was already present. fn runs
+// under the write lock and must not call back into the map.
+func (cm *ConcurrentMap[K, V]) GetOrCompute(key K, fn func() V) (value V, loaded bool) {
+	var evicted []eviction[K, V]
+	defer cm.notify(&evicted)
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if entry, exists := cm.lookup(key, &evicted); exists {
+		return entry.value, true
+	}
+	value = fn()
+	cm.store(key, value, cm.defaultExpiry(), &evicted)
+	return value, false
 }
 
-func NewConcurrentMap() *ConcurrentMap {
-	return &ConcurrentMap{
-		internal: make(map[string]interface{}),
+// The helpers below must be called with the write lock held, except notify.
+
+func (cm *ConcurrentMap[K, V]) defaultExpiry() int64 {
+	if cm.opts.DefaultTTL <= 0 {
+		return 0
 	}
+	return cm.opts.Now().Add(cm.opts.DefaultTTL).UnixNano()
 }
 
-func (cm *ConcurrentMap) Set(key string, value interface{}) {
-	cm.Lock()
-	defer cm.Unlock()
-	cm.internal[key] = value
+func (cm *ConcurrentMap[K, V]) expired(entry mapEntry[V], now int64) bool {
+	return entry.expiresAt != 0 && entry.expiresAt <= now
 }
 
-func (cm *ConcurrentMap) Get(key string) (interface{}, bool) {
-	cm.RLock()
-	defer cm.RUnlock()
-	val, ok := cm.internal[key]
-	return val, ok
+// lookup returns the live entry for key, dropping it if it has expired
+func (cm *ConcurrentMap[K, V]) lookup(key K, evicted *[]eviction[K, V]) (mapEntry[V], bool) {
+	entry, exists := cm.internal[key]
+	if !exists {
+		return mapEntry[V]{}, false
+	}
+	if cm.expired(entry, cm.opts.Now().UnixNano()) {
+		cm.remove(key)
+		*evicted = append(*evicted, eviction[K, V]{key, entry.value, EvictedExpired})
+		return mapEntry[V]{}, false
+	}
+	if entry.element != nil {
+		cm.recency.MoveToFront(entry.element)
+	}
+	return entry, true
 }
 
-func (cm *ConcurrentMap) Delete(key string) {
-	cm.Lock()
-	defer cm.Unlock()
+func (cm *ConcurrentMap[K, V]) store(key K, value V, expiresAt int64, evicted *[]eviction[K, V]) {
+	entry, exists := cm.internal[key]
+	if exists && entry.expiresAt != 0 {
+		cm.expiring--
+	}
+	if expiresAt != 0 {
+		cm.expiring++
+	}
+	entry.value = value
+	entry.expiresAt = expiresAt
+	if cm.recency != nil {
+		if exists {
+			cm.recency.MoveToFront(entry.element)
+		} else {
+			entry.element = cm.recency.PushFront(key)
+		}
+	}
+	cm.internal[key] = entry
+
+	for cm.recency != nil && len(cm.internal) > cm.opts.MaxSize {
+		oldest := cm.recency.Back().Value.(K)
+		victim := cm.internal[oldest]
+		reason := EvictedCapacity
+		if cm.expired(victim, cm.opts.Now().UnixNano()) {
+			reason = EvictedExpired
+		}
+		cm.remove(oldest)
+		*evicted = append(*evicted, eviction[K, V]{oldest, victim.value, reason})
+	}
+}
+
+func (cm *ConcurrentMap[K, V]) remove(key K) {
+	entry, exists := cm.internal[key]
+	if !exists {
+		return
+	}
+	if entry.expiresAt != 0 {
+		cm.expiring--
+	}
+	if entry.element != nil {
+		cm.recency.Remove(entry.element)
+	}
 	delete(cm.internal, key)
 }
 
+// notify runs OnEvict for the collected evictions; it is deferred before the
+// lock is taken so it runs after the lock is released
+func (cm *ConcurrentMap[K, V]) notify(evicted *[]eviction[K, V]) {
+	if cm.opts.OnEvict == nil {
+		return
+	}
+	for _, e := range *evicted {
+		cm.opts.OnEvict(e.key, e.value, e.reason)
+	}
+}
@@ -3,15 +3,17 @@
 package utils
 
 import (
+	"slices"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestConcurrentMap(t *testing.T) {
-	cm := NewConcurrentMap()
+	cm := NewConcurrentMap[string, string]()
 
 	// Test Set and Get
 	cm.Set("key1", "value1")
@@ -30,7 +32,7 @@ func TestConcurrentMap(t *testing.T) {
 }
 
 func TestConcurrentAccess(t *testing.T) {
-	cm := NewConcurrentMap()
+	cm := NewConcurrentMap[string, int]()
 	var wg sync.WaitGroup
 
 	// Simulate concurrent writes
@@ -61,3 +63,186 @@ func TestConcurrentAccess(t *testing.T) {
 	}
 }
 
+
+func TestConcurrentMapIteration(t *testing.T) {
+	cm := NewConcurrentMap[string, int]()
+	cm.Set("a", 1)
+	cm.Set("b", 2)
+	cm.Set("c", 3)
+
+	assert.Equal(t, 3, cm.Len(), "Len should count every key")
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, cm.Keys(), "Keys should list every key")
+
+	sum := 0
+	cm.Range(func(key string, value int) bool {
+		sum += value
+		return true
+	})
+	assert.Equal(t, 6, sum, "Range should visit every entry")
+
+	visited := 0
+	cm.Range(func(key string, value int) bool {
+		visited++
+		return false
+	})
+	assert.Equal(t, 1, visited, "Range should stop when fn returns false")
+
+	// writing while iterating a snapshot must neither deadlock nor affect it
+	snapshot := cm.Snapshot()
+	for key := range snapshot {
+		cm.Delete(key)
+	}
+	assert.Len(t, snapshot, 3, "The snapshot should be unaffected by later writes")
+	assert.Equal(t, 0, cm.Len(), "Every key should have been deleted")
+}
+
+func TestConcurrentMapAtomicOperations(t *testing.T) {
+	cm := NewConcurrentMap[string, int]()
+
+	assert.True(t, cm.SetIfAbsent("a", 1), "The first SetIfAbsent should store")
+	assert.False(t, cm.SetIfAbsent("a", 2), "Later SetIfAbsent calls should not overwrite")
+	val, _ := cm.Get("a")
+	assert.Equal(t, 1, val)
+
+	assert.False(t, CompareAndSwap(cm, "a", 5, 6), "Swapping from the wrong value should fail")
+	assert.True(t, CompareAndSwap(cm, "a", 1, 6), "Swapping from the current value should succeed")
+	assert.False(t, CompareAndSwap(cm, "missing", 0, 1), "Swapping a missing key should fail")
+
+	val, present := cm.Update("a", func(value int, exists bool) (int, bool) { return value + 1, true })
+	assert.True(t, present)
+	assert.Equal(t, 7, val)
+	_, present = cm.Update("a", func(value int, exists bool) (int, bool) { return 0, false })
+	assert.False(t, present, "Returning keep=false should delete the key")
+	_, exists := cm.Get("a")
+	assert.False(t, exists)
+
+	calls := 0
+	compute := func() int { calls++; return 42 }
+	val, loaded := cm.GetOrCompute("b", compute)
+	assert.Equal(t, 42, val)
+	assert.False(t, loaded)
+	val, loaded = cm.GetOrCompute("b", compute)
+	assert.Equal(t, 42, val)
+	assert.True(t, loaded)
+	assert.Equal(t, 1, calls, "The value should only be computed once")
+}
+
+func TestConcurrentMapCompareAndSwapFunc(t *testing.T) {
+	// slices are not comparable, so CompareAndSwap is not available here
+	cm := NewConcurrentMap[string, []string]()
+	cm.Set("a", []string{"x"})
+
+	assert.False(t, cm.CompareAndSwapFunc("a", []string{"y"}, []string{"z"}, slices.Equal[[]string]), "Swapping from the wrong value should fail")
+	assert.True(t, cm.CompareAndSwapFunc("a", []string{"x"}, []string{"z"}, slices.Equal[[]string]), "Swapping from an equal value should succeed")
+	val, _ := cm.Get("a")
+	assert.Equal(t, []string{"z"}, val)
+}
+
+func TestConcurrentMapAtomicOperationsUnderContention(t *testing.T) {
+	cm := NewConcurrentMap[string, int]()
+	var wg sync.WaitGroup
+	var stored, computed sync.Map
+	cm.Set("cas", 0)
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cm.Update("counter", func(value int, exists bool) (int, bool) { return value + 1, true })
+			if cm.SetIfAbsent("once", i) {
+				stored.Store(i, true)
+			}
+			cm.GetOrCompute("computed", func() int {
+				computed.Store(i, true)
+				return i
+			})
+			for {
+				current, _ := cm.Get("cas")
+				if CompareAndSwap(cm, "cas", current, current+1) {
+					break
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	counter, _ := cm.Get("counter")
+	assert.Equal(t, 100, counter, "No increment should be lost")
+	swapped, _ := cm.Get("cas")
+	assert.Equal(t, 100, swapped, "Every compare-and-swap retry loop should land exactly once")
+	assert.Equal(t, 1, syncMapLen(&stored), "Exactly one SetIfAbsent should win")
+	assert.Equal(t, 1, syncMapLen(&computed), "The value should be computed exactly once")
+}
+
+func TestConcurrentMapExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	type evicted struct {
+		key    string
+		reason EvictionReason
+	}
+	var evictions []evicted
+	cm := NewConcurrentMapWithOptions(MapOptions[string, int]{
+		DefaultTTL: time.Minute,
+		Now:        func() time.Time { return now },
+		OnEvict: func(key string, value int, reason EvictionReason) {
+			evictions = append(evictions, evicted{key, reason})
+		},
+	})
+
+	cm.Set("default", 1)
+	cm.SetWithTTL("short", 2, time.Second)
+	cm.SetWithExpiry("long", 3, now.Add(time.Hour))
+	assert.Equal(t, 3, cm.Len())
+
+	now = now.Add(time.Second)
+	_, exists := cm.Get("short")
+	assert.False(t, exists, "An entry should expire exactly at its expiry")
+	assert.Equal(t, []evicted{{"short", EvictedExpired}}, evictions, "Finding an expired entry should evict it")
+
+	cm.Update("default", func(value int, exists bool) (int, bool) { return value + 1, true })
+	now = now.Add(time.Minute)
+	assert.Equal(t, 1, cm.Len(), "Len should skip expired entries")
+	assert.Equal(t, []string{"long"}, cm.Keys(), "Update should keep the entry's expiry")
+	assert.True(t, cm.SetIfAbsent("default", 10), "An expired entry should count as absent")
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, 2, cm.DeleteExpired())
+	assert.Equal(t, 0, cm.Len())
+	assert.Len(t, evictions, 4, "DeleteExpired should report what it dropped")
+}
+
+func TestConcurrentMapLRUEviction(t *testing.T) {
+	var evicted []string
+	var cm *ConcurrentMap[string, int]
+	cm = NewConcurrentMapWithOptions(MapOptions[string, int]{
+		MaxSize: 2,
+		OnEvict: func(key string, value int, reason EvictionReason) {
+			assert.Equal(t, EvictedCapacity, reason)
+			// the callback runs outside the lock, so it may use the map
+			assert.Equal(t, 2, cm.Len())
+			evicted = append(evicted, key)
+		},
+	})
+
+	cm.Set("a", 1)
+	cm.Set("b", 2)
+	cm.Get("a")
+	cm.Set("c", 3)
+	assert.Equal(t, []string{"b"}, evicted, "The least recently used entry should go first")
+	cm.Set("a", 4)
+	cm.Set("d", 5)
+	assert.Equal(t, []string{"b", "c"}, evicted, "Overwriting an entry should count as a use")
+
+	cm.Delete("a")
+	assert.Equal(t, []string{"b", "c"}, evicted, "Delete should not call OnEvict")
+	assert.ElementsMatch(t, []string{"d"}, cm.Keys())
+}
+
+func syncMapLen(m *sync.Map) int {
+	n := 0
+	m.Range(func(key, value any) bool {
+		n++
+		return true
+	})
+	return n
+}
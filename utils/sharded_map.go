@@ -0,0 +1,145 @@
+// utils/sharded_map.go
+
+package utils
+
+import (
+	"hash/maphash"
+	"runtime"
+	"time"
+)
+
+// ShardedConcurrentMap spreads its keys over several ConcurrentMaps, each with
+// its own lock, so goroutines working on different keys rarely contend. It has
+// the same API as ConcurrentMap. Operations on one key are as atomic as on a
+// ConcurrentMap; Len, Keys, Range and Snapshot visit the shards one after
+// another and so are not a consistent view of the whole map under writes.
+type ShardedConcurrentMap[K comparable, V any] struct {
+	hash   func(K) uint64
+	shards []*ConcurrentMap[K, V]
+}
+
+// NewShardedConcurrentMap returns a string-keyed map with the given number of
+// shards; zero or less picks one per CPU
+func NewShardedConcurrentMap[V any](shards int) *ShardedConcurrentMap[string, V] {
+	seed := maphash.MakeSeed()
+	return NewShardedConcurrentMapFunc[string, V](shards, func(key string) uint64 {
+		return maphash.String(seed, key)
+	})
+}
+
+// NewShardedConcurrentMapFunc returns a map whose keys are assigned to shards by hash
+func NewShardedConcurrentMapFunc[K comparable, V any](shards int, hash func(K) uint64) *ShardedConcurrentMap[K, V] {
+	return NewShardedConcurrentMapWithOptions(shards, hash, MapOptions[K, V]{})
+}
+
+// NewShardedConcurrentMapWithOptions returns a sharded map whose shards are
+// configured by opts. MaxSize is split evenly between the shards, so LRU
+// eviction is per shard and only approximately global.
+func NewShardedConcurrentMapWithOptions[K comparable, V any](shards int, hash func(K) uint64, opts MapOptions[K, V]) *ShardedConcurrentMap[K, V] {
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	if opts.MaxSize > 0 {
+		opts.MaxSize = (opts.MaxSize + shards - 1) / shards
+	}
+	sm := &ShardedConcurrentMap[K, V]{
+		hash:   hash,
+		shards: make([]*ConcurrentMap[K, V], shards),
+	}
+	for i := range sm.shards {
+		sm.shards[i] = NewConcurrentMapWithOptions(opts)
+	}
+	return sm
+}
+
+func (sm *ShardedConcurrentMap[K, V]) shard(key K) *ConcurrentMap[K, V] {
+	return sm.shards[sm.hash(key)%uint64(len(sm.shards))]
+}
+
+func (sm *ShardedConcurrentMap[K, V]) Set(key K, value V) {
+	sm.shard(key).Set(key, value)
+}
+
+func (sm *ShardedConcurrentMap[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	sm.shard(key).SetWithTTL(key, value, ttl)
+}
+
+func (sm *ShardedConcurrentMap[K, V]) SetWithExpiry(key K, value V, expiresAt time.Time) {
+	sm.shard(key).SetWithExpiry(key, value, expiresAt)
+}
+
+func (sm *ShardedConcurrentMap[K, V]) Get(key K) (V, bool) {
+	return sm.shard(key).Get(key)
+}
+
+func (sm *ShardedConcurrentMap[K, V]) Delete(key K) {
+	sm.shard(key).Delete(key)
+}
+
+func (sm *ShardedConcurrentMap[K, V]) DeleteExpired() int {
+	n := 0
+	for _, shard := range sm.shards {
+		n += shard.DeleteExpired()
+	}
+	return n
+}
+
+func (sm *ShardedConcurrentMap[K, V]) Update(key K, fn func(value V, exists bool) (newValue V, keep bool)) (V, bool) {
+	return sm.shard(key).Update(key, fn)
+}
+
+func (sm *ShardedConcurrentMap[K, V]) SetIfAbsent(key K, value V) bool {
+	return sm.shard(key).SetIfAbsent(key, value)
+}
+
+func (sm *ShardedConcurrentMap[K, V]) CompareAndSwapFunc(key K, old, new V, equal func(a, b V) bool) bool {
+	return sm.shard(key).CompareAndSwapFunc(key, old, new, equal)
+}
+
+func (sm *ShardedConcurrentMap[K, V]) GetOrCompute(key K, fn func() V) (V, bool) {
+	return sm.shard(key).GetOrCompute(key, fn)
+}
+
+func (sm *ShardedConcurrentMap[K, V]) Len() int {
+	n := 0
+	for _, shard := range sm.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+func (sm *ShardedConcurrentMap[K, V]) Keys() []K {
+	var keys []K
+	for _, shard := range sm.shards {
+		keys = append(keys, shard.Keys()...)
+	}
+	return keys
+}
+
+// Range calls fn for each entry until fn returns false, holding one shard's
+// read lock at a time; fn must not write to the map
+func (sm *ShardedConcurrentMap[K, V]) Range(fn func(key K, value V) bool) {
+	for _, shard := range sm.shards {
+		stopped := false
+		shard.Range(func(key K, value V) bool {
+			if !fn(key, value) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+func (sm *ShardedConcurrentMap[K, V]) Snapshot() map[K]V {
+	snapshot := make(map[K]V)
+	for _, shard := range sm.shards {
+		for key, value := range shard.Snapshot() {
+			snapshot[key] = value
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,157 @@
+// utils/sharded_map_test.go
+
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedConcurrentMap(t *testing.T) {
+	sm := NewShardedConcurrentMap[int](8)
+
+	for i := 0; i < 100; i++ {
+		sm.Set(strconv.Itoa(i), i)
+	}
+	val, exists := sm.Get("42")
+	assert.True(t, exists, "Key should exist after setting it")
+	assert.Equal(t, 42, val, "Value should match what was set")
+	assert.Equal(t, 100, sm.Len(), "Len should count the keys of every shard")
+	assert.Len(t, sm.Keys(), 100, "Keys should list the keys of every shard")
+	assert.Len(t, sm.Snapshot(), 100, "Snapshot should copy every shard")
+
+	sum := 0
+	sm.Range(func(key string, value int) bool {
+		sum += value
+		return true
+	})
+	assert.Equal(t, 4950, sum, "Range should visit every entry")
+	visited := 0
+	sm.Range(func(key string, value int) bool {
+		visited++
+		return false
+	})
+	assert.Equal(t, 1, visited, "Range should stop when fn returns false")
+
+	sm.Delete("42")
+	_, exists = sm.Get("42")
+	assert.False(t, exists, "Key should not exist after deleting it")
+
+	assert.False(t, sm.SetIfAbsent("1", 0), "SetIfAbsent should not overwrite")
+	assert.True(t, CompareAndSwap(sm, "1", 1, 10))
+	val, _ = sm.Update("1", func(value int, exists bool) (int, bool) { return value + 1, true })
+	assert.Equal(t, 11, val)
+	val, loaded := sm.GetOrCompute("new", func() int { return 7 })
+	assert.Equal(t, 7, val)
+	assert.False(t, loaded)
+}
+
+func TestShardedConcurrentMapUnderContention(t *testing.T) {
+	sm := NewShardedConcurrentMapFunc[int, int](4, func(key int) uint64 { return uint64(key) })
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sm.Set(i, i)
+			sm.Update(-1, func(value int, exists bool) (int, bool) { return value + 1, true })
+		}(i)
+	}
+	wg.Wait()
+
+	counter, _ := sm.Get(-1)
+	assert.Equal(t, 100, counter, "No increment should be lost")
+	assert.Equal(t, 101, sm.Len())
+}
+
+func TestShardedConcurrentMapOptions(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sm := NewShardedConcurrentMapWithOptions(4, func(key int) uint64 { return uint64(key) }, MapOptions[int, int]{
+		MaxSize: 8,
+		Now:     func() time.Time { return now },
+	})
+
+	for i := 0; i < 100; i++ {
+		sm.Set(i, i)
+	}
+	assert.Equal(t, 8, sm.Len(), "MaxSize should be split between the shards")
+
+	sm.SetWithTTL(1000, 1, time.Second)
+	sm.SetWithExpiry(1001, 1, now.Add(time.Hour))
+	now = now.Add(time.Minute)
+	_, exists := sm.Get(1000)
+	assert.False(t, exists, "Entries should expire in every shard")
+	_, exists = sm.Get(1001)
+	assert.True(t, exists)
+	now = now.Add(time.Hour)
+	assert.Equal(t, 1, sm.DeleteExpired())
+}
+
+// benchMap is the part of the API the benchmarks exercise
+type benchMap interface {
+	Set(key string, value int)
+	Get(key string) (int, bool)
+}
+
+type syncMap struct{ m sync.Map }
+
+func (s *syncMap) Set(key string, value int) { s.m.Store(key, value) }
+func (s *syncMap) Get(key string) (int, bool) {
+	value, ok := s.m.Load(key)
+	if !ok {
+		return 0, false
+	}
+	return value.(int), true
+}
+
+// BenchmarkMaps compares the maps under read/write mixes seen by the token
+// store: validations read, logins write.
+//
+//	go test ./utils -bench Maps -cpu 1,4,16
+func BenchmarkMaps(b *testing.B) {
+	const keys = 10000
+	implementations := []struct {
+		name string
+		new  func() benchMap
+	}{
+		{"ConcurrentMap", func() benchMap { return NewConcurrentMap[string, int]() }},
+		{"ShardedConcurrentMap", func() benchMap { return NewShardedConcurrentMap[int](0) }},
+		{"sync.Map", func() benchMap { return &syncMap{} }},
+	}
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = "token-" + strconv.Itoa(i)
+	}
+
+	for _, writePercent := range []int{1, 10, 50} {
+		for _, impl := range implementations {
+			b.Run(fmt.Sprintf("writes=%d%%/%s", writePercent, impl.name), func(b *testing.B) {
+				m := impl.new()
+				for i, name := range names {
+					m.Set(name, i)
+				}
+				var worker atomic.Int64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					// each goroutine walks the keys from its own offset
+					i := int(worker.Add(1)) * 7919
+					for pb.Next() {
+						name := names[i%keys]
+						if i%100 < writePercent {
+							m.Set(name, i)
+						} else {
+							m.Get(name)
+						}
+						i++
+					}
+				})
+			})
+		}
+	}
+}